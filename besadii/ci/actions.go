@@ -0,0 +1,394 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements post-merge actions, which are HTTP requests
+// sent to other services (such as code search indexers) after a
+// change has been merged into the HEAD branch.
+
+package ci
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// postMergeAction is the configuration of a single action.
+type postMergeAction struct {
+	// Human-readable name of the action, used in logs.
+	Name string `json:"name"`
+
+	// Kind of the action, one of:
+	//
+	// - "sourcegraph": trigger a Sourcegraph repository index update
+	// - "zoekt": enqueue the repository on a Zoekt index server
+	// - "docs": notify a documentation rebuild endpoint
+	// - "webhook": send an arbitrary templated JSON body
+	Kind string `json:"kind"`
+	Url  string `json:"url"`
+
+	// Template of the request body for webhooks. See actionData for
+	// the available fields. If unset, all fields are sent.
+	Body string `json:"body"`
+
+	Auth actionAuth `json:"auth"`
+
+	// Number of retries for requests that failed with a network error
+	// or a server error, and the delay before the first retry (as a Go
+	// duration). The delay doubles with each retry.
+	//
+	// Retries are run by the daemon (see 'queue'), so that hooks do
+	// not wait for them. Without a daemon, failed requests are not
+	// retried.
+	Retries    int    `json:"retries"`
+	RetryDelay string `json:"retryDelay"`
+
+	retryDelay time.Duration
+	body       *template.Template
+}
+
+// actionAuth configures authentication for a post-merge action.
+type actionAuth struct {
+	// Type of authentication, one of "token" (as used by
+	// Sourcegraph), "bearer" or "basic". Actions without a type do
+	// not authenticate.
+	Type     string `json:"type"`
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// actionData is the information about a merged change that is made
+// available to post-merge actions.
+type actionData struct {
+	Project string `json:"project"`
+	Ref     string `json:"ref"`
+	Commit  string `json:"commit"`
+	Author  string `json:"author"`
+	Email   string `json:"email"`
+}
+
+// actionTemplateFuncs are available in webhook body templates. The
+// 'json' function must be used to insert values into the body, as it
+// takes care of quoting.
+var actionTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		j, err := json.Marshal(v)
+		return string(j), err
+	},
+}
+
+// validateActions checks the configuration of all post-merge actions
+// and fills in defaults.
+func validateActions(cfg *Config) error {
+	// Older configurations specify a single Sourcegraph instance,
+	// which is turned into an action.
+	if cfg.SourcegraphUrl != "" {
+		cfg.PostMergeActions = append(cfg.PostMergeActions, postMergeAction{
+			Name: "sourcegraph",
+			Kind: "sourcegraph",
+			Url:  cfg.SourcegraphUrl,
+			Auth: actionAuth{Token: cfg.SourcegraphToken},
+		})
+	}
+
+	for i := range cfg.PostMergeActions {
+		action := &cfg.PostMergeActions[i]
+
+		if action.Name == "" {
+			action.Name = action.Kind
+		}
+
+		// Actions are retried by name in the daemon.
+		for _, other := range cfg.PostMergeActions[:i] {
+			if other.Name == action.Name {
+				return fmt.Errorf("duplicate post-merge action %q", action.Name)
+			}
+		}
+
+		if action.Url == "" {
+			return fmt.Errorf("post-merge action %q has no 'url'", action.Name)
+		}
+
+		switch action.Kind {
+		case "sourcegraph":
+			if action.Auth.Type == "" {
+				action.Auth.Type = "token"
+			}
+		case "zoekt", "docs":
+		case "webhook":
+			if action.Body == "" {
+				break
+			}
+
+			tmpl, err := template.New(action.Name).Funcs(actionTemplateFuncs).Parse(action.Body)
+			if err != nil {
+				return fmt.Errorf("invalid body template for post-merge action %q: %w", action.Name, err)
+			}
+			action.body = tmpl
+		default:
+			return fmt.Errorf("post-merge action %q has unknown kind %q", action.Name, action.Kind)
+		}
+
+		if action.Auth.Type == "" && action.Auth.Token != "" {
+			action.Auth.Type = "bearer"
+		}
+
+		switch action.Auth.Type {
+		case "":
+		case "token", "bearer":
+			if action.Auth.Token == "" {
+				return fmt.Errorf("post-merge action %q requires 'auth.token'", action.Name)
+			}
+		case "basic":
+			if action.Auth.User == "" || action.Auth.Password == "" {
+				return fmt.Errorf("post-merge action %q requires 'auth.user' and 'auth.password'", action.Name)
+			}
+		default:
+			return fmt.Errorf("post-merge action %q has unknown auth type %q", action.Name, action.Auth.Type)
+		}
+
+		action.retryDelay = time.Second
+		if action.RetryDelay != "" {
+			delay, err := time.ParseDuration(action.RetryDelay)
+			if err != nil {
+				return fmt.Errorf("invalid 'retryDelay' for post-merge action %q: %w", action.Name, err)
+			}
+			action.retryDelay = delay
+		}
+	}
+
+	return nil
+}
+
+// isHeadRef returns true if the trigger is for the configured HEAD
+// branch (and not for a CL).
+func isHeadRef(cfg *Config, trigger *buildTrigger) bool {
+	return trigger.changeId == "" && trigger.ref == "refs/heads/"+cfg.Branch
+}
+
+// actionRequestBody returns the body and content type of the request
+// sent by an action.
+func actionRequestBody(cfg *Config, action *postMergeAction, data *actionData) ([]byte, string, error) {
+	switch action.Kind {
+	case "sourcegraph":
+		return nil, "", nil
+
+	case "zoekt":
+		form := url.Values{}
+		form.Set("repo", cfg.Repository)
+		return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+
+	case "webhook":
+		if action.body != nil {
+			var body bytes.Buffer
+			err := action.body.Execute(&body, data)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to render body template: %w", err)
+			}
+
+			if !json.Valid(body.Bytes()) {
+				return nil, "", fmt.Errorf("body template did not render valid JSON")
+			}
+
+			return body.Bytes(), "application/json", nil
+		}
+	}
+
+	body, err := json.Marshal(data)
+	return body, "application/json", err
+}
+
+// retryableError is returned for failed action requests that may
+// succeed when retried, i.e. network errors and server errors.
+type retryableError struct {
+	error
+}
+
+func (e retryableError) Unwrap() error {
+	return e.error
+}
+
+// isRetryable returns true if a failed action request should be
+// retried.
+func isRetryable(err error) bool {
+	var retryable retryableError
+	return errors.As(err, &retryable)
+}
+
+// sendAction sends a single request for an action.
+func (s *Service) sendAction(action *postMergeAction, body []byte, contentType string) error {
+	req, err := http.NewRequest("POST", action.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create an HTTP request: %w", err)
+	}
+
+	if contentType != "" {
+		req.Header.Add("Content-Type", contentType)
+	}
+
+	switch action.Auth.Type {
+	case "token":
+		req.Header.Add("Authorization", "token "+action.Auth.Token)
+	case "bearer":
+		req.Header.Add("Authorization", "Bearer "+action.Auth.Token)
+	case "basic":
+		req.SetBasicAuth(action.Auth.User, action.Auth.Password)
+	}
+
+	resp, err := s.actions.Do(req)
+	if err != nil {
+		return retryableError{fmt.Errorf("failed to send request: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		err = fmt.Errorf("received non-success response: %s (%v)", strings.TrimSpace(string(respBody)), resp.Status)
+		if resp.StatusCode >= 500 {
+			return retryableError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// runAction sends the request of a post-merge action once.
+func (s *Service) runAction(action *postMergeAction, data *actionData) error {
+	body, contentType, err := actionRequestBody(s.cfg, action, data)
+	if err != nil {
+		return err
+	}
+
+	return s.sendAction(action, body, contentType)
+}
+
+// findAction returns the configured post-merge action with the given
+// name, or nil if there is none.
+func (s *Service) findAction(name string) *postMergeAction {
+	for i := range s.cfg.PostMergeActions {
+		if s.cfg.PostMergeActions[i].Name == name {
+			return &s.cfg.PostMergeActions[i]
+		}
+	}
+
+	return nil
+}
+
+// actionRetry is the representation of failed post-merge actions that
+// a hook submits to the daemon for retries.
+type actionRetry struct {
+	Actions []string   `json:"actions"`
+	Data    actionData `json:"data"`
+}
+
+// retryActions retries failed post-merge actions with exponential
+// backoff, as configured. This runs in the daemon.
+func (s *Service) retryActions(retry *actionRetry) {
+	for _, name := range retry.Actions {
+		action := s.findAction(name)
+
+		var err error
+		delay := action.retryDelay
+		for attempt := 0; attempt < action.Retries; attempt++ {
+			s.sleep(delay)
+			delay *= 2
+
+			err = s.runAction(action, &retry.Data)
+			if !isRetryable(err) {
+				break
+			}
+		}
+
+		if err != nil {
+			s.log.Err(fmt.Sprintf("post-merge action %q failed after retries: %s", action.Name, err))
+			continue
+		}
+
+		s.log.Info(fmt.Sprintf("ran post-merge action %q for commit %q", action.Name, retry.Data.Commit))
+	}
+}
+
+// handleActionRetry accepts failed post-merge actions submitted by a
+// hook, and retries them after responding.
+func (s *Service) handleActionRetry(w http.ResponseWriter, r *http.Request) {
+	if !s.queueAuthorized(r) {
+		http.Error(w, "invalid queue token", http.StatusUnauthorized)
+		return
+	}
+
+	var retry actionRetry
+	if err := json.NewDecoder(r.Body).Decode(&retry); err != nil {
+		http.Error(w, "invalid action retry", http.StatusBadRequest)
+		return
+	}
+
+	for _, name := range retry.Actions {
+		if s.findAction(name) == nil {
+			http.Error(w, fmt.Sprintf("unknown post-merge action %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.retryActions(&retry)
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// runPostMergeActions runs all configured post-merge actions if the
+// trigger is for the HEAD branch. Actions that should be retried are
+// submitted to the daemon, if there is one.
+func (s *Service) runPostMergeActions(trigger *buildTrigger) {
+	if !isHeadRef(s.cfg, trigger) {
+		return
+	}
+
+	retry := actionRetry{
+		Data: actionData{
+			Project: trigger.project,
+			Ref:     trigger.ref,
+			Commit:  trigger.commit,
+			Author:  trigger.author,
+			Email:   trigger.email,
+		},
+	}
+
+	for i := range s.cfg.PostMergeActions {
+		action := &s.cfg.PostMergeActions[i]
+
+		err := s.runAction(action, &retry.Data)
+		if err == nil {
+			s.log.Info(fmt.Sprintf("ran post-merge action %q for commit %q", action.Name, trigger.commit))
+			continue
+		}
+
+		if action.Retries > 0 && isRetryable(err) && s.cfg.Queue.Url != "" {
+			s.log.Info(fmt.Sprintf("post-merge action %q failed, retrying in the daemon: %s", action.Name, err))
+			retry.Actions = append(retry.Actions, action.Name)
+			continue
+		}
+
+		s.log.Err(fmt.Sprintf("post-merge action %q failed: %s", action.Name, err))
+	}
+
+	if len(retry.Actions) == 0 {
+		return
+	}
+
+	err := s.submitToDaemon("/actions", &retry)
+	if err != nil {
+		s.log.Err(fmt.Sprintf("post-merge actions %q failed and could not be retried: %s", retry.Actions, err))
+	}
+}
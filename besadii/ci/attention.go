@@ -0,0 +1,298 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements updates of the attention set and reviewers of
+// CLs based on build results, so that users are only asked to look at
+// a CL when there is something for them to do.
+
+package ci
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tag of the messages with which besadii reports build results.
+const resultTag = "autogenerated:buildkite~result"
+
+// attentionConfig configures the attention set and reviewer updates
+// made by the post-command hook.
+type attentionConfig struct {
+	// Update the attention set when reporting build results. When a
+	// build fails, the owner is added to the attention set and the
+	// reviewers are removed. When a build passes after an earlier
+	// failure, the reviewers are added back.
+	UpdateAttentionSet bool `json:"updateAttentionSet"`
+
+	// Name of the OWNERS files in the repository tree (e.g. "OWNERS")
+	// from which reviewers are suggested for changes without any.
+	// Suggestions are disabled if unset.
+	OwnersFile string `json:"ownersFile"`
+
+	// Add suggested reviewers to the change, instead of only listing
+	// them in the build result.
+	AddSuggestedReviewers bool `json:"addSuggestedReviewers"`
+}
+
+// enabled returns true if any attention set or reviewer updates are
+// configured.
+func (a *attentionConfig) enabled() bool {
+	return a.UpdateAttentionSet || a.OwnersFile != ""
+}
+
+// validateAttention checks the attention set configuration for errors.
+func validateAttention(cfg *attentionConfig) error {
+	if cfg.AddSuggestedReviewers && cfg.OwnersFile == "" {
+		return fmt.Errorf("'addSuggestedReviewers' requires an 'ownersFile'")
+	}
+
+	if strings.ContainsRune(cfg.OwnersFile, '/') {
+		return fmt.Errorf("'ownersFile' must be a file name, not a path")
+	}
+
+	return nil
+}
+
+// readOwners reads an OWNERS file, which lists one Gerrit account
+// (username or email address) per line. Empty lines and lines starting
+// with '#' are ignored.
+func readOwners(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	owners := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			owners = append(owners, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	return owners, nil
+}
+
+// findOwners returns the owners of the given paths, relative to the
+// root of the repository in the current directory. Each path is owned
+// by the accounts in the nearest OWNERS file in its directory or the
+// directories above it. The result is sorted.
+func findOwners(ownersFile string, paths []string) ([]string, error) {
+	// Paths in the same directory share their owners.
+	cache := make(map[string][]string)
+	var lookup func(dir string) ([]string, error)
+	lookup = func(dir string) ([]string, error) {
+		if owners, ok := cache[dir]; ok {
+			return owners, nil
+		}
+
+		owners, err := readOwners(filepath.Join(filepath.FromSlash(dir), ownersFile))
+		if os.IsNotExist(err) {
+			owners = nil
+			if dir != "." {
+				owners, err = lookup(path.Dir(dir))
+			} else {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		cache[dir] = owners
+		return owners, nil
+	}
+
+	found := make(map[string]bool)
+	for _, p := range paths {
+		owners, err := lookup(path.Dir(p))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, owner := range owners {
+			found[owner] = true
+		}
+	}
+
+	result := []string{}
+	for owner := range found {
+		result = append(result, owner)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// isAccount returns true if an OWNERS entry refers to the account.
+func isAccount(entry string, account *accountInfo) bool {
+	if entry == account.Username {
+		return true
+	}
+
+	if strings.EqualFold(entry, account.Email) {
+		return true
+	}
+
+	for _, email := range account.SecondaryEmails {
+		if strings.EqualFold(entry, email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lastResultFailed returns true if the last build result posted by
+// besadii on the change before this one voted against it. Results
+// posted without a vote (e.g. on work-in-progress changes) do not
+// count.
+func lastResultFailed(change *changeInfo, label string) bool {
+	for i := len(change.Messages) - 1; i >= 0; i-- {
+		m := change.Messages[i]
+		if m.Tag == resultTag {
+			return messageVote(m.Message, label) < 0
+		}
+	}
+	return false
+}
+
+// messageVote returns the vote on a label that Gerrit recorded in the
+// first line of a change message, e.g. "Patch Set 2: Verified-1", or 0
+// if the message has no vote on the label.
+func messageVote(message, label string) int {
+	first, _, _ := strings.Cut(message, "\n")
+	if !strings.HasPrefix(first, "Patch Set ") {
+		return 0
+	}
+
+	_, votes, ok := strings.Cut(first, ": ")
+	if !ok {
+		return 0
+	}
+
+	for _, vote := range strings.Fields(votes) {
+		value, ok := strings.CutPrefix(vote, label)
+		if !ok {
+			continue
+		}
+
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+
+	return 0
+}
+
+// besadiiAccounts returns the IDs of the accounts that have posted
+// build results on the change, which are never asked for attention.
+func besadiiAccounts(change *changeInfo) map[int]bool {
+	accounts := make(map[int]bool)
+	for _, m := range change.Messages {
+		if strings.HasPrefix(m.Tag, "autogenerated:buildkite~") {
+			accounts[m.Author.AccountId] = true
+		}
+	}
+	return accounts
+}
+
+// updateAttention adds attention set and reviewer updates for a build
+// result to the review posting it. Errors are printed, as they must not
+// prevent reporting the build result.
+func (s *Service) updateAttention(review *reviewInput, changeId, patchset string, passed bool) {
+	cfg := &s.cfg.Attention
+
+	change, err := s.gerrit.fetchChangeDetails(changeId)
+	if err != nil {
+		fmt.Fprintf(s.out, "failed to update attention set: %s\n", err)
+		return
+	}
+
+	bots := besadiiAccounts(change)
+	var reviewers []accountInfo
+	for _, r := range change.Reviewers["REVIEWER"] {
+		if r.AccountId != change.Owner.AccountId && !bots[r.AccountId] {
+			reviewers = append(reviewers, r)
+		}
+	}
+
+	if cfg.UpdateAttentionSet {
+		// The updates replace Gerrit's default rules, which would add
+		// the owner for any comment.
+		review.IgnoreDefaultAttentionSetRules = true
+
+		if !passed {
+			review.AddToAttentionSet = append(review.AddToAttentionSet, attentionSetInput{
+				User:   strconv.Itoa(change.Owner.AccountId),
+				Reason: fmt.Sprintf("Build of patchset %s failed", patchset),
+			})
+
+			for _, r := range reviewers {
+				if _, ok := change.AttentionSet[strconv.Itoa(r.AccountId)]; ok {
+					review.RemoveFromAttentionSet = append(review.RemoveFromAttentionSet, attentionSetInput{
+						User:   strconv.Itoa(r.AccountId),
+						Reason: "Waiting for the owner to fix the build",
+					})
+				}
+			}
+		} else if lastResultFailed(change, s.cfg.GerritLabel) {
+			for _, r := range reviewers {
+				review.AddToAttentionSet = append(review.AddToAttentionSet, attentionSetInput{
+					User:   strconv.Itoa(r.AccountId),
+					Reason: fmt.Sprintf("Build of patchset %s passed again", patchset),
+				})
+			}
+		}
+	}
+
+	// Failing changes are not ready for review, and changes that
+	// already have reviewers do not need suggestions.
+	if cfg.OwnersFile == "" || !passed || len(reviewers) > 0 {
+		return
+	}
+
+	paths, err := s.gerrit.fetchChangeFiles(changeId, patchset)
+	if err != nil {
+		fmt.Fprintf(s.out, "failed to suggest reviewers: %s\n", err)
+		return
+	}
+
+	owners, err := findOwners(cfg.OwnersFile, paths)
+	if err != nil {
+		fmt.Fprintf(s.out, "failed to suggest reviewers: %s\n", err)
+		return
+	}
+
+	var suggested []string
+	for _, owner := range owners {
+		if !isAccount(owner, &change.Owner) {
+			suggested = append(suggested, owner)
+		}
+	}
+
+	if len(suggested) == 0 {
+		return
+	}
+
+	if cfg.AddSuggestedReviewers {
+		for _, owner := range suggested {
+			review.Reviewers = append(review.Reviewers, reviewerInput{Reviewer: owner, State: "REVIEWER"})
+		}
+		review.Message += fmt.Sprintf("\n\nAdded reviewers from %s files: %s", cfg.OwnersFile, strings.Join(suggested, ", "))
+	} else {
+		review.Message += fmt.Sprintf("\n\nSuggested reviewers from %s files: %s", cfg.OwnersFile, strings.Join(suggested, ", "))
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	owner    = accountInfo{AccountId: 1, Name: "Jane Doe", Email: "jane@tvl.su", Username: "jane"}
+	reviewer = accountInfo{AccountId: 2, Name: "Sam", Email: "sam@tvl.su", Username: "sam"}
+	idle     = accountInfo{AccountId: 3, Name: "Alex", Email: "alex@tvl.su", Username: "alex"}
+	bot      = accountInfo{AccountId: 100, Name: "besadii", Username: "besadii"}
+)
+
+// addReviewedChange adds change 1234 with reviewers, of which only
+// 'reviewer' is in the attention set, and the given earlier build
+// result.
+func addReviewedChange(env *testEnv, lastResult string) *changeInfo {
+	change := env.gerrit.addChange(1234, 2, "f00")
+	change.Owner = owner
+	change.Reviewers = map[string][]accountInfo{
+		"REVIEWER": {reviewer, idle, bot},
+	}
+	change.AttentionSet = map[string]attentionSetInfo{
+		"2": {Account: reviewer},
+	}
+
+	// Gerrit records the vote at the start of the message.
+	votes := map[string]string{"passed": " Verified+1", "failed": " Verified-1"}
+
+	if lastResult != "" {
+		change.Messages = []changeMessageInfo{{
+			Tag:            resultTag,
+			Message:        fmt.Sprintf("Patch Set 1:%s\n\nBuild of patchset 1 %s: https://buildkite.com/tvl/depot/builds/1", votes[lastResult], lastResult),
+			Author:         bot,
+			RevisionNumber: 1,
+		}}
+	}
+
+	return change
+}
+
+// postResult runs the post-command hook for a build with the given
+// exit status, and returns the posted review.
+func postResult(t *testing.T, env *testEnv, exitStatus string) reviewInput {
+	t.Helper()
+
+	if err := env.s.PostCommand(postCommandEnv(map[string]string{"BUILDKITE_COMMAND_EXIT_STATUS": exitStatus})); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+	return reviews[0].review
+}
+
+func users(inputs []attentionSetInput) string {
+	names := []string{}
+	for _, input := range inputs {
+		names = append(names, input.User)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestAttentionSetFailure(t *testing.T) {
+	env := newTestEnv(t, `{"attention": {"updateAttentionSet": true}}`)
+	addReviewedChange(env, "passed")
+
+	review := postResult(t, env, "1")
+
+	if !review.IgnoreDefaultAttentionSetRules {
+		t.Errorf("expected default attention set rules to be ignored")
+	}
+
+	if got := users(review.AddToAttentionSet); got != "1" {
+		t.Errorf("expected owner to be added to attention set, got %q", got)
+	}
+
+	// Only reviewers in the attention set can be removed from it.
+	if got := users(review.RemoveFromAttentionSet); got != "2" {
+		t.Errorf("expected reviewer to be removed from attention set, got %q", got)
+	}
+}
+
+func TestAttentionSetPassAfterFailure(t *testing.T) {
+	env := newTestEnv(t, `{"attention": {"updateAttentionSet": true}}`)
+	addReviewedChange(env, "failed")
+
+	review := postResult(t, env, "0")
+
+	// besadii itself is never added to the attention set.
+	if got := users(review.AddToAttentionSet); got != "2 3" {
+		t.Errorf("expected reviewers to be added back, got %q", got)
+	}
+
+	if len(review.RemoveFromAttentionSet) != 0 {
+		t.Errorf("unexpected removals from attention set: %+v", review.RemoveFromAttentionSet)
+	}
+}
+
+func TestAttentionSetPassAfterNoVoteFailure(t *testing.T) {
+	env := newTestEnv(t, `{"attention": {"updateAttentionSet": true}}`)
+	change := addReviewedChange(env, "failed")
+
+	// The failed build of a work-in-progress change did not vote.
+	change.Messages[0].Message = "Patch Set 1:\n\nBuild of patchset 1 failed: https://buildkite.com/tvl/depot/builds/1"
+
+	review := postResult(t, env, "0")
+
+	if len(review.AddToAttentionSet) != 0 || len(review.RemoveFromAttentionSet) != 0 {
+		t.Errorf("expected no attention set updates, got %+v", review)
+	}
+}
+
+func TestMessageVote(t *testing.T) {
+	for message, want := range map[string]int{
+		"Patch Set 2: Verified-1\n\nBuild of patchset 2 failed":  -1,
+		"Patch Set 2: Code-Review+2 Verified+1":                  1,
+		"Patch Set 2: -Verified":                                 0,
+		"Patch Set 2:\n\nBuild of patchset 2 failed: Verified-1": 0,
+		"Build of patchset 2 failed: Verified-1":                 0,
+	} {
+		if got := messageVote(message, "Verified"); got != want {
+			t.Errorf("expected vote %d for %q, got %d", want, message, got)
+		}
+	}
+}
+
+func TestAttentionSetPass(t *testing.T) {
+	env := newTestEnv(t, `{"attention": {"updateAttentionSet": true}}`)
+	addReviewedChange(env, "passed")
+
+	review := postResult(t, env, "0")
+
+	if len(review.AddToAttentionSet) != 0 || len(review.RemoveFromAttentionSet) != 0 {
+		t.Errorf("expected no attention set updates, got %+v", review)
+	}
+}
+
+func TestAttentionSetError(t *testing.T) {
+	env := newTestEnv(t, `{"attention": {"updateAttentionSet": true}}`)
+
+	// The change is unknown to Gerrit's REST API, but the result is
+	// still posted.
+	review := postResult(t, env, "1")
+
+	if review.Labels["Verified"] != -1 || len(review.AddToAttentionSet) != 0 {
+		t.Errorf("unexpected review: %+v", review)
+	}
+
+	if !strings.Contains(env.out.String(), "failed to update attention set") {
+		t.Errorf("expected error to be printed, got:\n%s", env.out)
+	}
+}
+
+// writeOwners creates OWNERS files in the current directory.
+func writeOwners(t *testing.T, files map[string]string) {
+	for dir, owners := range files {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create directory: %s", err)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, "OWNERS"), []byte(owners), 0644); err != nil {
+			t.Fatalf("failed to write OWNERS: %s", err)
+		}
+	}
+}
+
+func TestSuggestReviewers(t *testing.T) {
+	chdirTemp(t)
+	writeOwners(t, map[string]string{
+		".":                "# Owners of the repository\nroot@tvl.su\n",
+		"ops":              "sam\njane@tvl.su\n",
+		"ops/besadii/docs": "\n",
+	})
+
+	for name, test := range map[string]struct {
+		add  bool
+		want string
+	}{
+		"listed": {false, "\n\nSuggested reviewers from OWNERS files: root@tvl.su, sam"},
+		"added":  {true, "\n\nAdded reviewers from OWNERS files: root@tvl.su, sam"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, fmt.Sprintf(`{"attention": {"ownersFile": "OWNERS", "addSuggestedReviewers": %t}}`, test.add))
+			change := env.gerrit.addChange(1234, 2, "f00")
+			change.Owner = owner
+			env.gerrit.files["1234"] = []string{
+				"README.md",
+				"ops/besadii/ci/hooks.go",
+				// Empty OWNERS files have no owners.
+				"ops/besadii/docs/index.md",
+			}
+
+			review := postResult(t, env, "0")
+
+			if !strings.HasSuffix(review.Message, test.want) {
+				t.Errorf("unexpected message: %q", review.Message)
+			}
+
+			reviewers := []string{}
+			for _, r := range review.Reviewers {
+				reviewers = append(reviewers, r.Reviewer)
+			}
+
+			want := ""
+			if test.add {
+				want = "root@tvl.su sam"
+			}
+			if got := strings.Join(reviewers, " "); got != want {
+				t.Errorf("unexpected reviewers added: %q", got)
+			}
+		})
+	}
+}
+
+func TestSuggestReviewersSkipped(t *testing.T) {
+	chdirTemp(t)
+	writeOwners(t, map[string]string{".": "root@tvl.su\n"})
+
+	// Changes with reviewers get no suggestions ...
+	env := newTestEnv(t, `{"attention": {"ownersFile": "OWNERS"}}`)
+	addReviewedChange(env, "")
+	if review := postResult(t, env, "0"); strings.Contains(review.Message, "reviewers") {
+		t.Errorf("unexpected suggestions: %q", review.Message)
+	}
+
+	// ... and neither do failing changes.
+	env = newTestEnv(t, `{"attention": {"ownersFile": "OWNERS"}}`)
+	env.gerrit.addChange(1234, 2, "f00").Owner = owner
+	if review := postResult(t, env, "1"); strings.Contains(review.Message, "reviewers") {
+		t.Errorf("unexpected suggestions: %q", review.Message)
+	}
+}
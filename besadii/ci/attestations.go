@@ -0,0 +1,468 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements signed attestations of build results, which
+// allow auditing CI results without trusting whoever can post votes
+// on Gerrit.
+
+package ci
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Prefix of the line containing an attestation, in Gerrit messages and
+// git notes.
+const attestationPrefix = "besadii-attestation: "
+
+// Regular expression matching attestation lines, capturing the payload
+// and signature.
+var attestationRegexp = regexp.MustCompile(`(?m)^` + attestationPrefix + `([A-Za-z0-9_-]+)\.([A-Za-z0-9_-]+)\s*$`)
+
+// attestationConfig configures the signing and verification of
+// attestations.
+type attestationConfig struct {
+	// Path to a PEM-encoded (PKCS #8) ed25519 private key. If set,
+	// the post-command hook embeds an attestation in the Gerrit
+	// message reporting the build result.
+	SigningKey string `json:"signingKey"`
+
+	// Paths to PEM-encoded (PKIX) ed25519 public keys accepted by
+	// 'verify'. Defaults to the public key of 'signingKey'.
+	PublicKeys []string `json:"publicKeys"`
+
+	// Store attestations of all finished builds reported by webhooks
+	// as git notes on the built commits, in the repository at
+	// 'notesRepository'. Notes are pushed to 'notesRemote' (default
+	// "origin") under 'notesRef' (default "refs/notes/besadii").
+	Notes           bool   `json:"notes"`
+	NotesRepository string `json:"notesRepository"`
+	NotesRemote     string `json:"notesRemote"`
+	NotesRef        string `json:"notesRef"`
+}
+
+// validateAttestations fills in defaults of the attestation
+// configuration and checks it for errors.
+func validateAttestations(cfg *attestationConfig) error {
+	if cfg.Notes && (cfg.SigningKey == "" || cfg.NotesRepository == "") {
+		return fmt.Errorf("attestation 'notes' require a 'signingKey' and 'notesRepository'")
+	}
+
+	if cfg.NotesRemote == "" {
+		cfg.NotesRemote = "origin"
+	}
+
+	if cfg.NotesRef == "" {
+		cfg.NotesRef = "refs/notes/besadii"
+	}
+
+	if !strings.HasPrefix(cfg.NotesRef, "refs/notes/") {
+		return fmt.Errorf("invalid attestation 'notesRef' %q", cfg.NotesRef)
+	}
+
+	return nil
+}
+
+// attestation is the signed statement about the result of a build.
+type attestation struct {
+	Commit    string    `json:"commit"`
+	BuildUrl  string    `json:"buildUrl"`
+	Pipeline  string    `json:"pipeline"`
+	Result    string    `json:"result"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// readPEM reads the first PEM block of the given type from a file.
+func readPEM(file, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("no %s found in %s", blockType, file)
+	}
+
+	return block.Bytes, nil
+}
+
+// loadSigningKey loads the configured ed25519 private key.
+func loadSigningKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(file, "PRIVATE KEY")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %w", err)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	ed, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ed25519 key", file)
+	}
+
+	return ed, nil
+}
+
+// loadPublicKeys loads the public keys accepted for attestations.
+func loadPublicKeys(cfg *attestationConfig) ([]ed25519.PublicKey, error) {
+	if len(cfg.PublicKeys) == 0 {
+		if cfg.SigningKey == "" {
+			return nil, fmt.Errorf("no public keys for attestations configured")
+		}
+
+		key, err := loadSigningKey(cfg.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		return []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}, nil
+	}
+
+	keys := []ed25519.PublicKey{}
+	for _, file := range cfg.PublicKeys {
+		der, err := readPEM(file, "PUBLIC KEY")
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public key: %w", err)
+		}
+
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %w", file, err)
+		}
+
+		ed, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key %s is not an ed25519 key", file)
+		}
+		keys = append(keys, ed)
+	}
+
+	return keys, nil
+}
+
+// signAttestation signs an attestation, and returns the line in which
+// it is stored.
+func signAttestation(key ed25519.PrivateKey, a *attestation) (string, error) {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal attestation: %w", err)
+	}
+
+	signature := ed25519.Sign(key, payload)
+	return attestationPrefix + base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// signedAttestation is an attestation found in a message or note,
+// which may not have a valid signature.
+type signedAttestation struct {
+	attestation
+	payload   []byte
+	signature []byte
+}
+
+// findAttestations extracts all attestations from a text. Lines that
+// can not be decoded are ignored.
+func findAttestations(text string) []signedAttestation {
+	found := []signedAttestation{}
+	for _, match := range attestationRegexp.FindAllStringSubmatch(text, -1) {
+		payload, err := base64.RawURLEncoding.DecodeString(match[1])
+		if err != nil {
+			continue
+		}
+
+		signature, err := base64.RawURLEncoding.DecodeString(match[2])
+		if err != nil {
+			continue
+		}
+
+		a := signedAttestation{payload: payload, signature: signature}
+		if err := json.Unmarshal(payload, &a.attestation); err != nil {
+			continue
+		}
+
+		found = append(found, a)
+	}
+
+	return found
+}
+
+// verify checks the signature of an attestation against the accepted
+// public keys.
+func (a *signedAttestation) verify(keys []ed25519.PublicKey) bool {
+	for _, key := range keys {
+		if ed25519.Verify(key, a.payload, a.signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelineName returns the name of the pipeline in attestations.
+func pipelineName(cfg *Config) string {
+	return cfg.BuildkiteOrg + "/" + cfg.BuildkiteProject
+}
+
+// attestResult creates a signed attestation for the post-command hook,
+// to be embedded in the Gerrit message.
+func (s *Service) attestResult(getenv func(string) string, result string) (string, error) {
+	key, err := loadSigningKey(s.cfg.Attestation.SigningKey)
+	if err != nil {
+		return "", err
+	}
+
+	commit := getenv("BUILDKITE_COMMIT")
+	if commit == "" {
+		return "", fmt.Errorf("commit of the build is unknown")
+	}
+
+	return signAttestation(key, &attestation{
+		Commit:    commit,
+		BuildUrl:  getenv("BUILDKITE_BUILD_URL"),
+		Pipeline:  pipelineName(s.cfg),
+		Result:    result,
+		Timestamp: s.now().UTC(),
+	})
+}
+
+// notesGit runs git in the repository in which attestations are stored
+// as notes.
+func (s *Service) notesGit(args ...string) (string, error) {
+	return git(append([]string{"-C", s.cfg.Attestation.NotesRepository}, args...)...)
+}
+
+// fetchNotes replaces the local attestation notes with those of the
+// remote. Nothing is fetched if the remote has no notes yet.
+func fetchNotes(gitCmd func(...string) (string, error), cfg *attestationConfig) error {
+	refs, err := gitCmd("ls-remote", cfg.NotesRemote, cfg.NotesRef)
+	if err != nil {
+		return fmt.Errorf("failed to list notes of %s: %w", cfg.NotesRemote, err)
+	}
+
+	if refs == "" {
+		return nil
+	}
+
+	_, err = gitCmd("fetch", "--quiet", cfg.NotesRemote, "+"+cfg.NotesRef+":"+cfg.NotesRef)
+	if err != nil {
+		return fmt.Errorf("failed to fetch notes from %s: %w", cfg.NotesRemote, err)
+	}
+
+	return nil
+}
+
+// Number of attempts at storing an attestation note, and the delay
+// before the first retry, which doubles with each retry.
+const (
+	noteAttempts   = 4
+	noteRetryDelay = 2 * time.Second
+)
+
+// appendAttestationNote appends a line to the git note of a commit,
+// based on the current notes of the remote, and pushes the notes.
+func (s *Service) appendAttestationNote(commit, line string) error {
+	cfg := &s.cfg.Attestation
+
+	// Notes can only be added to commits known to the repository.
+	if _, err := s.notesGit("cat-file", "-e", commit+"^{commit}"); err != nil {
+		if _, err := s.notesGit("fetch", "--quiet", cfg.NotesRemote, commit); err != nil {
+			return fmt.Errorf("failed to fetch commit %s: %w", commit, err)
+		}
+	}
+
+	// Notes left over from a failed push must not be pushed again if
+	// the remote has no notes yet.
+	if _, err := s.notesGit("update-ref", "-d", cfg.NotesRef); err != nil {
+		return fmt.Errorf("failed to reset local notes: %w", err)
+	}
+
+	if err := fetchNotes(s.notesGit, cfg); err != nil {
+		return err
+	}
+
+	if _, err := s.notesGit("notes", "--ref", cfg.NotesRef, "append", "-m", line, commit); err != nil {
+		return fmt.Errorf("failed to add note to %s: %w", commit, err)
+	}
+
+	if _, err := s.notesGit("push", "--quiet", cfg.NotesRemote, cfg.NotesRef+":"+cfg.NotesRef); err != nil {
+		return fmt.Errorf("failed to push notes to %s: %w", cfg.NotesRemote, err)
+	}
+
+	return nil
+}
+
+// storeAttestationNote appends an attestation to the git note of its
+// commit and pushes the notes. Other attestations may have been pushed
+// concurrently, and the remote may be unavailable, so the whole update
+// is retried a few times.
+func (s *Service) storeAttestationNote(a *attestation) error {
+	key, err := loadSigningKey(s.cfg.Attestation.SigningKey)
+	if err != nil {
+		return err
+	}
+
+	line, err := signAttestation(key, a)
+	if err != nil {
+		return err
+	}
+
+	delay := noteRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = s.appendAttestationNote(a.Commit, line)
+		if err == nil || attempt == noteAttempts {
+			return err
+		}
+
+		s.sleep(delay)
+		delay *= 2
+	}
+}
+
+// attestWebhook stores an attestation of a finished build reported by
+// a webhook as a git note. This happens after the webhook has been
+// acknowledged, and notes are stored one at a time.
+func (s *Service) attestWebhook(hook *buildkiteWebhook) {
+	if hook.Build.State != "passed" && hook.Build.State != "failed" {
+		return
+	}
+
+	number := hook.Build.Number
+	a := &attestation{
+		Commit:    hook.Build.Commit,
+		BuildUrl:  hook.Build.WebUrl,
+		Pipeline:  pipelineName(s.cfg),
+		Result:    hook.Build.State,
+		Timestamp: s.now().UTC(),
+	}
+
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+
+		s.notesMu.Lock()
+		defer s.notesMu.Unlock()
+
+		if err := s.storeAttestationNote(a); err != nil {
+			s.log.Err(fmt.Sprintf("failed to store attestation for build %d: %s", number, err))
+		}
+	}()
+}
+
+// Verify implements the 'verify' command, which checks the attestations
+// of a commit in the git notes of the repository in the current
+// directory and in the messages of the Gerrit changes containing it.
+//
+// It fails unless the latest validly signed attestation of the commit
+// is of a passed build.
+func (s *Service) Verify(args []string) error {
+	cfg := &s.cfg.Attestation
+	var noFetch bool
+
+	flags := newFlagSet("verify")
+	flags.BoolVar(&noFetch, "no-fetch", false, "Do not fetch attestation notes before verifying")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse 'verify' arguments: %w", err)
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: verify [--no-fetch] <commit>")
+	}
+
+	keys, err := loadPublicKeys(cfg)
+	if err != nil {
+		return err
+	}
+
+	commit, err := git("rev-parse", "--verify", flags.Arg(0)+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("unknown commit %q: %w", flags.Arg(0), err)
+	}
+
+	if !noFetch {
+		if err := fetchNotes(git, cfg); err != nil {
+			return err
+		}
+	}
+
+	// Attestations are read from the git note of the commit and the
+	// messages of its changes.
+	type source struct {
+		name string
+		text string
+	}
+	var sources []source
+
+	// 'git notes show' fails if the commit has no note.
+	if note, err := git("notes", "--ref", cfg.NotesRef, "show", commit); err == nil {
+		sources = append(sources, source{"git note", note})
+	}
+
+	if s.gerrit.ssh == nil {
+		var changes []changeInfo
+		err := s.gerrit.get("changes/?o=MESSAGES&q="+url.QueryEscape("commit:"+commit), &changes)
+		if err != nil {
+			return fmt.Errorf("failed to find changes of %s: %w", commit, err)
+		}
+
+		for _, change := range changes {
+			var text strings.Builder
+			for _, m := range change.Messages {
+				text.WriteString(m.Message + "\n")
+			}
+			sources = append(sources, source{fmt.Sprintf("%s %d", s.cfg.GerritChangeName, change.Number), text.String()})
+		}
+	}
+
+	var latest *signedAttestation
+	for _, source := range sources {
+		for _, a := range findAttestations(source.text) {
+			var problem string
+			switch {
+			case !a.verify(keys):
+				problem = "signature does not match any public key"
+			case a.Commit != commit:
+				problem = "attests commit " + a.Commit
+			case a.Pipeline != pipelineName(s.cfg):
+				problem = "attests pipeline " + a.Pipeline
+			}
+
+			if problem != "" {
+				fmt.Fprintf(s.out, "INVALID attestation from %s: %s\n", source.name, problem)
+				continue
+			}
+
+			fmt.Fprintf(s.out, "valid attestation from %s: %s at %s (%s)\n", source.name, a.Result, a.Timestamp.Format(time.RFC3339), a.BuildUrl)
+
+			// A later build of the same commit (e.g. a retry after a
+			// flaky failure, or a failure after a passed build)
+			// determines its result.
+			if latest == nil || !a.Timestamp.Before(latest.Timestamp) {
+				latest = &a
+			}
+		}
+	}
+
+	if latest == nil {
+		return fmt.Errorf("no valid attestation found for %s", commit)
+	}
+
+	if latest.Result != "passed" {
+		return fmt.Errorf("latest valid attestation of %s is of a %s build (%s)", commit, latest.Result, latest.BuildUrl)
+	}
+
+	fmt.Fprintf(s.out, "%s passed CI\n", commit)
+	return nil
+}
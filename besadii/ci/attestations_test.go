@@ -0,0 +1,269 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeys generates an ed25519 key pair, and returns the paths of the
+// PEM files containing them.
+func writeKeys(t *testing.T) (string, string) {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	privateDer, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to marshal private key: %s", err)
+	}
+
+	publicDer, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %s", err)
+	}
+
+	dir := t.TempDir()
+	privatePath := filepath.Join(dir, "key.pem")
+	publicPath := filepath.Join(dir, "key.pub.pem")
+
+	for path, block := range map[string]*pem.Block{
+		privatePath: {Type: "PRIVATE KEY", Bytes: privateDer},
+		publicPath:  {Type: "PUBLIC KEY", Bytes: publicDer},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("failed to write key: %s", err)
+		}
+	}
+
+	return privatePath, publicPath
+}
+
+// signedResult runs the post-command hook for a build of the commit
+// with a signing key, and returns the posted message.
+func signedResult(t *testing.T, key, commit, exitStatus string) string {
+	t.Helper()
+	return signedResultAt(t, key, commit, exitStatus, testTime)
+}
+
+// signedResultAt is like signedResult, for a build finishing at the
+// given time.
+func signedResultAt(t *testing.T, key, commit, exitStatus string, at time.Time) string {
+	t.Helper()
+
+	env := newTestEnv(t, `{"attestation": {"signingKey": "`+key+`"}}`)
+	env.now = at
+	err := env.s.PostCommand(postCommandEnv(map[string]string{
+		"BUILDKITE_COMMIT":              commit,
+		"BUILDKITE_COMMAND_EXIT_STATUS": exitStatus,
+	}))
+	if err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	return env.gerrit.postedReviews()[0].review.Message
+}
+
+func TestVerifyGerritMessages(t *testing.T) {
+	repo := newTestRepo(t)
+	key, public := writeKeys(t)
+	otherKey, _ := writeKeys(t)
+	later := testTime.Add(time.Hour)
+
+	for name, test := range map[string]struct {
+		messages []string
+		want     []string
+		valid    bool
+	}{
+		"passed after failure": {
+			messages: []string{signedResult(t, key, repo.cl, "1"), signedResultAt(t, key, repo.cl, "0", later)},
+			want:     []string{"valid attestation from cl 1234: failed", "valid attestation from cl 1234: passed"},
+			valid:    true,
+		},
+		"failed after passing": {
+			// Only the latest result counts, regardless of the order of
+			// the messages.
+			messages: []string{signedResultAt(t, key, repo.cl, "1", later), signedResult(t, key, repo.cl, "0")},
+			want:     []string{"valid attestation from cl 1234: failed", "valid attestation from cl 1234: passed"},
+		},
+		"failed": {
+			messages: []string{signedResult(t, key, repo.cl, "1")},
+			want:     []string{"valid attestation from cl 1234: failed"},
+		},
+		"wrong key": {
+			messages: []string{signedResult(t, otherKey, repo.cl, "0")},
+			want:     []string{"INVALID attestation from cl 1234: signature does not match any public key"},
+		},
+		"wrong commit": {
+			messages: []string{signedResult(t, key, repo.canon[0], "0")},
+			want:     []string{"INVALID attestation from cl 1234: attests commit " + repo.canon[0]},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, `{"attestation": {"publicKeys": ["`+public+`"]}}`)
+			change := env.gerrit.addChange(1234, 2, repo.cl)
+			for _, msg := range test.messages {
+				change.Messages = append(change.Messages, changeMessageInfo{Tag: resultTag, Message: msg})
+			}
+
+			err := env.s.Verify([]string{"--no-fetch", "HEAD"})
+			if test.valid != (err == nil) {
+				t.Errorf("unexpected verification result: %v", err)
+			}
+
+			for _, want := range test.want {
+				if !strings.Contains(env.out.String(), want) {
+					t.Errorf("expected output to contain %q, got:\n%s", want, env.out)
+				}
+			}
+		})
+	}
+}
+
+func TestSignedResultMessage(t *testing.T) {
+	key, _ := writeKeys(t)
+	msg := signedResult(t, key, "f00", "0")
+
+	found := findAttestations(msg)
+	if len(found) != 1 {
+		t.Fatalf("expected 1 attestation in message, got %d:\n%s", len(found), msg)
+	}
+
+	want := attestation{
+		Commit:    "f00",
+		BuildUrl:  "https://buildkite.com/tvl/depot/builds/1",
+		Pipeline:  "tvl/depot",
+		Result:    "passed",
+		Timestamp: testTime.UTC(),
+	}
+	if found[0].attestation != want {
+		t.Errorf("unexpected attestation: %+v", found[0].attestation)
+	}
+}
+
+func TestAttestationNotes(t *testing.T) {
+	repo := newTestRepo(t)
+	key, _ := writeKeys(t)
+
+	// Notes are pushed to a shared remote, from which the daemon's
+	// repository was cloned.
+	remote := t.TempDir()
+	runGit(t, "init", "--quiet", "--bare", remote)
+	runGit(t, "push", "--quiet", remote, "canon", "cl")
+	runGit(t, "remote", "set-url", "origin", remote)
+
+	notes := filepath.Join(t.TempDir(), "notes")
+	runGit(t, "clone", "--quiet", "--single-branch", "--branch", "canon", remote, notes)
+
+	records := filepath.Join(t.TempDir(), "records.jsonl")
+	env := newTestEnv(t, fmt.Sprintf(`{
+		"recordsPath": %q,
+		"buildkiteWebhookToken": "hook-token",
+		"attestation": {"signingKey": %q, "notes": true, "notesRepository": %q}
+	}`, records, key, notes))
+
+	for number, state := range []string{"failed", "passed", "running"} {
+		env.now = env.now.Add(time.Minute)
+		hook := fmt.Sprintf(`{"event": "build.finished", "build": {"number": %d, "state": %q, "commit": %q, "web_url": "https://buildkite.com/tvl/depot/builds/%d"}, "pipeline": {"slug": "depot"}}`, number+1, state, repo.canon[1], number+1)
+		if w := env.request("POST", "/webhook/buildkite", "hook-token", hook); w.Code != http.StatusNoContent {
+			t.Fatalf("webhook failed with %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// Notes are stored after the webhooks are acknowledged.
+	env.s.background.Wait()
+	if env.log.contains("failed to store attestation") {
+		t.Fatalf("failed to store attestation: %v", env.log.msgs)
+	}
+
+	// The commit of a change is fetched before its note is added.
+	hook := fmt.Sprintf(`{"event": "build.finished", "build": {"number": 4, "state": "passed", "commit": %q}, "pipeline": {"slug": "depot"}}`, repo.cl)
+	if w := env.request("POST", "/webhook/buildkite", "hook-token", hook); w.Code != http.StatusNoContent {
+		t.Fatalf("webhook failed with %d: %s", w.Code, w.Body)
+	}
+	env.s.background.Wait()
+
+	if err := env.s.Verify([]string{repo.canon[1]}); err != nil {
+		t.Fatalf("Verify failed: %s\n%s", err, env.out)
+	}
+
+	out := env.out.String()
+	for _, want := range []string{
+		"valid attestation from git note: failed at 2026-",
+		"valid attestation from git note: passed at 2026-",
+		"(https://buildkite.com/tvl/depot/builds/2)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, out)
+		}
+	}
+
+	// Running builds are not attested.
+	if strings.Contains(out, "builds/3") {
+		t.Errorf("unexpected attestation of running build:\n%s", out)
+	}
+
+	if err := env.s.Verify([]string{"--no-fetch", repo.cl}); err != nil {
+		t.Errorf("Verify of change commit failed: %s", err)
+	}
+}
+
+func TestAttestationNotesRetry(t *testing.T) {
+	repo := newTestRepo(t)
+	key, _ := writeKeys(t)
+
+	// The remote of the notes is unavailable.
+	notes := filepath.Join(t.TempDir(), "notes")
+	runGit(t, "clone", "--quiet", "--single-branch", "--branch", "canon", ".", notes)
+	runGit(t, "-C", notes, "remote", "set-url", "origin", filepath.Join(t.TempDir(), "missing"))
+
+	records := filepath.Join(t.TempDir(), "records.jsonl")
+	env := newTestEnv(t, fmt.Sprintf(`{
+		"recordsPath": %q,
+		"buildkiteWebhookToken": "hook-token",
+		"attestation": {"signingKey": %q, "notes": true, "notesRepository": %q}
+	}`, records, key, notes))
+
+	hook := fmt.Sprintf(`{"event": "build.finished", "build": {"number": 1, "state": "passed", "commit": %q}, "pipeline": {"slug": "depot"}}`, repo.canon[1])
+	if w := env.request("POST", "/webhook/buildkite", "hook-token", hook); w.Code != http.StatusNoContent {
+		t.Fatalf("webhook failed with %d: %s", w.Code, w.Body)
+	}
+	env.s.background.Wait()
+
+	if len(env.sleeps) != noteAttempts-1 || env.sleeps[0] != noteRetryDelay {
+		t.Errorf("unexpected retry delays: %v", env.sleeps)
+	}
+
+	if !env.log.contains("failed to store attestation for build 1") {
+		t.Errorf("expected failure to be logged, got %v", env.log.msgs)
+	}
+}
+
+func TestAttestationConfiguration(t *testing.T) {
+	for name, attestation := range map[string]string{
+		"notes without key":        `{"notes": true, "notesRepository": "/var/lib/besadii/depot"}`,
+		"notes without repository": `{"notes": true, "signingKey": "/etc/besadii/key.pem"}`,
+		"invalid ref":              `{"notesRef": "refs/heads/notes"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := `{"repository": "depot", "branch": "canon", "attestation": ` + attestation + `}`
+			if _, err := ParseConfig([]byte(cfg)); err == nil || !strings.Contains(err.Error(), "attestation") {
+				t.Errorf("expected attestation configuration error, got %v", err)
+			}
+		})
+	}
+}
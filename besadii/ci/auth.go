@@ -0,0 +1,449 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the ways in which besadii can authenticate to
+// Gerrit: HTTP basic auth, bearer tokens, OAuth2 client credentials,
+// cookies and SSH.
+
+package ci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gerritAuthConfig configures how besadii authenticates to Gerrit.
+type gerritAuthConfig struct {
+	// Authentication type, one of "basic" (the default, using
+	// 'gerritUser' and 'gerritPassword'), "bearer", "oauth2",
+	// "cookie" or "ssh".
+	Type string `json:"type"`
+
+	// Token for bearer authentication.
+	Token string `json:"token"`
+
+	// Token endpoint and client credentials for the OAuth2 client
+	// credentials grant.
+	TokenUrl     string   `json:"tokenUrl"`
+	ClientId     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+
+	// Netscape-format cookie file (like ~/.gitcookies, which is the
+	// default) for cookie authentication.
+	CookieFile string `json:"cookieFile"`
+
+	// Connection settings for SSH-only Gerrit installations. The host
+	// defaults to the host of 'gerritUrl', the port to 29418 and the
+	// user to 'gerritUser'. Reviews are subject to the request
+	// timeout of the Gerrit transport.
+	SshHost    string `json:"sshHost"`
+	SshPort    int    `json:"sshPort"`
+	SshUser    string `json:"sshUser"`
+	SshKey     string `json:"sshKey"`
+	SshCommand string `json:"sshCommand"`
+}
+
+// gerritAuth authenticates requests to the Gerrit REST API.
+type gerritAuth interface {
+	authenticate(req *http.Request) error
+}
+
+// tokenResetter is implemented by authentication methods with cached
+// credentials, which are discarded when Gerrit rejects them.
+type tokenResetter interface {
+	reset()
+}
+
+// validateGerritAuth fills in defaults of the Gerrit authentication
+// configuration and checks that it is complete.
+func validateGerritAuth(cfg *Config) error {
+	auth := &cfg.GerritAuth
+
+	switch auth.Type {
+	case "", "basic":
+		auth.Type = "basic"
+		if cfg.GerritUser == "" || cfg.GerritPassword == "" {
+			return fmt.Errorf("missing Gerrit configuration (required: gerritUrl, gerritUser, gerritPassword)")
+		}
+
+	case "bearer":
+		if auth.Token == "" {
+			return fmt.Errorf("Gerrit bearer authentication requires 'token'")
+		}
+
+	case "oauth2":
+		if auth.TokenUrl == "" || auth.ClientId == "" || auth.ClientSecret == "" {
+			return fmt.Errorf("Gerrit OAuth2 authentication requires 'tokenUrl', 'clientId' and 'clientSecret'")
+		}
+
+	case "cookie":
+		if auth.CookieFile == "" {
+			usr, err := user.Current()
+			if err != nil {
+				return fmt.Errorf("failed to get current user: %w", err)
+			}
+			auth.CookieFile = path.Join(usr.HomeDir, ".gitcookies")
+		}
+
+	case "ssh":
+		if auth.SshHost == "" {
+			u, err := url.Parse(cfg.GerritUrl)
+			if err != nil {
+				return fmt.Errorf("invalid 'gerritUrl': %w", err)
+			}
+			auth.SshHost = u.Hostname()
+		}
+
+		if auth.SshPort == 0 {
+			auth.SshPort = 29418
+		}
+
+		if auth.SshUser == "" {
+			auth.SshUser = cfg.GerritUser
+		}
+
+		if auth.SshCommand == "" {
+			auth.SshCommand = "ssh"
+		}
+
+		if auth.SshHost == "" || auth.SshUser == "" {
+			return fmt.Errorf("Gerrit SSH authentication requires 'sshHost' and 'sshUser' (or 'gerritUser')")
+		}
+
+		// Without the REST API, besadii can only post reviews.
+		if policyNeedsChange(cfg) {
+			return fmt.Errorf("change policies can not be used with Gerrit SSH authentication")
+		}
+
+		if cfg.Identities.LookupAccounts {
+			return fmt.Errorf("'lookupAccounts' can not be used with Gerrit SSH authentication")
+		}
+
+		if cfg.FailureRobotComments {
+			return fmt.Errorf("'failureRobotComments' can not be used with Gerrit SSH authentication")
+		}
+
+		if cfg.Attention.enabled() {
+			return fmt.Errorf("attention set updates can not be used with Gerrit SSH authentication")
+		}
+
+		for _, rule := range cfg.BuildRules {
+			if len(rule.Hashtags) > 0 || len(rule.Paths) > 0 {
+				return fmt.Errorf("build rules matching hashtags or paths can not be used with Gerrit SSH authentication")
+			}
+		}
+
+	default:
+		return fmt.Errorf("unknown Gerrit authentication type %q", auth.Type)
+	}
+
+	if cfg.GerritUrl == "" {
+		return fmt.Errorf("missing Gerrit configuration (required: gerritUrl)")
+	}
+
+	return nil
+}
+
+// newGerritClient creates a Gerrit client using the configured
+// authentication method.
+func newGerritClient(cfg *Config, client *http.Client, now func() time.Time) (*gerritClient, error) {
+	g := &gerritClient{
+		url:    cfg.GerritUrl,
+		client: client,
+	}
+
+	auth := &cfg.GerritAuth
+	switch auth.Type {
+	case "basic":
+		g.auth = &basicAuth{user: cfg.GerritUser, password: cfg.GerritPassword}
+
+	case "bearer":
+		g.auth = &bearerAuth{token: auth.Token}
+
+	case "oauth2":
+		g.auth = &oauth2Auth{
+			tokenUrl:     auth.TokenUrl,
+			clientId:     auth.ClientId,
+			clientSecret: auth.ClientSecret,
+			scopes:       auth.Scopes,
+			client:       client,
+			now:          now,
+		}
+
+	case "cookie":
+		cookies, err := loadGerritCookies(auth.CookieFile, cfg.GerritUrl, now())
+		if err != nil {
+			return nil, err
+		}
+		g.auth = &cookieAuth{cookies: cookies}
+
+	case "ssh":
+		g.ssh = &sshReviewer{
+			command: auth.SshCommand,
+			host:    auth.SshHost,
+			port:    auth.SshPort,
+			user:    auth.SshUser,
+			key:     auth.SshKey,
+			timeout: cfg.Transport.Gerrit.timeout,
+		}
+	}
+
+	return g, nil
+}
+
+// basicAuth authenticates with a username and HTTP password.
+type basicAuth struct {
+	user     string
+	password string
+}
+
+func (b *basicAuth) authenticate(req *http.Request) error {
+	req.SetBasicAuth(b.user, b.password)
+	return nil
+}
+
+// bearerAuth authenticates with a static token.
+type bearerAuth struct {
+	token string
+}
+
+func (b *bearerAuth) authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return nil
+}
+
+// oauth2Auth authenticates with access tokens obtained through the
+// OAuth2 client credentials grant. Tokens are cached until shortly
+// before they expire.
+type oauth2Auth struct {
+	tokenUrl     string
+	clientId     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+	now          func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Tokens are refreshed this long before they expire, to avoid using
+// them during a request.
+const oauth2ExpiryMargin = time.Minute
+
+// oauth2Token is the token response of an OAuth2 server.
+//
+// https://www.rfc-editor.org/rfc/rfc6749#section-5.1
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (o *oauth2Auth) authenticate(req *http.Request) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.token == "" || !o.now().Before(o.expiry.Add(-oauth2ExpiryMargin)) {
+		if err := o.refresh(); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+o.token)
+	return nil
+}
+
+func (o *oauth2Auth) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.token = ""
+}
+
+// refresh fetches a new access token. The caller must hold the lock.
+func (o *oauth2Auth) refresh() error {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.scopes) > 0 {
+		form.Set("scope", strings.Join(o.scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", o.tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create OAuth2 token request: %w", err)
+	}
+
+	req.SetBasicAuth(url.QueryEscape(o.clientId), url.QueryEscape(o.clientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to request OAuth2 token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read OAuth2 token response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("received non-success response from OAuth2 server: %s (%v)", strings.TrimSpace(string(body)), resp.Status)
+	}
+
+	var token oauth2Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		return fmt.Errorf("failed to unmarshal OAuth2 token response: %w", err)
+	}
+
+	if token.AccessToken == "" || (token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer")) {
+		return fmt.Errorf("OAuth2 server returned no bearer token")
+	}
+
+	o.token = token.AccessToken
+
+	// Tokens without an expiry time are refreshed every hour.
+	expiresIn := time.Hour
+	if token.ExpiresIn > 0 {
+		expiresIn = time.Duration(token.ExpiresIn) * time.Second
+	}
+	o.expiry = o.now().Add(expiresIn)
+
+	return nil
+}
+
+// cookieAuth authenticates with cookies, e.g. from a .gitcookies file.
+type cookieAuth struct {
+	cookies []*http.Cookie
+}
+
+func (c *cookieAuth) authenticate(req *http.Request) error {
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	return nil
+}
+
+// loadGerritCookies reads the cookies for the Gerrit URL from a
+// Netscape-format cookie file.
+//
+// https://curl.se/docs/http-cookies.html
+func loadGerritCookies(file, gerritUrl string, now time.Time) ([]*http.Cookie, error) {
+	u, err := url.Parse(gerritUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'gerritUrl': %w", err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Gerrit cookie file: %w", err)
+	}
+
+	host := u.Hostname()
+	cookies := []*http.Cookie{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expiry, name, value
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+
+		domain := strings.TrimPrefix(fields[0], ".")
+		if host != domain && !(fields[1] == "TRUE" && strings.HasSuffix(host, "."+domain)) {
+			continue
+		}
+
+		// besadii only uses the authenticated API below /a/.
+		if !strings.HasPrefix(u.Path+"/a/", fields[2]) {
+			continue
+		}
+
+		if fields[3] == "TRUE" && u.Scheme != "https" {
+			continue
+		}
+
+		// An expiry of 0 marks session cookies.
+		if expiry, err := strconv.ParseInt(fields[4], 10, 64); err == nil && expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+
+		cookies = append(cookies, &http.Cookie{Name: fields[5], Value: fields[6]})
+	}
+
+	if len(cookies) == 0 {
+		return nil, fmt.Errorf("no valid cookies for %s found in %s", host, file)
+	}
+
+	return cookies, nil
+}
+
+// sshReviewer posts reviews with the 'gerrit review' command over SSH,
+// for installations in which the REST API is not available to bots.
+//
+// The command is killed once the request timeout of the Gerrit
+// transport expires, so that an unreachable SSH port can not hang
+// the hook.
+//
+// https://gerrit-review.googlesource.com/Documentation/cmd-review.html
+type sshReviewer struct {
+	command string
+	host    string
+	port    int
+	user    string
+	key     string
+	timeout time.Duration
+}
+
+func (s *sshReviewer) postReview(changeId, patchset string, review *reviewInput) error {
+	input, err := json.Marshal(review)
+	if err != nil {
+		return fmt.Errorf("failed to marshal review: %w", err)
+	}
+
+	args := []string{"-p", strconv.Itoa(s.port), "-o", "BatchMode=yes"}
+	if s.key != "" {
+		args = append(args, "-i", s.key)
+	}
+	args = append(args, s.user+"@"+s.host, "gerrit", "review", "--json", changeId+","+patchset)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.command, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("failed to post review over SSH: timed out after %s", s.timeout)
+		}
+
+		return fmt.Errorf("failed to post review over SSH: %w (output: %s)", err, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGerritBearerAuth(t *testing.T) {
+	env := newTestEnv(t, `{"gerritAuth": {"type": "bearer", "token": "gerrit-token"}}`)
+	env.gerrit.authorized = func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer gerrit-token"
+	}
+
+	if err := env.s.PostCommand(postCommandEnv(nil)); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	if n := len(env.gerrit.postedReviews()); n != 1 {
+		t.Errorf("expected 1 review, got %d", n)
+	}
+}
+
+// fakeTokenServer is an OAuth2 server issuing numbered tokens.
+type fakeTokenServer struct {
+	*httptest.Server
+	issued []string
+}
+
+func newFakeTokenServer(t *testing.T) *fakeTokenServer {
+	ts := &fakeTokenServer{}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "besadii" || secret != "client-secret" || r.FormValue("grant_type") != "client_credentials" {
+			http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+
+		if r.FormValue("scope") != "gerrit:read gerrit:review" {
+			http.Error(w, `{"error": "invalid_scope"}`, http.StatusBadRequest)
+			return
+		}
+
+		token := fmt.Sprintf("token-%d", len(ts.issued)+1)
+		ts.issued = append(ts.issued, token)
+		json.NewEncoder(w).Encode(oauth2Token{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   3600,
+		})
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// valid returns true if the request uses the newest issued token.
+func (ts *fakeTokenServer) valid(r *http.Request) bool {
+	return len(ts.issued) > 0 && r.Header.Get("Authorization") == "Bearer "+ts.issued[len(ts.issued)-1]
+}
+
+func TestGerritOAuth2(t *testing.T) {
+	ts := newFakeTokenServer(t)
+	env := newTestEnv(t, `{"gerritAuth": {
+		"type": "oauth2",
+		"tokenUrl": "`+ts.URL+`",
+		"clientId": "besadii",
+		"clientSecret": "client-secret",
+		"scopes": ["gerrit:read", "gerrit:review"]
+	}}`)
+	env.gerrit.authorized = ts.valid
+
+	post := func() {
+		t.Helper()
+		if err := env.s.PostCommand(postCommandEnv(nil)); err != nil {
+			t.Fatalf("PostCommand failed: %s", err)
+		}
+	}
+
+	// Tokens are reused while they are valid ...
+	post()
+	env.now = env.now.Add(30 * time.Minute)
+	post()
+
+	if len(ts.issued) != 1 {
+		t.Errorf("expected token to be cached, got %d tokens", len(ts.issued))
+	}
+
+	// ... and refreshed shortly before they expire.
+	env.now = env.now.Add(29*time.Minute + 30*time.Second)
+	post()
+
+	if len(ts.issued) != 2 {
+		t.Errorf("expected token to be refreshed, got %d tokens", len(ts.issued))
+	}
+
+	// Revoked tokens are replaced when Gerrit rejects them.
+	ts.issued = append(ts.issued, "revoked")
+	post()
+
+	if len(ts.issued) != 4 {
+		t.Errorf("expected token to be replaced, got %d tokens", len(ts.issued))
+	}
+
+	if n := len(env.gerrit.postedReviews()); n != 4 {
+		t.Errorf("expected 4 reviews, got %d", n)
+	}
+}
+
+func TestGerritOAuth2Error(t *testing.T) {
+	ts := newFakeTokenServer(t)
+	env := newTestEnv(t, `{"gerritAuth": {
+		"type": "oauth2",
+		"tokenUrl": "`+ts.URL+`",
+		"clientId": "besadii",
+		"clientSecret": "wrong"
+	}}`)
+
+	err := env.s.PostCommand(postCommandEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), "invalid_client") {
+		t.Errorf("expected token error, got %v", err)
+	}
+}
+
+func TestGerritCookieAuth(t *testing.T) {
+	cookieFile := filepath.Join(t.TempDir(), ".gitcookies")
+	cookies := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		"127.0.0.1\tFALSE\t/\tFALSE\t0\to\tgit-besadii=secret",
+		"#HttpOnly_.0.0.1\tTRUE\t/\tFALSE\t2147483647\tsession\tabc",
+		"127.0.0.1\tFALSE\t/\tFALSE\t1000\texpired\tyes",
+		"127.0.0.1\tFALSE\t/\tTRUE\t0\tsecure\tyes",
+		"cl.tvl.fyi\tFALSE\t/\tTRUE\t0\to\tgit-other=secret",
+	}, "\n")
+	if err := os.WriteFile(cookieFile, []byte(cookies), 0600); err != nil {
+		t.Fatalf("failed to write cookie file: %s", err)
+	}
+
+	env := newTestEnv(t, `{"gerritAuth": {"type": "cookie", "cookieFile": "`+cookieFile+`"}}`)
+	env.gerrit.authorized = func(r *http.Request) bool {
+		return r.Header.Get("Cookie") == "o=git-besadii=secret; session=abc"
+	}
+
+	if err := env.s.PostCommand(postCommandEnv(nil)); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	if n := len(env.gerrit.postedReviews()); n != 1 {
+		t.Errorf("expected 1 review, got %d", n)
+	}
+}
+
+// fakeSSH writes a script that records its arguments and input in
+// place of the ssh command.
+func fakeSSH(t *testing.T, exitCode int) (string, string) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "ssh")
+	record := filepath.Join(dir, "invocation")
+
+	content := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\ncat >> %s\necho 'fatal: not permitted' >&2\nexit %d\n", record, record, exitCode)
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatalf("failed to write fake ssh: %s", err)
+	}
+
+	return script, record
+}
+
+func TestGerritSSH(t *testing.T) {
+	ssh, record := fakeSSH(t, 0)
+	env := newTestEnv(t, `{"gerritAuth": {"type": "ssh", "sshKey": "/etc/besadii/id_ed25519", "sshCommand": "`+ssh+`"}}`)
+
+	if err := env.s.PostCommand(postCommandEnv(nil)); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	invocation, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatalf("ssh was not invoked: %s", err)
+	}
+
+	args, input, _ := strings.Cut(string(invocation), "\n")
+	wantArgs := "-p 29418 -o BatchMode=yes -i /etc/besadii/id_ed25519 besadii@127.0.0.1 gerrit review --json 1234,2"
+	if args != wantArgs {
+		t.Errorf("unexpected ssh arguments:\n got: %s\nwant: %s", args, wantArgs)
+	}
+
+	var review reviewInput
+	if err := json.Unmarshal([]byte(input), &review); err != nil {
+		t.Fatalf("invalid review input %q: %s", input, err)
+	}
+
+	if review.Labels["Verified"] != 1 || !strings.Contains(review.Message, "passed") {
+		t.Errorf("unexpected review: %+v", review)
+	}
+
+	// The REST API is never used.
+	if n := len(env.gerrit.postedReviews()); n != 0 {
+		t.Errorf("expected no REST reviews, got %d", n)
+	}
+
+	err = env.s.WipStateChanged(stateChangedArgs("wip", "false"))
+	if err == nil || !strings.Contains(err.Error(), "not available with SSH authentication") {
+		t.Errorf("expected REST API error, got %v", err)
+	}
+}
+
+func TestGerritSSHError(t *testing.T) {
+	ssh, _ := fakeSSH(t, 1)
+	env := newTestEnv(t, `{"gerritAuth": {"type": "ssh", "sshCommand": "`+ssh+`"}}`)
+
+	err := env.s.PostCommand(postCommandEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), "fatal: not permitted") {
+		t.Errorf("expected ssh error with output, got %v", err)
+	}
+}
+
+func TestGerritSSHTimeout(t *testing.T) {
+	dir := t.TempDir()
+	ssh := filepath.Join(dir, "ssh")
+	if err := os.WriteFile(ssh, []byte("#!/bin/sh\nsleep 10\n"), 0755); err != nil {
+		t.Fatalf("failed to write fake ssh: %s", err)
+	}
+
+	env := newTestEnv(t, `{
+		"gerritAuth": {"type": "ssh", "sshCommand": "`+ssh+`"},
+		"transport": {"gerrit": {"timeout": "100ms"}}
+	}`)
+
+	start := time.Now()
+	err := env.s.PostCommand(postCommandEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Errorf("expected ssh timeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ssh was not killed after its timeout, took %s", elapsed)
+	}
+}
+
+func TestGerritAuthConfiguration(t *testing.T) {
+	base := `"repository": "depot", "branch": "canon", "gerritUrl": "https://cl.tvl.fyi",
+		"buildkiteOrg": "tvl", "buildkiteProject": "depot", "buildkiteToken": "t"`
+
+	for name, auth := range map[string]string{
+		"missing password":   `"gerritUser": "besadii"`,
+		"unknown type":       `"gerritAuth": {"type": "kerberos"}`,
+		"missing token":      `"gerritAuth": {"type": "bearer"}`,
+		"missing client":     `"gerritAuth": {"type": "oauth2", "tokenUrl": "https://sso.tvl.fyi/token"}`,
+		"ssh without user":   `"gerritAuth": {"type": "ssh"}`,
+		"ssh with policies":  `"gerritUser": "besadii", "gerritAuth": {"type": "ssh"}, "changePolicy": {"wip": "skip"}`,
+		"ssh with paths":     `"gerritUser": "besadii", "gerritAuth": {"type": "ssh"}, "buildRules": [{"paths": ["web"]}]`,
+		"ssh with attention": `"gerritUser": "besadii", "gerritAuth": {"type": "ssh"}, "attention": {"updateAttentionSet": true}`,
+	} {
+		if _, err := ParseConfig([]byte(`{` + base + `, ` + auth + `}`)); err == nil {
+			t.Errorf("%s: expected configuration error", name)
+		}
+	}
+
+	cfg, err := ParseConfig([]byte(`{` + base + `, "gerritUser": "besadii", "gerritAuth": {"type": "ssh"}}`))
+	if err != nil {
+		t.Fatalf("unexpected configuration error: %s", err)
+	}
+
+	if a := cfg.GerritAuth; a.SshHost != "cl.tvl.fyi" || a.SshPort != 29418 || a.SshUser != "besadii" || a.SshCommand != "ssh" {
+		t.Errorf("unexpected SSH defaults: %+v", a)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2019-2020 Google LLC.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ci implements besadii, a configurable integration between
+// Gerrit and Buildkite.
+//
+// It supports the following modes & operations:
+//
+// Gerrit (patchset-created, change-merged) hooks:
+// - Trigger Buildkite CI builds
+// - Run post-merge actions, e.g. code search index updates
+//
+// Gerrit (wip-state-changed, private-state-changed) hooks:
+// - Trigger builds of changes that became ready for review
+//
+// Buildkite (post-command) hook:
+// - Submit CL verification status back to Gerrit
+// - Summarise failed build steps on the CL
+// - Summarise test reports on the CL and as a Buildkite annotation
+// - Update the attention set and suggest reviewers from OWNERS files
+// - Sign build results with an ed25519 key
+//
+// Buildkite pipeline commands:
+// - parent-drvmap: fetch the derivation map of a change's merge-base
+// - drvmap-diff: compare derivation maps, reporting rebuilt targets on the CL
+//
+// Auditing:
+// - verify: check the signed attestations of a commit's build results
+//
+// Daemon mode:
+// - Record build state changes reported by Buildkite webhooks
+// - Serve a build status dashboard
+// - Queue build triggers submitted by hooks, limiting concurrent builds
+// - Store signed attestations of finished builds as git notes
+package ci
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Logger is the subset of *syslog.Writer used by besadii.
+type Logger interface {
+	Info(m string) error
+	Err(m string) error
+}
+
+// Options configures the dependencies of a Service. Unset fields are
+// replaced with the defaults used in production.
+type Options struct {
+	// Log receives messages about operations that do not report
+	// their result to the caller. Defaults to discarding messages.
+	Log Logger
+
+	// HTTP client used for all requests to Gerrit, Buildkite and
+	// other services. Defaults to clients created from the transport
+	// configuration of each endpoint.
+	Client *http.Client
+
+	// Clock used for timestamps. Defaults to time.Now.
+	Now func() time.Time
+
+	// Function used to wait between retries. Defaults to time.Sleep.
+	Sleep func(time.Duration)
+
+	// Output receives messages intended for the user running a hook,
+	// e.g. in Buildkite job logs. Defaults to standard output.
+	Output io.Writer
+}
+
+// Service performs besadii's operations using a configuration and
+// injected dependencies.
+type Service struct {
+	cfg         *Config
+	log         Logger
+	now         func() time.Time
+	sleep       func(time.Duration)
+	out         io.Writer
+	gerrit      *gerritClient
+	buildkite   *buildkiteClient
+	actions     *http.Client
+	queue       *triggerQueue
+	queueClient *http.Client
+
+	// Builds parsed from the records file by the daemon.
+	records buildCache
+
+	// Tracks work that the daemon does after responding to requests.
+	background sync.WaitGroup
+
+	// Serialises updates of the attestation notes.
+	notesMu sync.Mutex
+}
+
+// discardLog is a Logger that drops all messages.
+type discardLog struct{}
+
+func (discardLog) Info(string) error { return nil }
+func (discardLog) Err(string) error  { return nil }
+
+// New creates a Service for the given configuration.
+func New(cfg *Config, opts Options) (*Service, error) {
+	s := &Service{
+		cfg:   cfg,
+		log:   opts.Log,
+		now:   opts.Now,
+		sleep: opts.Sleep,
+		out:   opts.Output,
+		queue: newTriggerQueue(),
+	}
+
+	if s.log == nil {
+		s.log = discardLog{}
+	}
+
+	if s.now == nil {
+		s.now = time.Now
+	}
+
+	if s.sleep == nil {
+		s.sleep = time.Sleep
+	}
+
+	if s.out == nil {
+		s.out = os.Stdout
+	}
+
+	gerrit, err := endpointClient(opts.Client, &cfg.Transport.Gerrit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gerrit client: %w", err)
+	}
+
+	buildkite, err := endpointClient(opts.Client, &cfg.Transport.Buildkite)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Buildkite client: %w", err)
+	}
+
+	s.actions, err = endpointClient(opts.Client, &cfg.Transport.Actions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create post-merge action client: %w", err)
+	}
+
+	s.queueClient, err = endpointClient(opts.Client, &cfg.Transport.Queue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trigger queue client: %w", err)
+	}
+
+	s.gerrit, err = newGerritClient(cfg, gerrit, s.now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gerrit client: %w", err)
+	}
+
+	s.buildkite = &buildkiteClient{
+		pipelineUrl: fmt.Sprintf("%s/organizations/%s/pipelines/%s", cfg.BuildkiteApiUrl, cfg.BuildkiteOrg, cfg.BuildkiteProject),
+		token:       cfg.BuildkiteToken,
+		client:      buildkite,
+	}
+
+	return s, nil
+}
+
+// endpointClient returns the client to use for an endpoint, which is
+// either the client overriding all endpoints or one created from the
+// endpoint's transport configuration.
+func endpointClient(override *http.Client, t *transportConfig) (*http.Client, error) {
+	if override != nil {
+		return override, nil
+	}
+
+	return newHTTPClient(t)
+}
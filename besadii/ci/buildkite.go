@@ -0,0 +1,296 @@
+// Copyright 2019-2020 Google LLC.
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the Buildkite REST API client used by besadii.
+
+package ci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// buildkiteClient performs authenticated requests against the
+// Buildkite REST API for the configured pipeline.
+type buildkiteClient struct {
+	// API URL of the pipeline, under which all of its resources are
+	// located.
+	pipelineUrl string
+	token       string
+	client      *http.Client
+}
+
+type Author struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Build is the representation of a Buildkite build as described on
+// https://buildkite.com/docs/apis/rest-api/builds#create-a-build
+type Build struct {
+	Commit        string            `json:"commit"`
+	Branch        string            `json:"branch"`
+	Author        Author            `json:"author"`
+	Env           map[string]string `json:"env"`
+	MetaData      map[string]string `json:"meta_data,omitempty"`
+	CleanCheckout bool              `json:"clean_checkout,omitempty"`
+}
+
+// BuildResponse is the representation of Buildkite's success response
+// after triggering a build. This has many fields, but we only need
+// a few of them.
+type buildResponse struct {
+	WebUrl string `json:"web_url"`
+	Number int    `json:"number"`
+}
+
+// buildkiteJob is the representation of a job in a Buildkite build as
+// described on https://buildkite.com/docs/apis/rest-api/builds
+type buildkiteJob struct {
+	Id         string `json:"id"`
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	ExitStatus *int   `json:"exit_status"`
+	WebUrl     string `json:"web_url"`
+	RawLogUrl  string `json:"raw_log_url"`
+}
+
+// buildkiteBuild is the representation of a Buildkite build as
+// returned by the API.
+type buildkiteBuild struct {
+	Number int               `json:"number"`
+	State  string            `json:"state"`
+	Env    map[string]string `json:"env"`
+	Jobs   []buildkiteJob    `json:"jobs"`
+}
+
+// buildkiteArtifact is the representation of a build artifact as
+// described on https://buildkite.com/docs/apis/rest-api/artifacts
+type buildkiteArtifact struct {
+	Path        string `json:"path"`
+	State       string `json:"state"`
+	DownloadUrl string `json:"download_url"`
+}
+
+// buildkiteAnnotation is the representation of a build annotation as
+// described on https://buildkite.com/docs/apis/rest-api/annotations
+type buildkiteAnnotation struct {
+	Style   string `json:"style"`
+	Context string `json:"context"`
+	Body    string `json:"body"`
+	Append  bool   `json:"append"`
+}
+
+// newRequest creates a request to the Buildkite API. Paths starting
+// with a slash are relative to the pipeline, other paths are used as
+// full URLs (e.g. for job logs).
+func (b *buildkiteClient) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	url := path
+	if strings.HasPrefix(path, "/") {
+		url = b.pipelineUrl + path
+	}
+
+	var reader io.Reader
+	if body != nil {
+		j, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reader = bytes.NewReader(j)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create an HTTP request: %w", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+b.token)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	return req, nil
+}
+
+// do sends a request to the Buildkite API and returns the response
+// body.
+func (b *buildkiteClient) do(method, path string, body interface{}, expectedStatus int) ([]byte, error) {
+	respBody, _, err := b.doWithHeader(method, path, body, expectedStatus)
+	return respBody, err
+}
+
+// doWithHeader sends a request to the Buildkite API and returns the
+// response body and headers.
+func (b *buildkiteClient) doWithHeader(method, path string, body interface{}, expectedStatus int) ([]byte, http.Header, error) {
+	req, err := b.newRequest(method, path, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// This might indicate a temporary error on the Buildkite side.
+		return nil, nil, fmt.Errorf("failed to send Buildkite request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Buildkite response body: %w", err)
+	}
+
+	if resp.StatusCode != expectedStatus {
+		return nil, nil, fmt.Errorf("received non-success response from Buildkite: %s (%v)", strings.TrimSpace(string(respBody)), resp.Status)
+	}
+
+	return respBody, resp.Header, nil
+}
+
+// get performs a GET request and returns the raw response body.
+func (b *buildkiteClient) get(path string) ([]byte, error) {
+	return b.do("GET", path, nil, http.StatusOK)
+}
+
+// getTail fetches at most the last n bytes of a (log) file, starting
+// at the beginning of a line. Only the requested range is transferred
+// if the server supports range requests.
+func (b *buildkiteClient) getTail(path string, n int) ([]byte, error) {
+	req, err := b.newRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=-%d", n))
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send Buildkite request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("received non-success response from Buildkite: %s (%v)", strings.TrimSpace(string(respBody)), resp.Status)
+	}
+
+	tail, truncated, err := readTail(resp.Body, n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Buildkite response body: %w", err)
+	}
+
+	// A partial response is truncated unless it starts at the
+	// beginning of the file ("bytes 0-...").
+	if resp.StatusCode == http.StatusPartialContent && !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-") {
+		truncated = true
+	}
+
+	// The first line of a truncated file is incomplete.
+	if truncated {
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+
+	return tail, nil
+}
+
+// readTail reads r to the end, keeping only its last n bytes, and
+// returns whether anything was discarded.
+func readTail(r io.Reader, n int) ([]byte, bool, error) {
+	buf := make([]byte, 0, n)
+	chunk := make([]byte, 32*1024)
+	truncated := false
+
+	for {
+		k, err := r.Read(chunk)
+		buf = append(buf, chunk[:k]...)
+		if len(buf) > n {
+			buf = append(buf[:0], buf[len(buf)-n:]...)
+			truncated = true
+		}
+
+		if err == io.EOF {
+			return buf, truncated, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// getJSON performs a GET request and unmarshals the response into the
+// target.
+func (b *buildkiteClient) getJSON(path string, target interface{}) error {
+	body, err := b.get(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(body, target)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal Buildkite response: %w", err)
+	}
+
+	return nil
+}
+
+// nextPage returns the URL of the next page of a paginated response,
+// which is linked in its Link header, or an empty string on the last
+// page.
+//
+// https://buildkite.com/docs/apis/rest-api#pagination
+func nextPage(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		target, params, _ := strings.Cut(link, ";")
+		for _, param := range strings.Split(params, ";") {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(target), "<>")
+			}
+		}
+	}
+
+	return ""
+}
+
+// listArtifacts returns all artifacts of a build, from all pages of
+// the response.
+func (b *buildkiteClient) listArtifacts(build string) ([]buildkiteArtifact, error) {
+	artifacts := []buildkiteArtifact{}
+	next := "/builds/" + build + "/artifacts?per_page=100"
+	for next != "" {
+		body, header, err := b.doWithHeader("GET", next, nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []buildkiteArtifact
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal Buildkite response: %w", err)
+		}
+
+		artifacts = append(artifacts, page...)
+		next = nextPage(header)
+	}
+
+	return artifacts, nil
+}
+
+// createBuild triggers a new build of the pipeline.
+func (b *buildkiteClient) createBuild(build *Build) (*buildResponse, error) {
+	respBody, err := b.do("POST", "/builds", build, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+
+	var buildResp buildResponse
+	err = json.Unmarshal(respBody, &buildResp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal build response: %w", err)
+	}
+
+	return &buildResp, nil
+}
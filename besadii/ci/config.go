@@ -0,0 +1,241 @@
+// Copyright 2019-2020 Google LLC.
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements loading and validation of besadii's
+// configuration.
+
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"time"
+)
+
+// Regular expression to check if gerritChangeName valid. The
+// limitation could be what is allowed for a git branch name. For now
+// we want to have a stricter limitation for readability and ease of
+// use.
+var gerritChangeNameRegexp = `^[a-z0-9]+$`
+var gerritChangeNameCheck = regexp.MustCompile(gerritChangeNameRegexp)
+
+// Config is the besadii configuration file structure.
+type Config struct {
+	// Required configuration for Buildkite<>Gerrit monorepo
+	// integration.
+	Repository       string `json:"repository"`
+	Branch           string `json:"branch"`
+	GerritUrl        string `json:"gerritUrl"`
+	GerritUser       string `json:"gerritUser"`
+	GerritPassword   string `json:"gerritPassword"`
+	GerritLabel      string `json:"gerritLabel"`
+	BuildkiteOrg     string `json:"buildkiteOrg"`
+	BuildkiteProject string `json:"buildkiteProject"`
+	BuildkiteToken   string `json:"buildkiteToken"`
+	GerritChangeName string `json:"gerritChangeName"`
+
+	// Optional authentication method for Gerrit. Defaults to HTTP
+	// basic auth with 'gerritUser' and 'gerritPassword'.
+	GerritAuth gerritAuthConfig `json:"gerritAuth"`
+
+	// Optional base URL of the Buildkite REST API, e.g. for use with
+	// a proxy. Defaults to Buildkite's public API.
+	BuildkiteApiUrl string `json:"buildkiteApiUrl"`
+
+	// Optional HTTP transport settings (CA bundles, client
+	// certificates, proxies, timeouts) for each kind of endpoint.
+	Transport transportConfigs `json:"transport"`
+
+	// Optional mapping of Gerrit users to the authors of builds.
+	Identities identityConfig `json:"identities"`
+
+	// Optional policies for building work-in-progress and private
+	// changes of the configured repository and branch.
+	ChangePolicy changePolicy `json:"changePolicy"`
+
+	// Optional rules for selecting Buildkite settings (e.g. agent
+	// queues) of triggered builds.
+	BuildRules []buildRule `json:"buildRules"`
+
+	// Optional actions to run after changes are merged into the HEAD
+	// branch.
+	PostMergeActions []postMergeAction `json:"postMergeActions"`
+
+	// Deprecated configuration for Sourcegraph trigger updates, use
+	// a post-merge action of kind "sourcegraph" instead.
+	SourcegraphUrl   string `json:"sourcegraphUrl"`
+	SourcegraphToken string `json:"sourcegraphToken"`
+
+	// Optional path to the file in which besadii records triggered
+	// builds and their results. Required for daemon mode.
+	RecordsPath string `json:"recordsPath"`
+
+	// Optional time for which records of builds are kept after their
+	// last update, e.g. "720h" (the default). The daemon periodically
+	// removes older records from the file. "0" keeps all records.
+	RecordsRetention string `json:"recordsRetention"`
+
+	recordsRetention time.Duration
+
+	// Optional trigger queue, through which hooks submit builds to the
+	// daemon to limit the number of builds running at once. A daemon
+	// serves the single route of its configuration, so deployments
+	// with several routes run one daemon (and queue) per route.
+	Queue queueConfig `json:"queue"`
+
+	// Optional configuration for daemon mode.
+	DaemonListen          string `json:"daemonListen"`
+	BuildkiteWebhookToken string `json:"buildkiteWebhookToken"`
+	DashboardHeadBuilds   int    `json:"dashboardHeadBuilds"`
+
+	// Optional configuration for failure summaries posted by the
+	// post-command hook. Setting 'failureLogLines' to a negative
+	// value disables summaries.
+	FailureLogLines      int  `json:"failureLogLines"`
+	FailureRobotComments bool `json:"failureRobotComments"`
+
+	// Optional attention set and reviewer updates made by the
+	// post-command hook.
+	Attention attentionConfig `json:"attention"`
+
+	// Optional signing of build results, and storage of the signed
+	// attestations.
+	Attestation attestationConfig `json:"attestation"`
+
+	// Optional test reports, summarised by the post-command hook on
+	// Buildkite and the CL.
+	TestReports testReportConfig `json:"testReports"`
+}
+
+func defaultConfigLocation() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current user: %w", err)
+	}
+
+	return path.Join(usr.HomeDir, "besadii.json"), nil
+}
+
+// LoadConfig loads the configuration from the file specified in
+// $BESADII_CONFIG, or from ~/besadii.json by default.
+func LoadConfig() (*Config, error) {
+	configPath := os.Getenv("BESADII_CONFIG")
+
+	if configPath == "" {
+		var err error
+		configPath, err = defaultConfigLocation()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config location: %w", err)
+		}
+	}
+
+	configJson, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load besadii config: %w", err)
+	}
+
+	return ParseConfig(configJson)
+}
+
+// ParseConfig parses and validates a JSON configuration, filling in
+// defaults for unset optional values.
+func ParseConfig(configJson []byte) (*Config, error) {
+	var cfg Config
+	err := json.Unmarshal(configJson, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal besadii config: %w", err)
+	}
+
+	// The default Gerrit label to set is 'Verified', unless specified otherwise.
+	if cfg.GerritLabel == "" {
+		cfg.GerritLabel = "Verified"
+	}
+
+	// The default text referring to a Gerrit Change in BuildKite.
+	if cfg.GerritChangeName == "" {
+		cfg.GerritChangeName = "cl"
+	}
+	if !gerritChangeNameCheck.MatchString(cfg.GerritChangeName) {
+		return nil, fmt.Errorf("invalid 'gerritChangeName': %s", cfg.GerritChangeName)
+	}
+
+	if cfg.BuildkiteApiUrl == "" {
+		cfg.BuildkiteApiUrl = "https://api.buildkite.com/v2"
+	}
+
+	// The dashboard shows the last 20 HEAD builds, unless specified
+	// otherwise.
+	if cfg.DashboardHeadBuilds == 0 {
+		cfg.DashboardHeadBuilds = 20
+	}
+
+	if cfg.RecordsRetention == "" {
+		cfg.RecordsRetention = "720h"
+	}
+
+	cfg.recordsRetention, err = time.ParseDuration(cfg.RecordsRetention)
+	if err != nil || cfg.recordsRetention < 0 {
+		return nil, fmt.Errorf("invalid 'recordsRetention' %q", cfg.RecordsRetention)
+	}
+
+	// Failure summaries include the last 20 lines of each failed job,
+	// unless specified otherwise.
+	if cfg.FailureLogLines == 0 {
+		cfg.FailureLogLines = 20
+	}
+
+	// Rudimentary config validation logic
+	if cfg.SourcegraphUrl != "" && cfg.SourcegraphToken == "" {
+		return nil, fmt.Errorf("'SourcegraphToken' must be set if 'SourcegraphUrl' is set")
+	}
+
+	if err := validateTransports(&cfg.Transport); err != nil {
+		return nil, err
+	}
+
+	if err := validateActions(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := validatePolicy(&cfg.ChangePolicy); err != nil {
+		return nil, err
+	}
+
+	if err := validateIdentities(&cfg.Identities); err != nil {
+		return nil, err
+	}
+
+	if err := validateQueue(&cfg.Queue); err != nil {
+		return nil, err
+	}
+
+	if err := validateTestReports(&cfg.TestReports); err != nil {
+		return nil, err
+	}
+
+	if err := validateAttention(&cfg.Attention); err != nil {
+		return nil, err
+	}
+
+	if err := validateAttestations(&cfg.Attestation); err != nil {
+		return nil, err
+	}
+
+	if cfg.Repository == "" || cfg.Branch == "" {
+		return nil, fmt.Errorf("missing repository configuration (required: repository, branch)")
+	}
+
+	if err := validateGerritAuth(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.BuildkiteOrg == "" || cfg.BuildkiteProject == "" || cfg.BuildkiteToken == "" {
+		return nil, fmt.Errorf("mising Buildkite configuration (required: buildkiteOrg, buildkiteProject, buildkiteToken)")
+	}
+
+	return &cfg, nil
+}
@@ -0,0 +1,318 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements besadii's daemon mode, in which it receives
+// build state changes from Buildkite webhooks, serves a dashboard
+// displaying the status of builds and optionally queues build
+// triggers submitted by hooks.
+
+package ci
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// buildkiteWebhook is the subset of a Buildkite build webhook payload
+// that besadii uses.
+//
+// https://buildkite.com/docs/apis/webhooks/pipelines/build-events
+type buildkiteWebhook struct {
+	Event string `json:"event"`
+
+	Build struct {
+		Number int               `json:"number"`
+		State  string            `json:"state"`
+		WebUrl string            `json:"web_url"`
+		Commit string            `json:"commit"`
+		Branch string            `json:"branch"`
+		Env    map[string]string `json:"env"`
+		Author *Author           `json:"author"`
+	} `json:"build"`
+
+	Pipeline struct {
+		Slug string `json:"slug"`
+	} `json:"pipeline"`
+}
+
+// changeBuilds groups all builds of a single change, for display on
+// the dashboard.
+type changeBuilds struct {
+	ChangeId string
+	Link     string
+	Builds   []*buildStatus
+}
+
+// dashboardPage is the data passed to the dashboard template.
+type dashboardPage struct {
+	Title      string
+	Branch     string
+	ChangeName string
+	Active     []*buildStatus
+	Head       []*buildStatus
+	Changes    []changeBuilds
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: sans-serif; max-width: 70em; margin: auto; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1em; }
+td, th { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+.passed { color: #080; }
+.failed, .canceled { color: #b00; }
+.scheduled, .running { color: #a60; }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+{{ define "builds" }}
+<table>
+<tr><th>Build</th><th>State</th><th>Branch</th><th>Commit</th><th>Author</th><th>Started</th></tr>
+{{ range . }}
+<tr>
+<td><a href="{{ .Url }}">#{{ .Build }}</a></td>
+<td class="{{ .State }}">{{ .State }}</td>
+<td>{{ .Branch }}{{ if .Patchset }} (patchset {{ .Patchset }}){{ end }}</td>
+<td><code>{{ printf "%.12s" .Commit }}</code></td>
+<td>{{ if .Username }}<a href="/authors/{{ .Username }}">{{ or .Author .Username }}</a>{{ else }}{{ .Author }}{{ end }}</td>
+<td>{{ .Started.Format "2006-01-02 15:04 MST" }}</td>
+</tr>
+{{ end }}
+</table>
+{{ end }}
+{{ if .Active }}
+<h2>Queued and running builds</h2>
+{{ template "builds" .Active }}
+{{ end }}
+{{ if .Head }}
+<h2>Builds of {{ .Branch }}</h2>
+{{ template "builds" .Head }}
+{{ end }}
+{{ range .Changes }}
+<h2><a href="/changes/{{ .ChangeId }}">{{ $.ChangeName }}/{{ .ChangeId }}</a> (<a href="{{ .Link }}">Gerrit</a>)</h2>
+{{ template "builds" .Builds }}
+{{ end }}
+</body>
+</html>
+`))
+
+// Maximum number of changes to show on the dashboard's front page.
+const dashboardChanges = 50
+
+// groupByChange collects builds of changes in the order in which the
+// changes were last built.
+func groupByChange(cfg *Config, builds []*buildStatus, limit int) []changeBuilds {
+	changes := []changeBuilds{}
+	index := make(map[string]int)
+
+	for _, b := range builds {
+		if b.ChangeId == "" {
+			continue
+		}
+
+		i, ok := index[b.ChangeId]
+		if !ok {
+			if len(changes) == limit {
+				continue
+			}
+
+			i = len(changes)
+			index[b.ChangeId] = i
+			changes = append(changes, changeBuilds{
+				ChangeId: b.ChangeId,
+				Link:     fmt.Sprintf("%s/c/%s/+/%s", cfg.GerritUrl, cfg.Repository, b.ChangeId),
+			})
+		}
+
+		changes[i].Builds = append(changes[i].Builds, b)
+	}
+
+	return changes
+}
+
+// renderDashboard renders a dashboard page for the given builds.
+func renderDashboard(cfg *Config, w http.ResponseWriter, title string, builds []*buildStatus, withHead bool) {
+	page := dashboardPage{
+		Title:      title,
+		Branch:     cfg.Branch,
+		ChangeName: cfg.GerritChangeName,
+		Changes:    groupByChange(cfg, builds, dashboardChanges),
+	}
+
+	for _, b := range builds {
+		if !b.Finished() {
+			page.Active = append(page.Active, b)
+		}
+
+		if withHead && b.ChangeId == "" && branchName(b.Branch) == cfg.Branch && len(page.Head) < cfg.DashboardHeadBuilds {
+			page.Head = append(page.Head, b)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// filterBuilds returns all builds for which the predicate is true.
+func filterBuilds(builds []*buildStatus, keep func(*buildStatus) bool) []*buildStatus {
+	filtered := []*buildStatus{}
+	for _, b := range builds {
+		if keep(b) {
+			filtered = append(filtered, b)
+		}
+	}
+
+	return filtered
+}
+
+// handleWebhook records build state changes sent by Buildkite.
+func (s *Service) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg
+	token := r.Header.Get("X-Buildkite-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.BuildkiteWebhookToken)) != 1 {
+		http.Error(w, "invalid webhook token", http.StatusUnauthorized)
+		return
+	}
+
+	var hook buildkiteWebhook
+	err := json.NewDecoder(r.Body).Decode(&hook)
+	if err != nil {
+		http.Error(w, "invalid webhook payload", http.StatusBadRequest)
+		return
+	}
+
+	// Only build events for the configured pipeline are relevant,
+	// but Buildkite should still see them as delivered.
+	if !strings.HasPrefix(hook.Event, "build.") || hook.Pipeline.Slug != cfg.BuildkiteProject {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rec := record{
+		Build:    hook.Build.Number,
+		Url:      hook.Build.WebUrl,
+		State:    hook.Build.State,
+		Branch:   branchName(hook.Build.Branch),
+		Commit:   hook.Build.Commit,
+		ChangeId: hook.Build.Env["GERRIT_CHANGE_ID"],
+		Patchset: hook.Build.Env["GERRIT_PATCHSET"],
+	}
+
+	if hook.Build.Author != nil {
+		rec.Author = hook.Build.Author.Name
+		rec.Email = hook.Build.Author.Email
+	}
+
+	err = s.appendRecord(&rec)
+	if err != nil {
+		s.log.Err(fmt.Sprintf("failed to record webhook for build %d: %s", rec.Build, err))
+		http.Error(w, "failed to record build", http.StatusInternalServerError)
+		return
+	}
+
+	if stateRank(rec.State) == 3 {
+		s.queue.finished(rec.Build)
+
+		if cfg.Attestation.Notes {
+			s.attestWebhook(&hook)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// dashboardHandler returns a handler that loads the current build
+// records and renders them with the given function.
+func (s *Service) dashboardHandler(render func(http.ResponseWriter, *http.Request, []*buildStatus)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		builds, err := s.loadBuilds()
+		if err != nil {
+			s.log.Err(fmt.Sprintf("failed to load build records: %s", err))
+			http.Error(w, "failed to load build records", http.StatusInternalServerError)
+			return
+		}
+
+		render(w, r, builds)
+	}
+}
+
+// Handler returns the HTTP handler served in daemon mode, which
+// receives Buildkite webhooks and serves the build status dashboard.
+func (s *Service) Handler() http.Handler {
+	cfg := s.cfg
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /webhook/buildkite", s.handleWebhook)
+
+	if cfg.Queue.Token != "" {
+		mux.HandleFunc("POST /triggers", s.handleQueueTrigger)
+		mux.HandleFunc("POST /actions", s.handleActionRetry)
+	}
+
+	mux.Handle("GET /{$}", s.dashboardHandler(func(w http.ResponseWriter, r *http.Request, builds []*buildStatus) {
+		renderDashboard(cfg, w, "besadii: "+cfg.Repository, builds, true)
+	}))
+
+	mux.Handle("GET /changes/{change}", s.dashboardHandler(func(w http.ResponseWriter, r *http.Request, builds []*buildStatus) {
+		change := r.PathValue("change")
+		builds = filterBuilds(builds, func(b *buildStatus) bool {
+			return b.ChangeId == change
+		})
+
+		title := fmt.Sprintf("besadii: %s/%s", cfg.GerritChangeName, change)
+		renderDashboard(cfg, w, title, builds, false)
+	}))
+
+	// Authors are identified by their Gerrit username, as the dashboard
+	// does not publish email addresses.
+	mux.Handle("GET /authors/{username}", s.dashboardHandler(func(w http.ResponseWriter, r *http.Request, builds []*buildStatus) {
+		username := r.PathValue("username")
+		builds = filterBuilds(builds, func(b *buildStatus) bool {
+			return b.Username == username
+		})
+
+		// HEAD builds of an author are the builds of their merged
+		// changes, which are interesting on this page.
+		renderDashboard(cfg, w, "besadii: builds by "+username, builds, true)
+	}))
+
+	return mux
+}
+
+// Daemon runs besadii as a long-lived server.
+func (s *Service) Daemon() error {
+	cfg := s.cfg
+	if cfg.DaemonListen == "" || cfg.RecordsPath == "" {
+		return fmt.Errorf("missing daemon configuration (required: daemonListen, recordsPath)")
+	}
+
+	if cfg.BuildkiteWebhookToken == "" {
+		return fmt.Errorf("missing daemon configuration (required: buildkiteWebhookToken)")
+	}
+
+	if cfg.recordsRetention > 0 {
+		go s.runCompaction()
+	}
+
+	if cfg.Queue.Token != "" {
+		if err := s.loadQueue(); err != nil {
+			return fmt.Errorf("failed to load trigger queue: %w", err)
+		}
+
+		go s.runQueue()
+	}
+
+	s.log.Info(fmt.Sprintf("besadii daemon listening on %s", cfg.DaemonListen))
+	return http.ListenAndServe(cfg.DaemonListen, s.Handler())
+}
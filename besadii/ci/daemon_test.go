@@ -0,0 +1,202 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDaemonTestEnv(t *testing.T) *testEnv {
+	records := filepath.Join(t.TempDir(), "records.jsonl")
+	return newTestEnv(t, `{"recordsPath": "`+records+`", "buildkiteWebhookToken": "hook-token"}`)
+}
+
+func (env *testEnv) request(method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("X-Buildkite-Token", token)
+	}
+
+	w := httptest.NewRecorder()
+	env.s.Handler().ServeHTTP(w, req)
+	return w
+}
+
+func TestWebhookAuthentication(t *testing.T) {
+	env := newDaemonTestEnv(t)
+
+	if w := env.request("POST", "/webhook/buildkite", "", `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected missing token to be rejected, got %d", w.Code)
+	}
+
+	if w := env.request("POST", "/webhook/buildkite", "wrong", `{}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected wrong token to be rejected, got %d", w.Code)
+	}
+
+	if w := env.request("POST", "/webhook/buildkite", "hook-token", `{`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid payload to be rejected, got %d", w.Code)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	env := newDaemonTestEnv(t)
+
+	// Builds triggered by the hooks are recorded as scheduled.
+	if err := env.s.PatchsetCreated(patchsetCreatedArgs()); err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	if err := env.s.ChangeMerged(changeMergedArgs()); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	// Buildkite reports the CL build as finished, and another pipeline
+	// (which is ignored) as running.
+	for _, hook := range []string{
+		`{"event": "build.finished", "build": {"number": 1, "state": "failed"}, "pipeline": {"slug": "depot"}}`,
+		`{"event": "build.running", "build": {"number": 7, "state": "running"}, "pipeline": {"slug": "other"}}`,
+	} {
+		if w := env.request("POST", "/webhook/buildkite", "hook-token", hook); w.Code != http.StatusNoContent {
+			t.Fatalf("webhook failed with %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// Out of order deliveries do not move builds back in time.
+	late := `{"event": "build.running", "build": {"number": 1, "state": "running"}, "pipeline": {"slug": "depot"}}`
+	if w := env.request("POST", "/webhook/buildkite", "hook-token", late); w.Code != http.StatusNoContent {
+		t.Fatalf("webhook failed with %d: %s", w.Code, w.Body)
+	}
+
+	builds, err := env.s.loadBuilds()
+	if err != nil {
+		t.Fatalf("failed to load builds: %s", err)
+	}
+
+	if len(builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(builds))
+	}
+
+	// Builds are ordered newest first.
+	if builds[0].Build != 2 || builds[0].State != "scheduled" || builds[0].Branch != "canon" {
+		t.Errorf("unexpected HEAD build status: %+v", builds[0])
+	}
+
+	if builds[1].Build != 1 || builds[1].State != "failed" || builds[1].ChangeId != "1234" || !builds[1].Started.Equal(testTime) {
+		t.Errorf("unexpected CL build status: %+v", builds[1])
+	}
+
+	w := env.request("GET", "/", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("dashboard failed with %d: %s", w.Code, w.Body)
+	}
+
+	page := w.Body.String()
+	for _, want := range []string{
+		"Queued and running builds",
+		"Builds of canon",
+		`<a href="/changes/1234">cl/1234</a>`,
+		`<td class="failed">failed</td>`,
+		`<a href="/authors/jane">Jane Doe</a>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected dashboard to contain %q", want)
+		}
+	}
+
+	// Email addresses of authors are not published.
+	if strings.Contains(page, "@tvl.su") {
+		t.Errorf("expected dashboard not to contain email addresses: %s", page)
+	}
+
+	w = env.request("GET", "/changes/1234", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#1") || strings.Contains(w.Body.String(), "#2") {
+		t.Errorf("unexpected change page (%d): %s", w.Code, w.Body)
+	}
+
+	w = env.request("GET", "/authors/sam", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#2") || strings.Contains(w.Body.String(), "#1<") {
+		t.Errorf("unexpected author page (%d): %s", w.Code, w.Body)
+	}
+}
+
+func TestDaemonConfiguration(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	if err := env.s.Daemon(); err == nil || !strings.Contains(err.Error(), "missing daemon configuration") {
+		t.Errorf("expected configuration error, got %v", err)
+	}
+}
+
+func TestRecordsCompaction(t *testing.T) {
+	records := filepath.Join(t.TempDir(), "records.jsonl")
+	env := newTestEnv(t, `{"recordsPath": "`+records+`", "recordsRetention": "24h"}`)
+
+	for _, rec := range []*record{
+		{Time: testTime.Add(-48 * time.Hour), Build: 1, State: "scheduled"},
+		{Time: testTime.Add(-47 * time.Hour), Build: 1, State: "passed"},
+		{Build: 2, State: "scheduled", Username: "jane"},
+		{Queued: &queuedTrigger{Ref: "refs/heads/canon", Commit: "a1"}},
+		{Queued: &queuedTrigger{Ref: "refs/heads/canon", Commit: "b2"}},
+		{Dequeued: &queuedTrigger{Ref: "refs/heads/canon", Commit: "a1"}},
+	} {
+		if err := env.s.appendRecord(rec); err != nil {
+			t.Fatalf("failed to append record: %s", err)
+		}
+	}
+
+	buildNumbers := func() string {
+		t.Helper()
+		builds, err := env.s.loadBuilds()
+		if err != nil {
+			t.Fatalf("failed to load builds: %s", err)
+		}
+
+		numbers := []string{}
+		for _, b := range builds {
+			numbers = append(numbers, strconv.Itoa(b.Build))
+		}
+		return strings.Join(numbers, " ")
+	}
+
+	// Expired builds are not shown, even before compaction.
+	if got := buildNumbers(); got != "2" {
+		t.Errorf("unexpected builds before compaction: %s", got)
+	}
+
+	if err := env.s.compactRecords(); err != nil {
+		t.Fatalf("failed to compact records: %s", err)
+	}
+
+	kept := []string{}
+	err := readRecords(env.cfg, func(rec *record) {
+		if rec.Queued != nil {
+			kept = append(kept, "queued "+rec.Queued.Commit)
+		} else {
+			kept = append(kept, fmt.Sprintf("build %d", rec.Build))
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to read records: %s", err)
+	}
+
+	if got := strings.Join(kept, ", "); got != "build 2, queued b2" {
+		t.Errorf("unexpected records after compaction: %s", got)
+	}
+
+	// Records appended to the new file are picked up by the cache.
+	if err := env.s.appendRecord(&record{Build: 3, State: "scheduled"}); err != nil {
+		t.Fatalf("failed to append record: %s", err)
+	}
+
+	if got := buildNumbers(); got != "3 2" {
+		t.Errorf("unexpected builds after compaction: %s", got)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements commands working with the derivation maps
+// ("drvmaps") of builds: the lookup of the derivation map of the commit
+// a change is based on, which CI uses to skip building targets that
+// have not changed, and the comparison of two derivation maps.
+
+package ci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// drvmapEntry is a single target in a derivation map, as created by
+// mkDrvmap in //buildkite.
+type drvmapEntry struct {
+	DrvPath  string   `json:"drvPath"`
+	AttrPath []string `json:"attrPath"`
+}
+
+// drvmap maps readTree target labels to their derivations.
+type drvmap map[string]drvmapEntry
+
+// parseDrvmap parses and checks a derivation map.
+func parseDrvmap(data []byte) (drvmap, error) {
+	var m drvmap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid derivation map: %w", err)
+	}
+
+	for label, entry := range m {
+		if entry.DrvPath == "" {
+			return nil, fmt.Errorf("invalid derivation map: target %q has no 'drvPath'", label)
+		}
+	}
+
+	return m, nil
+}
+
+// git runs a git command in the current directory and returns its
+// output.
+func git(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("'git %s' failed: %w (%s)", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// findDrvmapArtifact looks for a derivation map among the artifacts of
+// the builds of a commit, and returns its download URL.
+func (s *Service) findDrvmapArtifact(commit, artifactPath string, exclude int) (string, error) {
+	query := url.Values{}
+	query.Set("commit", commit)
+
+	var builds []buildkiteBuild
+	err := s.buildkite.getJSON("/builds?"+query.Encode(), &builds)
+	if err != nil {
+		return "", fmt.Errorf("failed to list builds of commit %s: %w", commit, err)
+	}
+
+	if len(builds) == 0 {
+		fmt.Fprintf(s.out, "  %.12s: no builds\n", commit)
+		return "", nil
+	}
+
+	// Builds are listed newest first. The derivation map only depends
+	// on the commit, so builds of both changes and the HEAD branch
+	// are suitable.
+	for _, b := range builds {
+		if b.Number == exclude {
+			continue
+		}
+
+		artifacts, err := s.buildkite.listArtifacts(strconv.Itoa(b.Number))
+		if err != nil {
+			return "", fmt.Errorf("failed to list artifacts of build %d: %w", b.Number, err)
+		}
+
+		for _, a := range artifacts {
+			if a.Path == artifactPath && a.State == "finished" {
+				fmt.Fprintf(s.out, "  %.12s: found %s in build #%d\n", commit, artifactPath, b.Number)
+				return a.DownloadUrl, nil
+			}
+		}
+
+		fmt.Fprintf(s.out, "  %.12s: build #%d (%s) has no %s\n", commit, b.Number, b.State, artifactPath)
+	}
+
+	return "", nil
+}
+
+// ParentDrvmap implements the 'parent-drvmap' command, run in a
+// Buildkite job in a checkout of the commit being built. It looks up
+// the derivation map of the commit at which the change forked off the
+// HEAD branch (or of its nearest ancestor on the branch with one),
+// and writes it to a file for pipeline generation.
+//
+// If no derivation map is found, no file is written and all targets
+// will be built.
+func (s *Service) ParentDrvmap(args []string, getenv func(string) string) error {
+	cfg := s.cfg
+	var commit, remote, output, artifact string
+	var maxAncestors int
+	var noFetch bool
+
+	flags := newFlagSet("parent-drvmap")
+	flags.StringVar(&commit, "commit", "HEAD", "Commit that is being built")
+	flags.StringVar(&remote, "remote", "origin", "Git remote of the repository")
+	flags.BoolVar(&noFetch, "no-fetch", false, "Do not fetch the HEAD branch before finding the merge-base")
+	flags.StringVar(&output, "output", "tmp/parent-target-map.json", "File to write the derivation map to")
+	flags.StringVar(&artifact, "artifact", "pipeline/drvmap.json", "Path of the derivation map artifact")
+	flags.IntVar(&maxAncestors, "max-ancestors", 20, "Number of commits on the HEAD branch to check")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse 'parent-drvmap' arguments: %w", err)
+	}
+
+	// Checkouts may be reused between builds, in which case an old
+	// derivation map must not be picked up.
+	if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old derivation map: %w", err)
+	}
+
+	headRef := fmt.Sprintf("refs/remotes/%s/%s", remote, cfg.Branch)
+	if !noFetch {
+		_, err := git("fetch", "--quiet", remote, fmt.Sprintf("+refs/heads/%s:%s", cfg.Branch, headRef))
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", cfg.Branch, err)
+		}
+	}
+
+	mergeBase, err := git("merge-base", commit, headRef)
+	if err != nil {
+		return fmt.Errorf("failed to find merge-base of %s with %s: %w", commit, cfg.Branch, err)
+	}
+
+	ancestors, err := git("rev-list", "--first-parent", "--max-count="+strconv.Itoa(maxAncestors), mergeBase)
+	if err != nil {
+		return fmt.Errorf("failed to list ancestors of %s: %w", mergeBase, err)
+	}
+
+	// The current build has no derivation map yet, but should not be
+	// considered in case the commit is already on the HEAD branch.
+	current, _ := strconv.Atoi(getenv("BUILDKITE_BUILD_NUMBER"))
+
+	fmt.Fprintf(s.out, "looking for derivation map of merge-base %.12s with %s:\n", mergeBase, cfg.Branch)
+
+	for _, ancestor := range strings.Fields(ancestors) {
+		downloadUrl, err := s.findDrvmapArtifact(ancestor, artifact, current)
+		if err != nil {
+			return err
+		}
+
+		if downloadUrl == "" {
+			continue
+		}
+
+		data, err := s.buildkite.get(downloadUrl)
+		if err != nil {
+			return fmt.Errorf("failed to download derivation map of %s: %w", ancestor, err)
+		}
+
+		if _, err := parseDrvmap(data); err != nil {
+			return fmt.Errorf("downloaded derivation map of %s: %w", ancestor, err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+
+		if err := os.WriteFile(output, data, 0644); err != nil {
+			return fmt.Errorf("failed to write derivation map: %w", err)
+		}
+
+		if ancestor != mergeBase {
+			fmt.Fprintf(s.out, "merge-base has no derivation map, using that of its ancestor %.12s\n", ancestor)
+		}
+
+		fmt.Fprintf(s.out, "wrote derivation map of %.12s to %s\n", ancestor, output)
+		return nil
+	}
+
+	fmt.Fprintf(s.out, "no derivation map found for %.12s or its last %d ancestors on %s, all targets will be built\n", mergeBase, maxAncestors-1, cfg.Branch)
+	return nil
+}
+
+// maxReportedTargets is the maximum number of targets listed in a
+// derivation map report on Gerrit.
+const maxReportedTargets = 50
+
+// drvmapDiff describes the readTree targets that differ between two
+// derivation maps.
+type drvmapDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// diffDrvmaps compares two derivation maps. Targets are sorted by
+// label.
+func diffDrvmaps(from, to drvmap) drvmapDiff {
+	diff := drvmapDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []string{},
+	}
+
+	for label, entry := range to {
+		fromEntry, ok := from[label]
+		if !ok {
+			diff.Added = append(diff.Added, label)
+		} else if fromEntry.DrvPath != entry.DrvPath {
+			diff.Changed = append(diff.Changed, label)
+		}
+	}
+
+	for label := range from {
+		if _, ok := to[label]; !ok {
+			diff.Removed = append(diff.Removed, label)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// rebuilt returns the targets that are built because of the
+// difference, sorted by label.
+func (d *drvmapDiff) rebuilt() []string {
+	targets := append(append([]string{}, d.Added...), d.Changed...)
+	sort.Strings(targets)
+	return targets
+}
+
+// formatText formats the difference for humans, with one target per
+// line prefixed by '+' (added), '-' (removed) or '~' (changed).
+func (d *drvmapDiff) formatText() string {
+	var out strings.Builder
+	for _, section := range []struct {
+		prefix  string
+		targets []string
+	}{
+		{"+", d.Added},
+		{"-", d.Removed},
+		{"~", d.Changed},
+	} {
+		for _, target := range section.targets {
+			fmt.Fprintf(&out, "%s %s\n", section.prefix, target)
+		}
+	}
+
+	fmt.Fprintf(&out, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+	return out.String()
+}
+
+// formatReport formats the targets that will be rebuilt as a Gerrit
+// message.
+func (d *drvmapDiff) formatReport(patchset string) string {
+	rebuilt := d.rebuilt()
+	if len(rebuilt) == 0 {
+		return fmt.Sprintf("Patchset %s does not change any targets.", patchset)
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Patchset %s rebuilds %d targets (%d added, %d changed", patchset, len(rebuilt), len(d.Added), len(d.Changed))
+	if len(d.Removed) > 0 {
+		fmt.Fprintf(&msg, ", %d removed", len(d.Removed))
+	}
+	msg.WriteString("):\n\n")
+
+	added := make(map[string]bool, len(d.Added))
+	for _, target := range d.Added {
+		added[target] = true
+	}
+
+	for i, target := range rebuilt {
+		if i == maxReportedTargets {
+			fmt.Fprintf(&msg, "\n... and %d more\n", len(rebuilt)-maxReportedTargets)
+			break
+		}
+
+		fmt.Fprintf(&msg, "* %s", target)
+		if added[target] {
+			msg.WriteString(" (new)")
+		}
+		msg.WriteString("\n")
+	}
+
+	return msg.String()
+}
+
+// readDrvmap reads a derivation map from a file. If 'optional' is set,
+// a missing file is treated as an empty derivation map.
+func readDrvmap(path string, optional bool) (drvmap, error) {
+	data, err := os.ReadFile(path)
+	if optional && os.IsNotExist(err) {
+		return drvmap{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read derivation map: %w", err)
+	}
+
+	m, err := parseDrvmap(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return m, nil
+}
+
+// DrvmapDiff implements the 'drvmap-diff' command, which compares the
+// derivation map of a change's parent with that of the change itself.
+// The difference is printed, and optionally reported on the CL.
+//
+// A missing old derivation map (e.g. if 'parent-drvmap' found none) is
+// treated as empty, as all targets will be built in that case.
+func (s *Service) DrvmapDiff(args []string, getenv func(string) string) error {
+	var format string
+	var report bool
+
+	flags := newFlagSet("drvmap-diff")
+	flags.StringVar(&format, "format", "text", "Output format ('text' or 'json')")
+	flags.BoolVar(&report, "report", false, "Post the targets that will be rebuilt on the CL")
+
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("failed to parse 'drvmap-diff' arguments: %w", err)
+	}
+
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: drvmap-diff [--format text|json] [--report] old.json new.json")
+	}
+
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown output format %q", format)
+	}
+
+	from, err := readDrvmap(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+
+	to, err := readDrvmap(flags.Arg(1), false)
+	if err != nil {
+		return err
+	}
+
+	diff := diffDrvmaps(from, to)
+
+	if format == "json" {
+		out, err := json.MarshalIndent(diff, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal derivation map difference: %w", err)
+		}
+		fmt.Fprintf(s.out, "%s\n", out)
+	} else {
+		io.WriteString(s.out, diff.formatText())
+	}
+
+	if !report {
+		return nil
+	}
+
+	changeId := getenv("GERRIT_CHANGE_ID")
+	patchset := getenv("GERRIT_PATCHSET")
+	if changeId == "" || patchset == "" {
+		fmt.Fprintf(s.out, "This isn't a %s build, not reporting targets.\n", s.cfg.GerritChangeName)
+		return nil
+	}
+
+	review := reviewInput{
+		Message:                        diff.formatReport(patchset),
+		OmitDuplicateComments:          true,
+		IgnoreDefaultAttentionSetRules: true,
+		Tag:                            "autogenerated:buildkite~drvmap",
+		Notify:                         "NONE",
+	}
+
+	return s.updateGerrit(review, changeId, patchset)
+}
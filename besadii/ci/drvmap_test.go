@@ -0,0 +1,309 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testDrvmap = `{"ops/besadii": {"drvPath": "/nix/store/aaa-besadii.drv", "attrPath": ["ops", "besadii"]}}`
+
+// testRepo is a git repository in which the change being built forked
+// off the HEAD branch after its second commit.
+type testRepo struct {
+	canon []string // commits on the HEAD branch, oldest first
+	cl    string   // commit of the change
+}
+
+// runGit runs a git command in the current directory.
+func runGit(t *testing.T, args ...string) string {
+	t.Helper()
+
+	out, err := git(args...)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	return out
+}
+
+// newTestRepo creates a repository in a temporary directory and
+// changes into it for the duration of the test.
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir := chdirTemp(t)
+
+	t.Setenv("GIT_AUTHOR_NAME", "Jane")
+	t.Setenv("GIT_AUTHOR_EMAIL", "jane@tvl.su")
+	t.Setenv("GIT_COMMITTER_NAME", "Jane")
+	t.Setenv("GIT_COMMITTER_EMAIL", "jane@tvl.su")
+
+	repo := &testRepo{}
+	runGit(t, "init", "--quiet", "--initial-branch=canon")
+
+	commit := func(msg string) string {
+		runGit(t, "commit", "--quiet", "--allow-empty", "-m", msg)
+		return runGit(t, "rev-parse", "HEAD")
+	}
+
+	for _, msg := range []string{"first", "second"} {
+		repo.canon = append(repo.canon, commit(msg))
+	}
+
+	runGit(t, "checkout", "--quiet", "-b", "cl")
+	repo.cl = commit("change")
+
+	runGit(t, "checkout", "--quiet", "canon")
+	repo.canon = append(repo.canon, commit("third"))
+
+	// The repository is its own remote, from which the HEAD branch is
+	// fetched.
+	runGit(t, "remote", "add", "origin", dir)
+	runGit(t, "fetch", "--quiet", "origin")
+	runGit(t, "checkout", "--quiet", repo.cl)
+
+	return repo
+}
+
+// addDrvmapBuild adds a finished build of the commit, with the given
+// derivation map as an artifact if it is not empty.
+func (env *testEnv) addDrvmapBuild(commit, drvmap string) *fakeBuild {
+	fb := env.buildkite.add(Build{Commit: commit, Branch: "canon"}, "passed")
+	if drvmap != "" {
+		fb.artifacts["pipeline/drvmap.json"] = drvmap
+	}
+	return fb
+}
+
+// drvmapEnv returns the environment of the job looking up the
+// derivation map, in the build with the given number.
+func drvmapEnv(build string) func(string) string {
+	return postCommandEnv(map[string]string{"BUILDKITE_BUILD_NUMBER": build})
+}
+
+func readOutput(t *testing.T) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("tmp", "parent-target-map.json"))
+	if err != nil {
+		t.Fatalf("failed to read derivation map: %s", err)
+	}
+	return string(data)
+}
+
+func TestParentDrvmapMergeBase(t *testing.T) {
+	env := newTestEnv(t, "")
+	repo := newTestRepo(t)
+
+	env.addDrvmapBuild(repo.canon[0], `{}`)
+	env.addDrvmapBuild(repo.canon[1], testDrvmap)
+	// Newer commits on the branch are not the change's parent.
+	env.addDrvmapBuild(repo.canon[2], `{}`)
+
+	if err := env.s.ParentDrvmap(nil, drvmapEnv("100")); err != nil {
+		t.Fatalf("ParentDrvmap failed: %s", err)
+	}
+
+	if got := readOutput(t); got != testDrvmap {
+		t.Errorf("unexpected derivation map: %s", got)
+	}
+}
+
+func TestParentDrvmapAncestor(t *testing.T) {
+	env := newTestEnv(t, "")
+	repo := newTestRepo(t)
+
+	env.addDrvmapBuild(repo.canon[0], testDrvmap)
+	// The merge-base was only built by a failed build.
+	env.addDrvmapBuild(repo.canon[1], "")
+
+	if err := env.s.ParentDrvmap([]string{"--no-fetch"}, drvmapEnv("100")); err != nil {
+		t.Fatalf("ParentDrvmap failed: %s", err)
+	}
+
+	if got := readOutput(t); got != testDrvmap {
+		t.Errorf("unexpected derivation map: %s", got)
+	}
+
+	if !strings.Contains(env.out.String(), "using that of its ancestor") {
+		t.Errorf("expected ancestor to be reported, got:\n%s", env.out)
+	}
+}
+
+func TestParentDrvmapNotFound(t *testing.T) {
+	env := newTestEnv(t, "")
+	repo := newTestRepo(t)
+
+	// A stale derivation map from an earlier build in this checkout.
+	os.Mkdir("tmp", 0755)
+	os.WriteFile(filepath.Join("tmp", "parent-target-map.json"), []byte(testDrvmap), 0644)
+
+	// The build of the commit itself, which is currently running, is
+	// ignored.
+	current := env.addDrvmapBuild(repo.canon[1], testDrvmap)
+
+	if err := env.s.ParentDrvmap(nil, drvmapEnv(strconv.Itoa(current.number))); err != nil {
+		t.Fatalf("ParentDrvmap failed: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join("tmp", "parent-target-map.json")); !os.IsNotExist(err) {
+		t.Errorf("expected no derivation map to be written, got %v", err)
+	}
+
+	if !strings.Contains(env.out.String(), "all targets will be built") {
+		t.Errorf("expected missing derivation map to be reported, got:\n%s", env.out)
+	}
+}
+
+func TestParentDrvmapInvalid(t *testing.T) {
+	env := newTestEnv(t, "")
+	repo := newTestRepo(t)
+
+	env.addDrvmapBuild(repo.canon[1], `{"ops/besadii": {"attrPath": ["ops", "besadii"]}}`)
+
+	err := env.s.ParentDrvmap(nil, drvmapEnv("100"))
+	if err == nil || !strings.Contains(err.Error(), "has no 'drvPath'") {
+		t.Errorf("expected invalid derivation map error, got %v", err)
+	}
+}
+
+// writeDrvmaps writes two derivation maps to temporary files and
+// returns their paths.
+func writeDrvmaps(t *testing.T, from, to string) (string, string) {
+	dir := t.TempDir()
+	fromPath := filepath.Join(dir, "old.json")
+	toPath := filepath.Join(dir, "new.json")
+
+	for path, data := range map[string]string{fromPath: from, toPath: to} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write derivation map: %s", err)
+		}
+	}
+
+	return fromPath, toPath
+}
+
+const (
+	oldDrvmap = `{
+		"ops/besadii": {"drvPath": "/nix/store/aaa-besadii.drv", "attrPath": ["ops", "besadii"]},
+		"ops/magrathea": {"drvPath": "/nix/store/bbb-magrathea.drv", "attrPath": ["ops", "magrathea"]},
+		"tools/old": {"drvPath": "/nix/store/ccc-old.drv", "attrPath": ["tools", "old"]}
+	}`
+
+	newDrvmap = `{
+		"ops/besadii": {"drvPath": "/nix/store/ddd-besadii.drv", "attrPath": ["ops", "besadii"]},
+		"ops/magrathea": {"drvPath": "/nix/store/bbb-magrathea.drv", "attrPath": ["ops", "magrathea"]},
+		"tools/new": {"drvPath": "/nix/store/eee-new.drv", "attrPath": ["tools", "new"]}
+	}`
+)
+
+func TestDrvmapDiffText(t *testing.T) {
+	env := newTestEnv(t, "")
+	from, to := writeDrvmaps(t, oldDrvmap, newDrvmap)
+
+	if err := env.s.DrvmapDiff([]string{from, to}, postCommandEnv(nil)); err != nil {
+		t.Fatalf("DrvmapDiff failed: %s", err)
+	}
+
+	want := "+ tools/new\n- tools/old\n~ ops/besadii\n1 added, 1 removed, 1 changed\n"
+	if got := env.out.String(); got != want {
+		t.Errorf("unexpected output:\n%s", got)
+	}
+
+	// Nothing is posted without --report.
+	if n := len(env.gerrit.postedReviews()); n != 0 {
+		t.Errorf("expected no reviews, got %d", n)
+	}
+}
+
+func TestDrvmapDiffJSON(t *testing.T) {
+	env := newTestEnv(t, "")
+	from, to := writeDrvmaps(t, oldDrvmap, newDrvmap)
+
+	if err := env.s.DrvmapDiff([]string{"--format", "json", from, to}, postCommandEnv(nil)); err != nil {
+		t.Fatalf("DrvmapDiff failed: %s", err)
+	}
+
+	var diff drvmapDiff
+	if err := json.Unmarshal([]byte(env.out.String()), &diff); err != nil {
+		t.Fatalf("invalid JSON output: %s", err)
+	}
+
+	if fmt.Sprint(diff) != "{[tools/new] [tools/old] [ops/besadii]}" {
+		t.Errorf("unexpected difference: %+v", diff)
+	}
+}
+
+func TestDrvmapDiffReport(t *testing.T) {
+	env := newTestEnv(t, "")
+	from, to := writeDrvmaps(t, oldDrvmap, newDrvmap)
+
+	if err := env.s.DrvmapDiff([]string{"--report", from, to}, postCommandEnv(nil)); err != nil {
+		t.Fatalf("DrvmapDiff failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+
+	review := reviews[0].review
+	want := "Patchset 2 rebuilds 2 targets (1 added, 1 changed, 1 removed):\n\n* ops/besadii\n* tools/new (new)\n"
+	if review.Message != want {
+		t.Errorf("unexpected report:\n%s", review.Message)
+	}
+
+	if len(review.Labels) != 0 || review.Notify != "NONE" {
+		t.Errorf("report must not vote or notify: %+v", review)
+	}
+}
+
+func TestDrvmapDiffMissingParent(t *testing.T) {
+	env := newTestEnv(t, "")
+	_, to := writeDrvmaps(t, oldDrvmap, newDrvmap)
+
+	// Without a parent derivation map, everything is rebuilt.
+	err := env.s.DrvmapDiff([]string{"--report", filepath.Join(t.TempDir(), "missing.json"), to}, postCommandEnv(nil))
+	if err != nil {
+		t.Fatalf("DrvmapDiff failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 || !strings.HasPrefix(reviews[0].review.Message, "Patchset 2 rebuilds 3 targets (3 added, 0 changed)") {
+		t.Errorf("unexpected reviews: %+v", reviews)
+	}
+
+	// The new derivation map is required.
+	if err := env.s.DrvmapDiff([]string{to, "missing.json"}, postCommandEnv(nil)); err == nil {
+		t.Errorf("expected missing derivation map to fail")
+	}
+}
+
+func TestDrvmapDiffReportLimit(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	targets := []string{}
+	for i := 0; i < maxReportedTargets+5; i++ {
+		targets = append(targets, fmt.Sprintf(`"t/%03d": {"drvPath": "/nix/store/%03d.drv", "attrPath": []}`, i, i))
+	}
+	from, to := writeDrvmaps(t, `{}`, "{"+strings.Join(targets, ",")+"}")
+
+	if err := env.s.DrvmapDiff([]string{"--report", from, to}, postCommandEnv(nil)); err != nil {
+		t.Fatalf("DrvmapDiff failed: %s", err)
+	}
+
+	msg := env.gerrit.postedReviews()[0].review.Message
+	if !strings.HasSuffix(msg, "\n... and 5 more\n") || strings.Contains(msg, "t/050") {
+		t.Errorf("expected report to be truncated, got:\n%s", msg)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements summaries of failed builds, which are posted
+// to Gerrit so that users do not need to visit Buildkite to find out
+// what went wrong.
+
+package ci
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Maximum number of failed jobs to include in a summary. Gerrit
+// limits the size of comments, and a build with more failures than
+// this is better inspected on Buildkite.
+const maxFailedJobs = 10
+
+// Number of bytes fetched from the end of a job log for each line
+// that is included in a summary, which leaves room for long lines and
+// Buildkite's escape codes.
+const logBytesPerLine = 1024
+
+// Regular expression matching the timestamps and terminal escape codes
+// in Buildkite job logs.
+var logEscapeRegexp = regexp.MustCompile(`\x1b_bk;t=\d+\x07|\x1b\[[0-9;]*[A-Za-z]|\r`)
+
+// failedJob is the summary of a single failed job.
+type failedJob struct {
+	Label  string
+	Target string
+	Url    string
+	Log    []string
+}
+
+// jobFailed returns true if a job has finished unsuccessfully.
+func jobFailed(job *buildkiteJob) bool {
+	if job.Type != "script" {
+		return false
+	}
+
+	if job.State == "failed" || job.State == "timed_out" {
+		return true
+	}
+
+	return job.State == "finished" && job.ExitStatus != nil && *job.ExitStatus != 0
+}
+
+// lastLines returns the last n non-empty lines of a job log, with
+// Buildkite's escape codes removed.
+func lastLines(log string, n int) []string {
+	log = logEscapeRegexp.ReplaceAllString(log, "")
+
+	lines := []string{}
+	for _, line := range strings.Split(log, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return lines
+}
+
+// findFailedJobs fetches the failed jobs of a build from Buildkite,
+// including their readTree targets and the tail of their logs. The
+// job with the ID in 'exclude' (the job running besadii) is ignored.
+//
+// At most maxFailedJobs jobs are returned, and 'truncated' reports
+// whether there were more.
+func (s *Service) findFailedJobs(buildNumber, exclude string) (failures []failedJob, truncated bool, err error) {
+	if buildNumber == "" {
+		return nil, false, fmt.Errorf("build number is unknown")
+	}
+
+	buildPath := "/builds/" + buildNumber
+
+	var build buildkiteBuild
+	err = s.buildkite.getJSON(buildPath, &build)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fetch build %s: %w", buildNumber, err)
+	}
+
+	failures = []failedJob{}
+	for _, job := range build.Jobs {
+		if job.Id == exclude || !jobFailed(&job) {
+			continue
+		}
+
+		if len(failures) == maxFailedJobs {
+			return failures, true, nil
+		}
+
+		failure := failedJob{
+			Label: job.Name,
+			Url:   job.WebUrl,
+		}
+
+		var env struct {
+			Env map[string]string `json:"env"`
+		}
+		err = s.buildkite.getJSON(fmt.Sprintf("%s/jobs/%s/env", buildPath, job.Id), &env)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to fetch environment of job %s: %w", job.Id, err)
+		}
+		failure.Target = env.Env["READTREE_TARGET"]
+
+		if job.RawLogUrl != "" {
+			log, err := s.buildkite.getTail(job.RawLogUrl, s.cfg.FailureLogLines*logBytesPerLine)
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to fetch log of job %s: %w", job.Id, err)
+			}
+			failure.Log = lastLines(string(log), s.cfg.FailureLogLines)
+		}
+
+		failures = append(failures, failure)
+	}
+
+	return failures, false, nil
+}
+
+// formatFailures formats failed jobs for inclusion in a Gerrit
+// message, noting if there were more failures than shown. Log lines
+// are indented, which Gerrit displays as preformatted text.
+func formatFailures(failures []failedJob, truncated bool) string {
+	if len(failures) == 0 {
+		return ""
+	}
+
+	var msg strings.Builder
+	msg.WriteString("\n\nFailed steps:\n")
+
+	for _, f := range failures {
+		fmt.Fprintf(&msg, "\n* %s", f.Label)
+		if f.Target != "" {
+			fmt.Fprintf(&msg, " (target: %s)", f.Target)
+		}
+		fmt.Fprintf(&msg, ": %s\n", f.Url)
+
+		if len(f.Log) > 0 {
+			msg.WriteString("\n")
+			for _, line := range f.Log {
+				fmt.Fprintf(&msg, "    %s\n", line)
+			}
+		}
+	}
+
+	if truncated {
+		fmt.Fprintf(&msg, "\nOnly the first %d failures are shown.\n", maxFailedJobs)
+	}
+
+	return msg.String()
+}
+
+// targetDirectory returns the directory corresponding to a readTree
+// target label, e.g. "ops/besadii:sub" corresponds to "ops/besadii".
+func targetDirectory(target string) string {
+	dir, _, _ := strings.Cut(target, ":")
+	return strings.Trim(dir, "/")
+}
+
+// failureRobotComments creates file comments for the files in a CL
+// that belong to failing readTree targets.
+func (s *Service) failureRobotComments(changeId, patchset string, failures []failedJob) (map[string][]robotCommentInput, error) {
+	paths, err := s.gerrit.fetchChangeFiles(changeId, patchset)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := make(map[string][]robotCommentInput)
+	for _, f := range failures {
+		dir := targetDirectory(f.Target)
+		if dir == "" {
+			continue
+		}
+
+		for _, file := range paths {
+			if !strings.HasPrefix(file, dir+"/") {
+				continue
+			}
+
+			msg := fmt.Sprintf("Target %s failed to build in step %s.", f.Target, f.Label)
+			if len(f.Log) > 0 {
+				msg += "\n\n    " + strings.Join(f.Log, "\n    ")
+			}
+
+			comments[file] = append(comments[file], robotCommentInput{
+				Path:       file,
+				Message:    msg,
+				RobotId:    "besadii",
+				RobotRunId: f.Url,
+				Url:        f.Url,
+			})
+		}
+	}
+
+	return comments, nil
+}
@@ -0,0 +1,595 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements fake Gerrit and Buildkite servers, which are
+// used to test besadii's hooks end to end.
+
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGerrit implements the parts of the Gerrit REST API used by
+// besadii.
+type fakeGerrit struct {
+	server *httptest.Server
+
+	// authorized checks the credentials of requests, and defaults to
+	// HTTP basic auth with the test credentials.
+	authorized func(r *http.Request) bool
+
+	mu       sync.Mutex
+	fail     bool
+	changes  map[string]*changeInfo
+	files    map[string][]string
+	hashtags map[string][]string
+	accounts map[string]accountInfo
+	reviews  []postedReview
+}
+
+// postedReview is a review received by the fake Gerrit.
+type postedReview struct {
+	changeId string
+	patchset string
+	review   reviewInput
+}
+
+func newFakeGerrit(t *testing.T) *fakeGerrit {
+	g := &fakeGerrit{
+		changes:  make(map[string]*changeInfo),
+		files:    make(map[string][]string),
+		hashtags: make(map[string][]string),
+		accounts: make(map[string]accountInfo),
+	}
+
+	g.authorized = func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "besadii" && password == "gerrit-secret"
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /a/changes/{change}/revisions/{patchset}/review", func(w http.ResponseWriter, r *http.Request) {
+		var review reviewInput
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		g.reviews = append(g.reviews, postedReview{
+			changeId: r.PathValue("change"),
+			patchset: r.PathValue("patchset"),
+			review:   review,
+		})
+		g.reply(w, map[string]interface{}{})
+	})
+
+	mux.HandleFunc("GET /a/changes/{$}", func(w http.ResponseWriter, r *http.Request) {
+		changes := []*changeInfo{}
+		commit, _ := strings.CutPrefix(r.URL.Query().Get("q"), "commit:")
+		for _, change := range g.changes {
+			if _, ok := change.Revisions[commit]; ok {
+				changes = append(changes, renderAccounts(r, change))
+			}
+		}
+		g.reply(w, changes)
+	})
+
+	mux.HandleFunc("GET /a/changes/{change}", func(w http.ResponseWriter, r *http.Request) {
+		change, ok := g.changes[r.PathValue("change")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		g.reply(w, renderAccounts(r, change))
+	})
+
+	mux.HandleFunc("GET /a/changes/{change}/hashtags", func(w http.ResponseWriter, r *http.Request) {
+		g.reply(w, g.hashtags[r.PathValue("change")])
+	})
+
+	mux.HandleFunc("GET /a/changes/{change}/revisions/{patchset}/files", func(w http.ResponseWriter, r *http.Request) {
+		files := map[string]interface{}{"/COMMIT_MSG": struct{}{}}
+		for _, f := range g.files[r.PathValue("change")] {
+			files[f] = struct{}{}
+		}
+		g.reply(w, files)
+	})
+
+	mux.HandleFunc("GET /a/accounts/{$}", func(w http.ResponseWriter, r *http.Request) {
+		accounts := []accountInfo{}
+		username, ok := strings.CutPrefix(r.URL.Query().Get("q"), "username:")
+		if account, found := g.accounts[username]; ok && found {
+			accounts = append(accounts, account)
+		}
+		g.reply(w, accounts)
+	})
+
+	g.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if !g.authorized(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if g.fail {
+			http.Error(w, "Gerrit is having a bad day", http.StatusInternalServerError)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(g.server.Close)
+
+	return g
+}
+
+// reply writes a JSON response in Gerrit's format.
+func (g *fakeGerrit) reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, ")]}'\n")
+	json.NewEncoder(w).Encode(v)
+}
+
+// renderAccounts returns a change as Gerrit renders it for a request.
+// Accounts only contain their ID unless the DETAILED_ACCOUNTS option
+// is requested.
+func renderAccounts(r *http.Request, change *changeInfo) *changeInfo {
+	if slices.Contains(r.URL.Query()["o"], "DETAILED_ACCOUNTS") {
+		return change
+	}
+
+	idOnly := func(a accountInfo) accountInfo {
+		return accountInfo{AccountId: a.AccountId}
+	}
+
+	c := *change
+	c.Owner = idOnly(c.Owner)
+
+	c.Revisions = make(map[string]revisionInfo)
+	for commit, rev := range change.Revisions {
+		rev.Uploader = idOnly(rev.Uploader)
+		c.Revisions[commit] = rev
+	}
+
+	c.Reviewers = make(map[string][]accountInfo)
+	for state, reviewers := range change.Reviewers {
+		for _, reviewer := range reviewers {
+			c.Reviewers[state] = append(c.Reviewers[state], idOnly(reviewer))
+		}
+	}
+
+	c.AttentionSet = make(map[string]attentionSetInfo)
+	for id, a := range change.AttentionSet {
+		c.AttentionSet[id] = attentionSetInfo{Account: idOnly(a.Account)}
+	}
+
+	c.Messages = nil
+	for _, m := range change.Messages {
+		m.Author = idOnly(m.Author)
+		c.Messages = append(c.Messages, m)
+	}
+
+	return &c
+}
+
+// addChange adds a change with a single current patchset.
+func (g *fakeGerrit) addChange(number, patchset int, commit string) *changeInfo {
+	change := &changeInfo{
+		Project:         "depot",
+		Branch:          "canon",
+		Number:          number,
+		CurrentRevision: commit,
+		Revisions: map[string]revisionInfo{
+			commit: {
+				Number: patchset,
+				Ref:    fmt.Sprintf("refs/changes/%02d/%d/%d", number%100, number, patchset),
+				Uploader: accountInfo{
+					AccountId: 1000,
+					Name:      "Jane Doe",
+					Email:     "jane@tvl.su",
+					Username:  "jane",
+				},
+			},
+		},
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.changes[strconv.Itoa(number)] = change
+
+	return change
+}
+
+func (g *fakeGerrit) postedReviews() []postedReview {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]postedReview{}, g.reviews...)
+}
+
+func (g *fakeGerrit) setFail(fail bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.fail = fail
+}
+
+// fakeBuildkite implements the parts of the Buildkite REST API used by
+// besadii, for a single pipeline.
+type fakeBuildkite struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	fail   bool
+	builds []*fakeBuild
+}
+
+// fakeBuild is a build known to the fake Buildkite, either created
+// through the API or set up by a test.
+type fakeBuild struct {
+	number int
+	state  string
+	build  Build
+	jobs   []buildkiteJob
+	env    map[string]map[string]string
+	logs   map[string]string
+
+	// Artifact contents by path.
+	artifacts map[string]string
+
+	annotations []buildkiteAnnotation
+}
+
+const fakePipelinePath = "/v2/organizations/tvl/pipelines/depot"
+
+func newFakeBuildkite(t *testing.T) *fakeBuildkite {
+	b := &fakeBuildkite{}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST "+fakePipelinePath+"/builds", func(w http.ResponseWriter, r *http.Request) {
+		var build Build
+		if err := json.NewDecoder(r.Body).Decode(&build); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fb := b.add(build, "scheduled")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(buildResponse{
+			WebUrl: fmt.Sprintf("https://buildkite.com/tvl/depot/builds/%d", fb.number),
+			Number: fb.number,
+		})
+	})
+
+	mux.HandleFunc("GET "+fakePipelinePath+"/builds", func(w http.ResponseWriter, r *http.Request) {
+		commit := r.URL.Query().Get("commit")
+		branch := r.URL.Query().Get("branch")
+
+		builds := []buildkiteBuild{}
+		for _, fb := range b.builds {
+			if (commit == "" || fb.build.Commit == commit) && (branch == "" || fb.build.Branch == branch) {
+				builds = append(builds, fb.api())
+			}
+		}
+		json.NewEncoder(w).Encode(builds)
+	})
+
+	mux.HandleFunc("GET "+fakePipelinePath+"/builds/{number}", func(w http.ResponseWriter, r *http.Request) {
+		fb := b.find(r.PathValue("number"))
+		if fb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(fb.api())
+	})
+
+	mux.HandleFunc("GET "+fakePipelinePath+"/builds/{number}/jobs/{job}/env", func(w http.ResponseWriter, r *http.Request) {
+		fb := b.find(r.PathValue("number"))
+		if fb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"env": fb.env[r.PathValue("job")]})
+	})
+
+	mux.HandleFunc("GET "+fakePipelinePath+"/builds/{number}/artifacts", func(w http.ResponseWriter, r *http.Request) {
+		fb := b.find(r.PathValue("number"))
+		if fb == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		paths := []string{}
+		for path := range fb.artifacts {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		// Artifacts are paginated like in the Buildkite API, with 30
+		// artifacts per page by default.
+		perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+		if err != nil {
+			perPage = 30
+		}
+
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			page = 1
+		}
+
+		start := min((page-1)*perPage, len(paths))
+		end := min(start+perPage, len(paths))
+		if end < len(paths) {
+			next := *r.URL
+			query := next.Query()
+			query.Set("page", strconv.Itoa(page+1))
+			next.RawQuery = query.Encode()
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s>; rel="next"`, b.server.URL, next.RequestURI()))
+		}
+
+		artifacts := []buildkiteArtifact{}
+		for _, path := range paths[start:end] {
+			artifacts = append(artifacts, buildkiteArtifact{
+				Path:        path,
+				State:       "finished",
+				DownloadUrl: fmt.Sprintf("%s/artifacts/%d/%s", b.server.URL, fb.number, path),
+			})
+		}
+		json.NewEncoder(w).Encode(artifacts)
+	})
+
+	mux.HandleFunc("POST "+fakePipelinePath+"/builds/{number}/annotations", func(w http.ResponseWriter, r *http.Request) {
+		fb := b.find(r.PathValue("number"))
+		if fb == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		var annotation buildkiteAnnotation
+		if err := json.NewDecoder(r.Body).Decode(&annotation); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		fb.annotations = append(fb.annotations, annotation)
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{}`)
+	})
+
+	mux.HandleFunc("GET /artifacts/{number}/{path...}", func(w http.ResponseWriter, r *http.Request) {
+		fb := b.find(r.PathValue("number"))
+		if fb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, fb.artifacts[r.PathValue("path")])
+	})
+
+	mux.HandleFunc("GET /logs/{number}/{job}", func(w http.ResponseWriter, r *http.Request) {
+		fb := b.find(r.PathValue("number"))
+		if fb == nil {
+			http.NotFound(w, r)
+			return
+		}
+		// Logs are served with support for range requests.
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(fb.logs[r.PathValue("job")]))
+	})
+
+	b.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer bk-token" {
+			http.Error(w, `{"message": "Authentication required"}`, http.StatusUnauthorized)
+			return
+		}
+
+		if b.fail {
+			http.Error(w, `{"message": "Buildkite is having a bad day"}`, http.StatusInternalServerError)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(b.server.Close)
+
+	return b
+}
+
+// add registers a new build. The caller must hold the lock, or no
+// server requests may be in flight.
+func (b *fakeBuildkite) add(build Build, state string) *fakeBuild {
+	fb := &fakeBuild{
+		number:    len(b.builds) + 1,
+		state:     state,
+		build:     build,
+		env:       make(map[string]map[string]string),
+		logs:      make(map[string]string),
+		artifacts: make(map[string]string),
+	}
+	b.builds = append(b.builds, fb)
+	return fb
+}
+
+func (b *fakeBuildkite) find(number string) *fakeBuild {
+	for _, fb := range b.builds {
+		if strconv.Itoa(fb.number) == number {
+			return fb
+		}
+	}
+	return nil
+}
+
+// addJob adds a job with the given environment and log to a build.
+func (b *fakeBuildkite) addJob(fb *fakeBuild, id, name, state string, env map[string]string, log string) {
+	fb.jobs = append(fb.jobs, buildkiteJob{
+		Id:        id,
+		Type:      "script",
+		Name:      name,
+		State:     state,
+		WebUrl:    fmt.Sprintf("https://buildkite.com/tvl/depot/builds/%d#%s", fb.number, id),
+		RawLogUrl: fmt.Sprintf("%s/logs/%d/%s", b.server.URL, fb.number, id),
+	})
+	fb.env[id] = env
+	fb.logs[id] = log
+}
+
+func (fb *fakeBuild) api() buildkiteBuild {
+	return buildkiteBuild{
+		Number: fb.number,
+		State:  fb.state,
+		Env:    fb.build.Env,
+		Jobs:   fb.jobs,
+	}
+}
+
+func (b *fakeBuildkite) createdBuilds() []Build {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	builds := []Build{}
+	for _, fb := range b.builds {
+		builds = append(builds, fb.build)
+	}
+	return builds
+}
+
+func (b *fakeBuildkite) setFail(fail bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = fail
+}
+
+// testLog is a Logger that collects all messages.
+type testLog struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLog) Info(m string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, "info: "+m)
+	return nil
+}
+
+func (l *testLog) Err(m string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, "err: "+m)
+	return nil
+}
+
+// contains returns true if any logged message contains the string.
+func (l *testLog) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// testEnv bundles a Service with the fakes it talks to.
+type testEnv struct {
+	s         *Service
+	cfg       *Config
+	gerrit    *fakeGerrit
+	buildkite *fakeBuildkite
+	log       *testLog
+	out       *strings.Builder
+	sleeps    []time.Duration
+
+	// Current time of the service's clock, which starts at testTime.
+	now time.Time
+}
+
+// Fixed time used as the clock in tests.
+var testTime = time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+
+// newTestEnv creates a Service talking to fake servers. The extra
+// configuration is a JSON object merged into the base configuration.
+func newTestEnv(t *testing.T, extra string) *testEnv {
+	t.Helper()
+
+	env := &testEnv{
+		gerrit:    newFakeGerrit(t),
+		buildkite: newFakeBuildkite(t),
+		log:       &testLog{},
+		out:       &strings.Builder{},
+		now:       testTime,
+	}
+
+	cfg := map[string]interface{}{
+		"repository":       "depot",
+		"branch":           "canon",
+		"gerritUrl":        env.gerrit.server.URL,
+		"gerritUser":       "besadii",
+		"gerritPassword":   "gerrit-secret",
+		"buildkiteOrg":     "tvl",
+		"buildkiteProject": "depot",
+		"buildkiteToken":   "bk-token",
+		"buildkiteApiUrl":  env.buildkite.server.URL + "/v2",
+	}
+
+	if extra != "" {
+		if err := json.Unmarshal([]byte(extra), &cfg); err != nil {
+			t.Fatalf("invalid extra test configuration: %s", err)
+		}
+	}
+
+	cfgJson, _ := json.Marshal(cfg)
+	parsed, err := ParseConfig(cfgJson)
+	if err != nil {
+		t.Fatalf("failed to parse test configuration: %s", err)
+	}
+
+	env.cfg = parsed
+	env.s, err = New(parsed, Options{
+		Log:    env.log,
+		Client: env.gerrit.server.Client(),
+		Now:    func() time.Time { return env.now },
+		Sleep:  func(d time.Duration) { env.sleeps = append(env.sleeps, d) },
+		Output: env.out,
+	})
+	if err != nil {
+		t.Fatalf("failed to create service: %s", err)
+	}
+
+	return env
+}
+
+// chdirTemp changes into a temporary directory for the duration of the
+// test, and returns its path.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %s", err)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("failed to change directory: %s", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	return dir
+}
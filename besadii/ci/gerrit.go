@@ -0,0 +1,295 @@
+// Copyright 2019-2020 Google LLC.
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the Gerrit REST API client used by besadii.
+
+package ci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// gerritClient performs authenticated requests against the Gerrit
+// REST API. If 'ssh' is set, the REST API is not used and reviews are
+// posted over SSH instead.
+type gerritClient struct {
+	url    string
+	auth   gerritAuth
+	ssh    *sshReviewer
+	client *http.Client
+}
+
+// reviewInput is a struct representing the data submitted to Gerrit
+// to post a review on a CL.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#review-input
+type reviewInput struct {
+	Message                        string         `json:"message"`
+	Labels                         map[string]int `json:"labels,omitempty"`
+	OmitDuplicateComments          bool           `json:"omit_duplicate_comments"`
+	IgnoreDefaultAttentionSetRules bool           `json:"ignore_default_attention_set_rules"`
+	Tag                            string         `json:"tag"`
+	Notify                         string         `json:"notify,omitempty"`
+
+	RobotComments map[string][]robotCommentInput `json:"robot_comments,omitempty"`
+
+	AddToAttentionSet      []attentionSetInput `json:"add_to_attention_set,omitempty"`
+	RemoveFromAttentionSet []attentionSetInput `json:"remove_from_attention_set,omitempty"`
+	Reviewers              []reviewerInput     `json:"reviewers,omitempty"`
+}
+
+// attentionSetInput is a struct representing a user added to or
+// removed from the attention set of a CL.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#attention-set-input
+type attentionSetInput struct {
+	User   string `json:"user"`
+	Reason string `json:"reason"`
+}
+
+// reviewerInput is a struct representing a reviewer added to a CL.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#reviewer-input
+type reviewerInput struct {
+	Reviewer string `json:"reviewer"`
+	State    string `json:"state,omitempty"`
+}
+
+// robotCommentInput is a struct representing a comment posted by
+// automation on a file in a CL.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#robot-comment-input
+type robotCommentInput struct {
+	Path       string `json:"path"`
+	Message    string `json:"message"`
+	RobotId    string `json:"robot_id"`
+	RobotRunId string `json:"robot_run_id"`
+	Url        string `json:"url,omitempty"`
+}
+
+// accountInfo is the representation of a Gerrit account.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-accounts.html#account-info
+type accountInfo struct {
+	AccountId int    `json:"_account_id"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Username  string `json:"username"`
+
+	// Only set if requested with the DETAILS and ALL_EMAILS options.
+	DisplayName     string   `json:"display_name"`
+	SecondaryEmails []string `json:"secondary_emails"`
+}
+
+// revisionInfo is the representation of a patchset in Gerrit.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#revision-info
+type revisionInfo struct {
+	Number   int         `json:"_number"`
+	Ref      string      `json:"ref"`
+	Uploader accountInfo `json:"uploader"`
+}
+
+// changeInfo is the representation of a Gerrit change, with the
+// fields used by besadii.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#change-info
+type changeInfo struct {
+	Project         string                  `json:"project"`
+	Branch          string                  `json:"branch"`
+	Number          int                     `json:"_number"`
+	WorkInProgress  bool                    `json:"work_in_progress"`
+	IsPrivate       bool                    `json:"is_private"`
+	CurrentRevision string                  `json:"current_revision"`
+	Revisions       map[string]revisionInfo `json:"revisions"`
+
+	// Only set by fetchChangeDetails.
+	Owner        accountInfo                 `json:"owner"`
+	Reviewers    map[string][]accountInfo    `json:"reviewers"`
+	AttentionSet map[string]attentionSetInfo `json:"attention_set"`
+	Messages     []changeMessageInfo         `json:"messages"`
+}
+
+// attentionSetInfo is the representation of a user in the attention
+// set of a change.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#attention-set-info
+type attentionSetInfo struct {
+	Account accountInfo `json:"account"`
+}
+
+// changeMessageInfo is the representation of a message on a change.
+//
+// https://gerrit-review.googlesource.com/Documentation/rest-api-changes.html#change-message-info
+type changeMessageInfo struct {
+	Tag            string      `json:"tag"`
+	Message        string      `json:"message"`
+	Author         accountInfo `json:"author"`
+	RevisionNumber int         `json:"_revision_number"`
+}
+
+// linkToChange creates the full link to a change's patchset in Gerrit
+func linkToChange(cfg *Config, changeId, patchset string) string {
+	return fmt.Sprintf("%s/c/%s/+/%s/%s", cfg.GerritUrl, cfg.Repository, changeId, patchset)
+}
+
+// do sends a request to the Gerrit REST API and returns the response
+// body, with Gerrit's JSON prefix removed.
+func (g *gerritClient) do(method, path string, body interface{}) ([]byte, error) {
+	if g.ssh != nil {
+		return nil, fmt.Errorf("the Gerrit REST API is not available with SSH authentication")
+	}
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request body: %w", err)
+		}
+	}
+
+	resp, respBody, err := g.send(method, path, reqBody)
+
+	// Cached credentials may have been revoked, in which case the
+	// request is retried once with fresh ones.
+	if r, ok := g.auth.(tokenResetter); ok && err == nil && resp.StatusCode == http.StatusUnauthorized {
+		r.reset()
+		resp, respBody, err = g.send(method, path, reqBody)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-success response from Gerrit: %s (%v)", strings.TrimSpace(string(respBody)), resp.Status)
+	}
+
+	// Gerrit prefixes all JSON responses with a magic string to
+	// prevent XSSI attacks.
+	return bytes.TrimPrefix(respBody, []byte(")]}'")), nil
+}
+
+// send performs a single authenticated request and reads its response.
+func (g *gerritClient) send(method, path string, body []byte) (*http.Response, []byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/a/%s", g.url, path), reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create an HTTP request: %w", err)
+	}
+
+	if err := g.auth.authenticate(req); err != nil {
+		return nil, nil, fmt.Errorf("failed to authenticate to Gerrit: %w", err)
+	}
+
+	req.Header.Add("Accept", "application/json")
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send Gerrit request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read Gerrit response body: %w", err)
+	}
+
+	return resp, respBody, nil
+}
+
+// get fetches a JSON resource from the Gerrit REST API.
+func (g *gerritClient) get(path string, target interface{}) error {
+	respBody, err := g.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(respBody, target)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal Gerrit response: %w", err)
+	}
+
+	return nil
+}
+
+// postReview posts a review (e.g. a comment and votes) on a patchset.
+func (g *gerritClient) postReview(changeId, patchset string, review *reviewInput) error {
+	if g.ssh != nil {
+		return g.ssh.postReview(changeId, patchset, review)
+	}
+
+	_, err := g.do("POST", fmt.Sprintf("changes/%s/revisions/%s/review", changeId, patchset), review)
+	return err
+}
+
+// fetchChange fetches a change and its current revision, including
+// the details of its uploader, from Gerrit.
+func (g *gerritClient) fetchChange(changeId string) (*changeInfo, error) {
+	var change changeInfo
+	err := g.get(fmt.Sprintf("changes/%s?o=CURRENT_REVISION&o=DETAILED_ACCOUNTS", url.PathEscape(changeId)), &change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch change %s: %w", changeId, err)
+	}
+
+	return &change, nil
+}
+
+// fetchChangeDetails fetches a change with its owner, reviewers,
+// attention set and messages from Gerrit.
+func (g *gerritClient) fetchChangeDetails(changeId string) (*changeInfo, error) {
+	var change changeInfo
+	err := g.get(fmt.Sprintf("changes/%s?o=DETAILED_LABELS&o=DETAILED_ACCOUNTS&o=MESSAGES", url.PathEscape(changeId)), &change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch change %s: %w", changeId, err)
+	}
+
+	return &change, nil
+}
+
+// fetchChangeFiles returns the files modified in a patchset.
+func (g *gerritClient) fetchChangeFiles(changeId, patchset string) ([]string, error) {
+	// Only the file names are used, the values are ignored.
+	var files map[string]json.RawMessage
+	err := g.get(fmt.Sprintf("changes/%s/revisions/%s/files", changeId, patchset), &files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch files of change %s: %w", changeId, err)
+	}
+
+	paths := []string{}
+	for file := range files {
+		// Magic files like /COMMIT_MSG are not part of the tree.
+		if !strings.HasPrefix(file, "/") {
+			paths = append(paths, file)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// updateGerrit posts a comment on a Gerrit CL to indicate the current build status.
+func (s *Service) updateGerrit(review reviewInput, changeId, patchset string) error {
+	err := s.gerrit.postReview(changeId, patchset, &review)
+	if err != nil {
+		return fmt.Errorf("failed to update %s on %s: %w", s.cfg.GerritChangeName, s.cfg.GerritUrl, err)
+	}
+
+	fmt.Fprintf(s.out, "Added CI status comment on %s\n", linkToChange(s.cfg, changeId, patchset))
+	return nil
+}
@@ -0,0 +1,480 @@
+// Copyright 2019-2020 Google LLC.
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the hooks invoked by Gerrit and Buildkite.
+
+package ci
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/mail"
+	"regexp"
+	"strconv"
+)
+
+// Regular expression to extract change ID out of a URL
+var changeIdRegexp = regexp.MustCompile(`^.*/(\d+)$`)
+
+// buildTrigger represents the information passed to besadii when it
+// is invoked as a Gerrit hook.
+//
+// https://gerrit.googlesource.com/plugins/hooks/+/HEAD/src/main/resources/Documentation/hooks.md
+type buildTrigger struct {
+	project string
+	ref     string
+	commit  string
+	author  string
+	email   string
+
+	// Gerrit username of the uploader or submitter, if known.
+	username string
+
+	changeId string
+	patchset string
+
+	// Build settings determined by change policies.
+	noVote   bool
+	priority *int
+}
+
+// Trigger a build of a given branch & commit on Buildkite. The created
+// build is returned even if it could not be reported to Gerrit, and is
+// nil if no build was triggered.
+func (s *Service) triggerBuild(trigger *buildTrigger) (*buildResponse, error) {
+	cfg := s.cfg
+	env := make(map[string]string)
+	branch := trigger.ref
+
+	author, ok := s.buildAuthor(trigger)
+	if !ok {
+		return nil, nil
+	}
+
+	// Pass information about the originating Gerrit change to the
+	// build, if it is for a patchset.
+	//
+	// This information is later used by besadii when invoked by Gerrit
+	// to communicate the build status back to Gerrit.
+	headBuild := true
+	if trigger.changeId != "" && trigger.patchset != "" {
+		env["GERRIT_CHANGE_URL"] = linkToChange(cfg, trigger.changeId, trigger.patchset)
+		env["GERRIT_CHANGE_ID"] = trigger.changeId
+		env["GERRIT_PATCHSET"] = trigger.patchset
+		headBuild = false
+
+		if trigger.noVote {
+			env[noVoteEnv] = "true"
+		}
+
+		// The branch doesn't have to be a real ref (it's just used to
+		// group builds), so make it the identifier for the CL.
+		branch = fmt.Sprintf("%s/%v", cfg.GerritChangeName, trigger.changeId)
+	}
+
+	build := Build{
+		Commit: trigger.commit,
+		Branch: branch,
+		Env:    env,
+		Author: author,
+	}
+
+	s.applyBuildRules(trigger, &build)
+
+	buildResp, err := s.buildkite.createBuild(&build)
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Info(fmt.Sprintf("triggered build for ref %q at commit %q: %s", trigger.ref, trigger.commit, buildResp.WebUrl))
+
+	err = s.appendRecord(&record{
+		Build:    buildResp.Number,
+		Url:      buildResp.WebUrl,
+		State:    "scheduled",
+		Branch:   branchName(branch),
+		Commit:   trigger.commit,
+		Author:   author.Name,
+		Email:    author.Email,
+		Username: trigger.username,
+		ChangeId: trigger.changeId,
+		Patchset: trigger.patchset,
+	})
+	if err != nil {
+		// The build was triggered anyways, so this is not fatal.
+		s.log.Err(fmt.Sprintf("failed to record triggered build: %s", err))
+	}
+
+	// For builds of the HEAD branch there is nothing else to do
+	if headBuild {
+		return buildResp, nil
+	}
+
+	// Report the status back to the Gerrit CL so that users can click
+	// through to the running build.
+	msg := fmt.Sprintf("Started build for patchset #%s on: %s", trigger.patchset, buildResp.WebUrl)
+	review := reviewInput{
+		Message:               msg,
+		OmitDuplicateComments: true,
+		Tag:                   "autogenerated:buildkite~trigger",
+
+		// Do not update the attention set for this comment.
+		IgnoreDefaultAttentionSetRules: true,
+
+		Notify: "NONE",
+	}
+
+	return buildResp, s.updateGerrit(review, trigger.changeId, trigger.patchset)
+}
+
+// Gerrit passes more flags than we want, but Rob Pike decided[0] in
+// 2013 that the Go art project will not allow users to ignore flags
+// because he "doesn't like it". This function allows users to ignore
+// flags.
+//
+// [0]: https://github.com/golang/go/issues/6112#issuecomment-66083768
+func ignoreFlags(flags *flag.FlagSet, ignore []string) {
+	for _, f := range ignore {
+		flags.String(f, "", "flag to ignore")
+	}
+}
+
+// newFlagSet creates a flag set for parsing the arguments of a hook.
+// Errors are returned to the caller instead of exiting.
+func newFlagSet(hook string) *flag.FlagSet {
+	flags := flag.NewFlagSet(hook, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+// Extract the username & email from Gerrit's uploader flag and set it
+// on the trigger struct, for display in Buildkite.
+func extractChangeUploader(uploader string, trigger *buildTrigger) error {
+	// Gerrit passes the uploader in another extra layer of quotes.
+	uploader, err := strconv.Unquote(uploader)
+	if err != nil {
+		return fmt.Errorf("failed to unquote email - forgot quotes on manual invocation?: %w", err)
+	}
+
+	// Extract the uploader username & email from the input passed by
+	// Gerrit (in RFC 5322 format).
+	addr, err := mail.ParseAddress(uploader)
+	if err != nil {
+		return fmt.Errorf("invalid change uploader (%s): %w", uploader, err)
+	}
+
+	trigger.author = addr.Name
+	trigger.email = addr.Address
+
+	return nil
+}
+
+// Extract the buildtrigger struct out of the flags passed to besadii
+// when invoked as Gerrit's 'patchset-created' hook. This hook is used
+// for triggering CI on in-progress CLs.
+func (s *Service) buildTriggerFromPatchsetCreated(args []string) (*buildTrigger, error) {
+	cfg := s.cfg
+
+	// Information that needs to be returned
+	var trigger buildTrigger
+
+	// Information that is only needed for parsing
+	var targetBranch, changeUrl, uploader, kind string
+
+	flags := newFlagSet("patchset-created")
+	flags.StringVar(&trigger.project, "project", "", "Gerrit project")
+	flags.StringVar(&trigger.commit, "commit", "", "commit hash")
+	flags.StringVar(&trigger.patchset, "patchset", "", "patchset ID")
+
+	flags.StringVar(&targetBranch, "branch", "", "CL target branch")
+	flags.StringVar(&changeUrl, "change-url", "", "HTTPS URL of change")
+	flags.StringVar(&uploader, "uploader", "", "Change uploader name & email")
+	flags.StringVar(&trigger.username, "uploader-username", "", "Change uploader username")
+	flags.StringVar(&kind, "kind", "", "Kind of patchset")
+
+	// patchset-created also passes various flags which we don't need.
+	ignoreFlags(flags, []string{"topic", "change", "change-owner", "change-owner-username"})
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Ignore patchsets which do not contain code changes
+	if kind == "NO_CODE_CHANGE" || kind == "NO_CHANGE" {
+		return nil, nil
+	}
+
+	// Parse username & email
+	err := extractChangeUploader(uploader, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the patchset is not for the HEAD branch of the monorepo, then
+	// we can ignore it. It might be some other kind of change
+	// (refs/meta/config or Gerrit-internal), but it is not an error.
+	if trigger.project != cfg.Repository || targetBranch != cfg.Branch {
+		return nil, nil
+	}
+
+	// Change ID is not directly passed in the numeric format, so we
+	// need to extract it out of the URL
+	matches := changeIdRegexp.FindStringSubmatch(changeUrl)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid change URL %q", changeUrl)
+	}
+	trigger.changeId = matches[1]
+
+	// Construct the CL ref from which the build should happen.
+	changeId, _ := strconv.Atoi(trigger.changeId)
+	trigger.ref = fmt.Sprintf(
+		"refs/changes/%02d/%s/%s",
+		changeId%100, trigger.changeId, trigger.patchset,
+	)
+
+	// The hook does not say whether the change is work-in-progress or
+	// private, so this needs to be looked up if any policies apply.
+	if policyNeedsChange(cfg) {
+		change, err := s.gerrit.fetchChange(trigger.changeId)
+		if err != nil {
+			return nil, err
+		}
+
+		if !s.applyChangePolicy(change, &trigger) {
+			return nil, nil
+		}
+	}
+
+	return &trigger, nil
+}
+
+// Extract the buildtrigger struct out of the flags passed to besadii
+// when invoked as Gerrit's 'change-merged' hook. This hook is used
+// for triggering HEAD builds after change submission.
+func (s *Service) buildTriggerFromChangeMerged(args []string) (*buildTrigger, error) {
+	cfg := s.cfg
+
+	// Information that needs to be returned
+	var trigger buildTrigger
+
+	// Information that is only needed for parsing
+	var targetBranch, submitter string
+
+	flags := newFlagSet("change-merged")
+	flags.StringVar(&trigger.project, "project", "", "Gerrit project")
+	flags.StringVar(&trigger.commit, "commit", "", "Commit hash")
+	flags.StringVar(&submitter, "submitter", "", "Submitter email & username")
+	flags.StringVar(&trigger.username, "submitter-username", "", "Submitter username")
+	flags.StringVar(&targetBranch, "branch", "", "CL target branch")
+
+	// Ignore extra flags passed by change-merged
+	ignoreFlags(flags, []string{"change", "topic", "change-url", "newrev", "change-owner", "change-owner-username"})
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Parse username & email
+	err := extractChangeUploader(submitter, &trigger)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the patchset is not for the HEAD branch of the monorepo, then
+	// we can ignore it.
+	if trigger.project != cfg.Repository || targetBranch != cfg.Branch {
+		return nil, nil
+	}
+
+	trigger.ref = "refs/heads/" + targetBranch
+
+	return &trigger, nil
+}
+
+// handleTrigger triggers a build and runs post-merge actions for a
+// trigger parsed from a Gerrit hook. A nil trigger means that the hook
+// was not for something we care about.
+func (s *Service) handleTrigger(trigger *buildTrigger) error {
+	if trigger == nil {
+		return nil
+	}
+
+	var err error
+	if s.cfg.Queue.Url != "" {
+		err = s.submitTrigger(trigger)
+		if err != nil {
+			// Building without the queue's limits is better than not
+			// building at all.
+			s.log.Err(fmt.Sprintf("failed to queue build, triggering it directly: %s", err))
+		}
+	}
+
+	if s.cfg.Queue.Url == "" || err != nil {
+		_, err = s.triggerBuild(trigger)
+		if err != nil {
+			err = fmt.Errorf("failed to trigger Buildkite build: %w", err)
+		}
+	}
+
+	// Post-merge actions are independent of the build, and run even
+	// if it could not be triggered.
+	s.runPostMergeActions(trigger)
+
+	return err
+}
+
+// PatchsetCreated handles an invocation of Gerrit's
+// 'patchset-created' hook with the given arguments.
+func (s *Service) PatchsetCreated(args []string) error {
+	trigger, err := s.buildTriggerFromPatchsetCreated(args)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'patchset-created' invocation from args: %w", err)
+	}
+
+	return s.handleTrigger(trigger)
+}
+
+// ChangeMerged handles an invocation of Gerrit's 'change-merged' hook
+// with the given arguments.
+func (s *Service) ChangeMerged(args []string) error {
+	trigger, err := s.buildTriggerFromChangeMerged(args)
+	if err != nil {
+		return fmt.Errorf("failed to parse 'change-merged' invocation from args: %w", err)
+	}
+
+	return s.handleTrigger(trigger)
+}
+
+// WipStateChanged handles an invocation of Gerrit's
+// 'wip-state-changed' hook with the given arguments.
+func (s *Service) WipStateChanged(args []string) error {
+	trigger, err := s.buildTriggerFromStateChanged("wip-state-changed", "wip", args)
+	if err != nil {
+		return fmt.Errorf("failed to handle 'wip-state-changed' invocation: %w", err)
+	}
+
+	return s.handleTrigger(trigger)
+}
+
+// PrivateStateChanged handles an invocation of Gerrit's
+// 'private-state-changed' hook with the given arguments.
+func (s *Service) PrivateStateChanged(args []string) error {
+	trigger, err := s.buildTriggerFromStateChanged("private-state-changed", "private", args)
+	if err != nil {
+		return fmt.Errorf("failed to handle 'private-state-changed' invocation: %w", err)
+	}
+
+	return s.handleTrigger(trigger)
+}
+
+// PostCommand handles an invocation of Buildkite's 'post-command'
+// hook, reading the build information from the environment through
+// the getenv function (usually os.Getenv).
+func (s *Service) PostCommand(getenv func(string) string) error {
+	cfg := s.cfg
+	changeId := getenv("GERRIT_CHANGE_ID")
+	patchset := getenv("GERRIT_PATCHSET")
+
+	if changeId == "" || patchset == "" {
+		// Builds of branches still get test reports on Buildkite.
+		if getenv("BUILDKITE_LABEL") == ":duck:" {
+			s.reportTests(getenv)
+		}
+
+		// If these variables are unset, but the hook was invoked, the
+		// build was most likely for a branch and not for a CL - no status
+		// needs to be reported back to Gerrit!
+		fmt.Fprintf(s.out, "This isn't a %s build, nothing to do. Have a nice day!\n", cfg.GerritChangeName)
+		return nil
+	}
+
+	if getenv("BUILDKITE_LABEL") != ":duck:" {
+		// this is not the build stage, don't do anything.
+		return nil
+	}
+
+	var vote int
+	var verb string
+	var notify string
+
+	// Builds of work-in-progress changes may be configured to not
+	// vote on the CL, but their result is still reported.
+	noVote := getenv(noVoteEnv) != ""
+
+	if getenv("BUILDKITE_COMMAND_EXIT_STATUS") == "0" {
+		vote = 1 // automation passed: +1 in Gerrit
+		verb = "passed"
+		notify = "NONE"
+	} else {
+		vote = -1
+		verb = "failed"
+		notify = "OWNER"
+	}
+
+	msg := fmt.Sprintf("Build of patchset %s %s: %s", patchset, verb, getenv("BUILDKITE_BUILD_URL"))
+
+	if tests := s.reportTests(getenv); tests != nil {
+		msg += formatTestSummary(tests)
+	}
+
+	var failures []failedJob
+	if vote == -1 && cfg.FailureLogLines > 0 {
+		var truncated bool
+		var err error
+		failures, truncated, err = s.findFailedJobs(getenv("BUILDKITE_BUILD_NUMBER"), getenv("BUILDKITE_JOB_ID"))
+		if err != nil {
+			// The vote is more important than the summary, so it is
+			// still posted.
+			fmt.Fprintf(s.out, "failed to summarise build failures: %s\n", err)
+		}
+
+		msg += formatFailures(failures, truncated)
+	}
+
+	if cfg.Attestation.SigningKey != "" {
+		line, err := s.attestResult(getenv, verb)
+		if err != nil {
+			// Without an attestation, the result can not be audited
+			// later, but the vote is still posted.
+			fmt.Fprintf(s.out, "failed to sign build result: %s\n", err)
+		} else {
+			msg += "\n\n" + line
+		}
+	}
+
+	review := reviewInput{
+		Message:               msg,
+		OmitDuplicateComments: true,
+		Labels: map[string]int{
+			cfg.GerritLabel: vote,
+		},
+
+		// Update the attention set if we are failing this patchset.
+		IgnoreDefaultAttentionSetRules: vote == 1,
+
+		Tag: resultTag,
+
+		Notify: notify,
+	}
+
+	if noVote {
+		review.Labels = nil
+		review.Notify = "NONE"
+		review.IgnoreDefaultAttentionSetRules = true
+	}
+
+	if !noVote && cfg.Attention.enabled() {
+		s.updateAttention(&review, changeId, patchset, vote == 1)
+	}
+
+	if len(failures) > 0 && cfg.FailureRobotComments {
+		comments, err := s.failureRobotComments(changeId, patchset, failures)
+		if err != nil {
+			fmt.Fprintf(s.out, "failed to create robot comments: %s\n", err)
+		}
+		review.RobotComments = comments
+	}
+
+	return s.updateGerrit(review, changeId, patchset)
+}
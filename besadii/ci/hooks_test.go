@@ -0,0 +1,845 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// patchsetCreatedArgs returns the arguments Gerrit passes to the
+// 'patchset-created' hook, with some of them overridden.
+func patchsetCreatedArgs(overrides ...string) []string {
+	args := map[string]string{
+		"change":                "depot~canon~I0123456789abcdef",
+		"kind":                  "REWORK",
+		"change-url":            "https://cl.tvl.fyi/c/depot/+/1234",
+		"change-owner":          `"Jane Doe <jane@tvl.su>"`,
+		"change-owner-username": "jane",
+		"project":               "depot",
+		"branch":                "canon",
+		"topic":                 "",
+		"uploader":              `"Jane Doe <jane@tvl.su>"`,
+		"uploader-username":     "jane",
+		"commit":                "a1b2c3d4",
+		"patchset":              "2",
+	}
+
+	for i := 0; i+1 < len(overrides); i += 2 {
+		args[overrides[i]] = overrides[i+1]
+	}
+
+	flags := []string{}
+	for k, v := range args {
+		flags = append(flags, "--"+k, v)
+	}
+	return flags
+}
+
+func changeMergedArgs(overrides ...string) []string {
+	args := map[string]string{
+		"change":                "depot~canon~I0123456789abcdef",
+		"change-url":            "https://cl.tvl.fyi/c/depot/+/1234",
+		"change-owner":          `"Jane Doe <jane@tvl.su>"`,
+		"change-owner-username": "jane",
+		"project":               "depot",
+		"branch":                "canon",
+		"topic":                 "",
+		"submitter":             `"Sam Submitter <sam@tvl.su>"`,
+		"submitter-username":    "sam",
+		"commit":                "f00dfeed",
+		"newrev":                "f00dfeed",
+	}
+
+	for i := 0; i+1 < len(overrides); i += 2 {
+		args[overrides[i]] = overrides[i+1]
+	}
+
+	flags := []string{}
+	for k, v := range args {
+		flags = append(flags, "--"+k, v)
+	}
+	return flags
+}
+
+func TestPatchsetCreatedTriggersBuild(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	err := env.s.PatchsetCreated(patchsetCreatedArgs())
+	if err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(builds))
+	}
+
+	build := builds[0]
+	if build.Commit != "a1b2c3d4" || build.Branch != "cl/1234" {
+		t.Errorf("unexpected build commit/branch: %q/%q", build.Commit, build.Branch)
+	}
+
+	if build.Author.Name != "Jane Doe" || build.Author.Email != "jane@tvl.su" {
+		t.Errorf("unexpected build author: %+v", build.Author)
+	}
+
+	wantEnv := map[string]string{
+		"GERRIT_CHANGE_URL": env.gerrit.server.URL + "/c/depot/+/1234/2",
+		"GERRIT_CHANGE_ID":  "1234",
+		"GERRIT_PATCHSET":   "2",
+	}
+	for k, v := range wantEnv {
+		if build.Env[k] != v {
+			t.Errorf("expected build env %s=%q, got %q", k, v, build.Env[k])
+		}
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+
+	r := reviews[0]
+	if r.changeId != "1234" || r.patchset != "2" {
+		t.Errorf("review posted on wrong patchset: %s/%s", r.changeId, r.patchset)
+	}
+
+	if r.review.Message != "Started build for patchset #2 on: https://buildkite.com/tvl/depot/builds/1" {
+		t.Errorf("unexpected review message: %q", r.review.Message)
+	}
+
+	if r.review.Labels != nil || r.review.Tag != "autogenerated:buildkite~trigger" || r.review.Notify != "NONE" {
+		t.Errorf("unexpected trigger review: %+v", r.review)
+	}
+}
+
+func TestPatchsetCreatedIgnoredChanges(t *testing.T) {
+	for name, args := range map[string][]string{
+		"no code change": patchsetCreatedArgs("kind", "NO_CODE_CHANGE"),
+		"no change":      patchsetCreatedArgs("kind", "NO_CHANGE"),
+		"other branch":   patchsetCreatedArgs("branch", "refs/meta/config"),
+		"other project":  patchsetCreatedArgs("project", "other"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, "")
+
+			if err := env.s.PatchsetCreated(args); err != nil {
+				t.Fatalf("PatchsetCreated failed: %s", err)
+			}
+
+			if n := len(env.buildkite.createdBuilds()); n != 0 {
+				t.Errorf("expected no builds, got %d", n)
+			}
+		})
+	}
+}
+
+func TestPatchsetCreatedInvalidArgs(t *testing.T) {
+	for name, args := range map[string][]string{
+		"unquoted uploader": patchsetCreatedArgs("uploader", "Jane Doe <jane@tvl.su>"),
+		"invalid uploader":  patchsetCreatedArgs("uploader", `"not an address"`),
+		"invalid url":       patchsetCreatedArgs("change-url", "https://cl.tvl.fyi/"),
+		"unknown flag":      append(patchsetCreatedArgs(), "--frobnicate", "yes"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, "")
+
+			err := env.s.PatchsetCreated(args)
+			if err == nil || !strings.Contains(err.Error(), "failed to parse 'patchset-created'") {
+				t.Errorf("expected parse error, got %v", err)
+			}
+
+			if n := len(env.buildkite.createdBuilds()); n != 0 {
+				t.Errorf("expected no builds, got %d", n)
+			}
+		})
+	}
+}
+
+func TestPatchsetCreatedBuildkiteError(t *testing.T) {
+	env := newTestEnv(t, "")
+	env.buildkite.setFail(true)
+
+	err := env.s.PatchsetCreated(patchsetCreatedArgs())
+	if err == nil || !strings.Contains(err.Error(), "Buildkite is having a bad day") {
+		t.Errorf("expected Buildkite error, got %v", err)
+	}
+
+	if n := len(env.gerrit.postedReviews()); n != 0 {
+		t.Errorf("expected no reviews after failed trigger, got %d", n)
+	}
+}
+
+func TestPatchsetCreatedGerritError(t *testing.T) {
+	env := newTestEnv(t, "")
+	env.gerrit.setFail(true)
+
+	err := env.s.PatchsetCreated(patchsetCreatedArgs())
+	if err == nil || !strings.Contains(err.Error(), "Gerrit is having a bad day") {
+		t.Errorf("expected Gerrit error, got %v", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 1 {
+		t.Errorf("expected build to be triggered regardless, got %d builds", n)
+	}
+}
+
+func TestPatchsetCreatedGerritUnreachable(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	// Requests to a closed server fail without any response, which
+	// used to cause a nil pointer dereference.
+	env.gerrit.server.Close()
+
+	err := env.s.PatchsetCreated(patchsetCreatedArgs())
+	if err == nil || !strings.Contains(err.Error(), "failed to send Gerrit request") {
+		t.Errorf("expected Gerrit network error, got %v", err)
+	}
+}
+
+func TestChangeMergedTriggersHeadBuild(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	err := env.s.ChangeMerged(changeMergedArgs())
+	if err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(builds))
+	}
+
+	if builds[0].Branch != "refs/heads/canon" || builds[0].Commit != "f00dfeed" {
+		t.Errorf("unexpected HEAD build: %+v", builds[0])
+	}
+
+	if _, ok := builds[0].Env["GERRIT_CHANGE_ID"]; ok {
+		t.Errorf("HEAD build should not have change information: %v", builds[0].Env)
+	}
+
+	if n := len(env.gerrit.postedReviews()); n != 0 {
+		t.Errorf("expected no reviews for HEAD build, got %d", n)
+	}
+}
+
+func TestChangeMergedOtherBranch(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	if err := env.s.ChangeMerged(changeMergedArgs("branch", "release")); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 0 {
+		t.Errorf("expected no builds, got %d", n)
+	}
+}
+
+// actionServer records requests sent by post-merge actions. The first
+// 'failures' requests are answered with an error.
+type actionServer struct {
+	*httptest.Server
+	failures int
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newActionServer(t *testing.T, failures int) *actionServer {
+	a := &actionServer{failures: failures, status: http.StatusServiceUnavailable}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		a.requests = append(a.requests, r)
+		a.bodies = append(a.bodies, string(body))
+
+		if len(a.requests) <= a.failures {
+			http.Error(w, "request failed", a.status)
+		}
+	}))
+	t.Cleanup(a.Close)
+	return a
+}
+
+func TestPostMergeActions(t *testing.T) {
+	sourcegraph := newActionServer(t, 0)
+	webhook := newActionServer(t, 2)
+
+	actions, _ := json.Marshal([]map[string]interface{}{
+		{
+			"kind": "sourcegraph",
+			"url":  sourcegraph.URL,
+			"auth": map[string]string{"token": "sg-token"},
+		},
+		{
+			"name":       "notify",
+			"kind":       "webhook",
+			"url":        webhook.URL,
+			"body":       `{"commit": {{ json .Commit }}, "by": {{ json .Author }}, "ref": {{ json .Ref }}}`,
+			"auth":       map[string]string{"type": "basic", "user": "hook", "password": "hunter2"},
+			"retries":    2,
+			"retryDelay": "5s",
+		},
+	})
+	env := newQueueTestEnvWith(t, "", `, "postMergeActions": `+string(actions))
+
+	if err := env.s.ChangeMerged(changeMergedArgs()); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	// Retries run in the daemon after the hook has returned.
+	env.s.background.Wait()
+
+	if len(sourcegraph.requests) != 1 {
+		t.Fatalf("expected 1 Sourcegraph request, got %d", len(sourcegraph.requests))
+	}
+
+	if auth := sourcegraph.requests[0].Header.Get("Authorization"); auth != "token sg-token" {
+		t.Errorf("unexpected Sourcegraph authorization: %q", auth)
+	}
+
+	if len(webhook.requests) != 3 {
+		t.Fatalf("expected 3 webhook requests (with retries), got %d", len(webhook.requests))
+	}
+
+	if user, password, _ := webhook.requests[2].BasicAuth(); user != "hook" || password != "hunter2" {
+		t.Errorf("unexpected webhook credentials: %q/%q", user, password)
+	}
+
+	want := `{"commit": "f00dfeed", "by": "Sam Submitter", "ref": "refs/heads/canon"}`
+	if webhook.bodies[2] != want {
+		t.Errorf("unexpected webhook body:\n got: %s\nwant: %s", webhook.bodies[2], want)
+	}
+
+	if len(env.sleeps) != 2 || env.sleeps[0] != 5*time.Second || env.sleeps[1] != 10*time.Second {
+		t.Errorf("unexpected retry delays: %v", env.sleeps)
+	}
+}
+
+func TestPostMergeActionsFailure(t *testing.T) {
+	webhook := newActionServer(t, 10)
+	env := newQueueTestEnvWith(t, "", `, "postMergeActions": [{"kind": "docs", "url": "`+webhook.URL+`", "retries": 1}]`)
+
+	// Action failures are logged, but do not fail the hook.
+	if err := env.s.ChangeMerged(changeMergedArgs()); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+	env.s.background.Wait()
+
+	if len(webhook.requests) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(webhook.requests))
+	}
+
+	if !env.log.contains(`post-merge action "docs" failed after retries`) {
+		t.Errorf("expected action failure to be logged, got %v", env.log.msgs)
+	}
+}
+
+func TestPostMergeActionsClientError(t *testing.T) {
+	webhook := newActionServer(t, 10)
+	webhook.status = http.StatusBadRequest
+	env := newQueueTestEnvWith(t, "", `, "postMergeActions": [{"kind": "docs", "url": "`+webhook.URL+`", "retries": 3}]`)
+
+	if err := env.s.ChangeMerged(changeMergedArgs()); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+	env.s.background.Wait()
+
+	// Client errors can not be fixed by retrying.
+	if len(webhook.requests) != 1 || len(env.sleeps) != 0 {
+		t.Errorf("expected a single request without retries, got %d requests", len(webhook.requests))
+	}
+
+	if !env.log.contains(`post-merge action "docs" failed: received non-success response`) {
+		t.Errorf("expected action failure to be logged, got %v", env.log.msgs)
+	}
+}
+
+func TestPostMergeActionsWithoutDaemon(t *testing.T) {
+	webhook := newActionServer(t, 10)
+	env := newTestEnv(t, `{"postMergeActions": [{"kind": "docs", "url": "`+webhook.URL+`", "retries": 3}]}`)
+
+	if err := env.s.ChangeMerged(changeMergedArgs()); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	// Hooks do not wait for retries themselves.
+	if len(webhook.requests) != 1 || len(env.sleeps) != 0 {
+		t.Errorf("expected a single request without retries, got %d requests", len(webhook.requests))
+	}
+
+	if !env.log.contains(`post-merge action "docs" failed`) {
+		t.Errorf("expected action failure to be logged, got %v", env.log.msgs)
+	}
+}
+
+func TestPostMergeActionsSkippedForChanges(t *testing.T) {
+	webhook := newActionServer(t, 0)
+	env := newTestEnv(t, `{"postMergeActions": [{"kind": "zoekt", "url": "`+webhook.URL+`"}]}`)
+
+	if err := env.s.PatchsetCreated(patchsetCreatedArgs()); err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	if len(webhook.requests) != 0 {
+		t.Errorf("expected no post-merge actions for CL builds, got %d", len(webhook.requests))
+	}
+}
+
+func TestChangePolicies(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		policy   string
+		wip      bool
+		private  bool
+		builds   int
+		wantEnv  map[string]string
+		unsetEnv []string
+	}{
+		{name: "wip skipped", policy: `{"wip": "skip"}`, wip: true, builds: 0},
+		{name: "ready built", policy: `{"wip": "skip"}`, builds: 1},
+		{name: "wip without vote", policy: `{"wip": "novote"}`, wip: true, builds: 1, wantEnv: map[string]string{noVoteEnv: "true"}},
+		{name: "wip low priority", policy: `{"wip": "lowpriority"}`, wip: true, builds: 1, wantEnv: map[string]string{priorityEnv: "-1"}},
+		{name: "wip custom priority", policy: `{"wip": "lowpriority", "wipPriority": -5}`, wip: true, builds: 1, wantEnv: map[string]string{priorityEnv: "-5"}},
+		{name: "private skipped", policy: `{"private": "skip"}`, private: true, builds: 0},
+		{name: "private built", policy: `{"wip": "skip"}`, private: true, builds: 1, unsetEnv: []string{noVoteEnv, priorityEnv}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			env := newTestEnv(t, `{"changePolicy": `+test.policy+`}`)
+			change := env.gerrit.addChange(1234, 2, "a1b2c3d4")
+			change.WorkInProgress = test.wip
+			change.IsPrivate = test.private
+
+			if err := env.s.PatchsetCreated(patchsetCreatedArgs()); err != nil {
+				t.Fatalf("PatchsetCreated failed: %s", err)
+			}
+
+			builds := env.buildkite.createdBuilds()
+			if len(builds) != test.builds {
+				t.Fatalf("expected %d builds, got %d", test.builds, len(builds))
+			}
+
+			for k, v := range test.wantEnv {
+				if builds[0].Env[k] != v {
+					t.Errorf("expected build env %s=%q, got %q", k, v, builds[0].Env[k])
+				}
+			}
+
+			for _, k := range test.unsetEnv {
+				if _, ok := builds[0].Env[k]; ok {
+					t.Errorf("expected build env %s to be unset", k)
+				}
+			}
+		})
+	}
+}
+
+func TestChangePolicyGerritError(t *testing.T) {
+	env := newTestEnv(t, `{"changePolicy": {"wip": "skip"}}`)
+
+	// The change is unknown to Gerrit, so its state can not be
+	// determined.
+	err := env.s.PatchsetCreated(patchsetCreatedArgs())
+	if err == nil || !strings.Contains(err.Error(), "failed to fetch change 1234") {
+		t.Errorf("expected change lookup error, got %v", err)
+	}
+}
+
+func stateChangedArgs(flag, value string) []string {
+	return []string{
+		"--change", "depot~canon~I0123456789abcdef",
+		"--change-url", "https://cl.tvl.fyi/c/depot/+/1234",
+		"--change-owner", `"Jane Doe <jane@tvl.su>"`,
+		"--change-owner-username", "jane",
+		"--project", "depot",
+		"--branch", "canon",
+		"--topic", "",
+		"--changer", `"Jane Doe <jane@tvl.su>"`,
+		"--changer-username", "jane",
+		"--" + flag, value,
+	}
+}
+
+func TestWipStateChanged(t *testing.T) {
+	env := newTestEnv(t, `{"changePolicy": {"wip": "skip"}}`)
+	env.gerrit.addChange(1234, 3, "c0ffee")
+
+	// Marking a change as WIP never triggers a build.
+	if err := env.s.WipStateChanged(stateChangedArgs("wip", "true")); err != nil {
+		t.Fatalf("WipStateChanged failed: %s", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 0 {
+		t.Fatalf("expected no builds, got %d", n)
+	}
+
+	if err := env.s.WipStateChanged(stateChangedArgs("wip", "false")); err != nil {
+		t.Fatalf("WipStateChanged failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(builds))
+	}
+
+	if builds[0].Commit != "c0ffee" || builds[0].Branch != "cl/1234" || builds[0].Env["GERRIT_PATCHSET"] != "3" {
+		t.Errorf("unexpected build for ready change: %+v", builds[0])
+	}
+
+	// The uploader's details are only returned by Gerrit on request.
+	if builds[0].Author.Email != "jane@tvl.su" || builds[0].Author.Name != "Jane Doe" {
+		t.Errorf("unexpected author of build for ready change: %+v", builds[0].Author)
+	}
+
+	// The patchset now has a build, so it is not built again.
+	if err := env.s.WipStateChanged(stateChangedArgs("wip", "false")); err != nil {
+		t.Fatalf("WipStateChanged failed: %s", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 1 {
+		t.Errorf("expected no additional build, got %d builds", n)
+	}
+}
+
+func TestWipStateChangedAfterNoVoteBuild(t *testing.T) {
+	env := newTestEnv(t, `{"changePolicy": {"wip": "novote"}}`)
+	env.gerrit.addChange(1234, 3, "c0ffee")
+	env.buildkite.add(Build{
+		Commit: "c0ffee",
+		Branch: "cl/1234",
+		Env:    map[string]string{noVoteEnv: "true"},
+	}, "passed")
+
+	if err := env.s.WipStateChanged(stateChangedArgs("wip", "false")); err != nil {
+		t.Fatalf("WipStateChanged failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) != 2 {
+		t.Fatalf("expected a voting build to be triggered, got %d builds", len(builds))
+	}
+
+	if _, ok := builds[1].Env[noVoteEnv]; ok {
+		t.Errorf("build of ready change should vote: %v", builds[1].Env)
+	}
+}
+
+func TestPrivateStateChanged(t *testing.T) {
+	env := newTestEnv(t, `{"changePolicy": {"private": "skip"}}`)
+	change := env.gerrit.addChange(1234, 1, "deadbeef")
+
+	// Still private (e.g. the hook was delayed), so nothing is built.
+	change.IsPrivate = true
+	if err := env.s.PrivateStateChanged(stateChangedArgs("private", "false")); err != nil {
+		t.Fatalf("PrivateStateChanged failed: %s", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 0 {
+		t.Fatalf("expected no builds, got %d", n)
+	}
+
+	change.IsPrivate = false
+	if err := env.s.PrivateStateChanged(stateChangedArgs("private", "false")); err != nil {
+		t.Fatalf("PrivateStateChanged failed: %s", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 1 {
+		t.Errorf("expected 1 build, got %d", n)
+	}
+}
+
+func TestStateChangedErrors(t *testing.T) {
+	env := newTestEnv(t, "")
+	env.gerrit.addChange(1234, 1, "deadbeef")
+	env.buildkite.setFail(true)
+
+	err := env.s.WipStateChanged(stateChangedArgs("wip", "false"))
+	if err == nil || !strings.Contains(err.Error(), "failed to list builds") {
+		t.Errorf("expected Buildkite error, got %v", err)
+	}
+
+	err = env.s.PrivateStateChanged(append(stateChangedArgs("private", "false"), "--bogus"))
+	if err == nil || !strings.Contains(err.Error(), "'private-state-changed'") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+}
+
+// postCommandEnv returns a getenv function for the post-command hook.
+func postCommandEnv(overrides map[string]string) func(string) string {
+	env := map[string]string{
+		"GERRIT_CHANGE_ID":              "1234",
+		"GERRIT_PATCHSET":               "2",
+		"BUILDKITE_LABEL":               ":duck:",
+		"BUILDKITE_COMMAND_EXIT_STATUS": "0",
+		"BUILDKITE_BUILD_URL":           "https://buildkite.com/tvl/depot/builds/1",
+		"BUILDKITE_BUILD_NUMBER":        "1",
+		"BUILDKITE_JOB_ID":              "duck",
+	}
+
+	for k, v := range overrides {
+		env[k] = v
+	}
+
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func TestPostCommandPassed(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	if err := env.s.PostCommand(postCommandEnv(nil)); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+
+	r := reviews[0].review
+	if r.Message != "Build of patchset 2 passed: https://buildkite.com/tvl/depot/builds/1" {
+		t.Errorf("unexpected message: %q", r.Message)
+	}
+
+	if r.Labels["Verified"] != 1 || r.Notify != "NONE" || !r.IgnoreDefaultAttentionSetRules {
+		t.Errorf("unexpected review for passed build: %+v", r)
+	}
+
+	if !strings.Contains(env.out.String(), "Added CI status comment") {
+		t.Errorf("expected status output, got %q", env.out.String())
+	}
+}
+
+func TestPostCommandFailed(t *testing.T) {
+	env := newTestEnv(t, `{"failureLogLines": 2, "failureRobotComments": true}`)
+	env.gerrit.files["1234"] = []string{"ops/besadii/main.go", "web/README.md"}
+
+	fb := env.buildkite.add(Build{Commit: "a1b2c3d4", Branch: "cl/1234"}, "failing")
+	env.buildkite.addJob(fb, "ok", ":nix: web", "passed", map[string]string{"READTREE_TARGET": "web"}, "fine\n")
+	env.buildkite.addJob(fb, "broken", ":nix: ops/besadii", "failed",
+		map[string]string{"READTREE_TARGET": "ops/besadii"},
+		"\x1b_bk;t=1\x07building\nerror: compilation failed\r\n\x1b[31mbuilder failed\x1b[0m\n")
+	env.buildkite.addJob(fb, "duck", ":duck:", "running", nil, "")
+
+	err := env.s.PostCommand(postCommandEnv(map[string]string{"BUILDKITE_COMMAND_EXIT_STATUS": "1"}))
+	if err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+
+	r := reviews[0].review
+	if r.Labels["Verified"] != -1 || r.Notify != "OWNER" || r.IgnoreDefaultAttentionSetRules {
+		t.Errorf("unexpected review for failed build: %+v", r)
+	}
+
+	wantMsg := "Build of patchset 2 failed: https://buildkite.com/tvl/depot/builds/1\n\n" +
+		"Failed steps:\n\n" +
+		"* :nix: ops/besadii (target: ops/besadii): https://buildkite.com/tvl/depot/builds/1#broken\n\n" +
+		"    error: compilation failed\n" +
+		"    builder failed\n"
+	if r.Message != wantMsg {
+		t.Errorf("unexpected message:\n got: %q\nwant: %q", r.Message, wantMsg)
+	}
+
+	if len(r.RobotComments) != 1 || len(r.RobotComments["ops/besadii/main.go"]) != 1 {
+		t.Fatalf("expected one robot comment on ops/besadii/main.go, got %+v", r.RobotComments)
+	}
+
+	comment := r.RobotComments["ops/besadii/main.go"][0]
+	if comment.RobotId != "besadii" || !strings.Contains(comment.Message, "Target ops/besadii failed") {
+		t.Errorf("unexpected robot comment: %+v", comment)
+	}
+}
+
+func TestFailedJobsTruncation(t *testing.T) {
+	for _, count := range []int{maxFailedJobs, maxFailedJobs + 1} {
+		env := newTestEnv(t, "")
+		fb := env.buildkite.add(Build{Commit: "a1b2c3d4", Branch: "cl/1234"}, "failed")
+		for i := 0; i < count; i++ {
+			env.buildkite.addJob(fb, fmt.Sprintf("job%d", i), "step", "failed", nil, "error\n")
+		}
+
+		failures, truncated, err := env.s.findFailedJobs(strconv.Itoa(fb.number), "")
+		if err != nil {
+			t.Fatalf("findFailedJobs failed: %s", err)
+		}
+
+		if len(failures) != maxFailedJobs || truncated != (count > maxFailedJobs) {
+			t.Errorf("%d failed jobs: got %d failures, truncated = %v", count, len(failures), truncated)
+		}
+
+		note := strings.Contains(formatFailures(failures, truncated), "Only the first")
+		if note != truncated {
+			t.Errorf("%d failed jobs: truncation note shown = %v", count, note)
+		}
+	}
+}
+
+func TestFailedJobLogTail(t *testing.T) {
+	env := newTestEnv(t, `{"failureLogLines": 2}`)
+	fb := env.buildkite.add(Build{Commit: "a1b2c3d4", Branch: "cl/1234"}, "failed")
+
+	// Only the end of the log is fetched, and the line that is cut
+	// off at its start is discarded.
+	env.buildkite.addJob(fb, "broken", "step", "failed", nil, strings.Repeat("x", 3*logBytesPerLine)+"\nerror\n")
+
+	failures, _, err := env.s.findFailedJobs(strconv.Itoa(fb.number), "")
+	if err != nil {
+		t.Fatalf("findFailedJobs failed: %s", err)
+	}
+
+	if len(failures) != 1 || !reflect.DeepEqual(failures[0].Log, []string{"error"}) {
+		t.Errorf("unexpected failures: %+v", failures)
+	}
+}
+
+func TestPostCommandFailureSummaryError(t *testing.T) {
+	env := newTestEnv(t, "")
+
+	// The build does not exist on Buildkite, but the vote should be
+	// posted anyways.
+	err := env.s.PostCommand(postCommandEnv(map[string]string{
+		"BUILDKITE_COMMAND_EXIT_STATUS": "1",
+		"BUILDKITE_BUILD_NUMBER":        "42",
+	}))
+	if err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 || reviews[0].review.Labels["Verified"] != -1 {
+		t.Fatalf("expected a failing vote, got %+v", reviews)
+	}
+
+	if !strings.Contains(env.out.String(), "failed to summarise build failures") {
+		t.Errorf("expected summary error in output, got %q", env.out.String())
+	}
+}
+
+func TestPostCommandNoVote(t *testing.T) {
+	env := newTestEnv(t, `{"failureLogLines": -1}`)
+
+	err := env.s.PostCommand(postCommandEnv(map[string]string{
+		"BUILDKITE_COMMAND_EXIT_STATUS": "1",
+		noVoteEnv:                       "true",
+	}))
+	if err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+
+	if r := reviews[0].review; r.Labels != nil || r.Notify != "NONE" {
+		t.Errorf("expected review without vote, got %+v", r)
+	}
+}
+
+func TestPostCommandSkipped(t *testing.T) {
+	for name, overrides := range map[string]map[string]string{
+		"head build":   {"GERRIT_CHANGE_ID": "", "GERRIT_PATCHSET": ""},
+		"another step": {"BUILDKITE_LABEL": ":nix: ops/besadii"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			env := newTestEnv(t, "")
+
+			if err := env.s.PostCommand(postCommandEnv(overrides)); err != nil {
+				t.Fatalf("PostCommand failed: %s", err)
+			}
+
+			if n := len(env.gerrit.postedReviews()); n != 0 {
+				t.Errorf("expected no reviews, got %d", n)
+			}
+		})
+	}
+}
+
+func TestPostCommandGerritError(t *testing.T) {
+	env := newTestEnv(t, "")
+	env.gerrit.setFail(true)
+
+	err := env.s.PostCommand(postCommandEnv(nil))
+	if err == nil || !strings.Contains(err.Error(), "failed to update cl") {
+		t.Errorf("expected Gerrit error, got %v", err)
+	}
+}
+
+func TestBuildRules(t *testing.T) {
+	env := newTestEnv(t, `{"buildRules": [
+		{"paths": ["third_party/nixpkgs"], "queue": "large-disk", "cleanCheckout": true},
+		{"emailDomains": ["tvl.su"], "metaData": {"team": "tvl"}},
+		{"emails": ["bot@tvl.su"], "priority": -10},
+		{"hashtags": ["urgent"], "priority": 10},
+		{"project": "other", "queue": "never"}
+	]}`)
+	env.gerrit.files["1234"] = []string{"third_party/nixpkgs/default.nix"}
+	env.gerrit.hashtags["1234"] = []string{"urgent"}
+
+	if err := env.s.PatchsetCreated(patchsetCreatedArgs()); err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	if err := env.s.PatchsetCreated(patchsetCreatedArgs(
+		"change-url", "https://cl.tvl.fyi/c/depot/+/5678",
+		"uploader", `"Bot <bot@tvl.su>"`,
+	)); err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) != 2 {
+		t.Fatalf("expected 2 builds, got %d", len(builds))
+	}
+
+	human, bot := builds[0], builds[1]
+
+	if human.Env[queueEnv] != "large-disk" || !human.CleanCheckout {
+		t.Errorf("expected large-disk queue and clean checkout, got %+v", human)
+	}
+
+	if human.MetaData["team"] != "tvl" || human.Env[priorityEnv] != "10" {
+		t.Errorf("expected team metadata and high priority, got %+v", human)
+	}
+
+	if _, ok := bot.Env[queueEnv]; ok || bot.CleanCheckout {
+		t.Errorf("expected default queue for bot build, got %+v", bot)
+	}
+
+	if bot.Env[priorityEnv] != "-10" {
+		t.Errorf("expected low priority for bot build, got %+v", bot)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for name, cfg := range map[string]string{
+		"invalid json":       `{`,
+		"missing repository": `{"branch": "canon"}`,
+		"invalid change name": `{"repository": "depot", "branch": "canon", "gerritChangeName": "CL!",
+			"gerritUrl": "g", "gerritUser": "u", "gerritPassword": "p",
+			"buildkiteOrg": "o", "buildkiteProject": "p", "buildkiteToken": "t"}`,
+		"unknown action": `{"repository": "depot", "branch": "canon", "postMergeActions": [{"kind": "fax", "url": "x"}]}`,
+		"unknown policy": `{"repository": "depot", "branch": "canon", "changePolicy": {"wip": "maybe"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseConfig([]byte(cfg)); err == nil {
+				t.Errorf("expected configuration error")
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the mapping of Gerrit accounts to the authors
+// shown for builds on Buildkite.
+
+package ci
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// identityConfig configures how Gerrit users are mapped to build
+// authors.
+type identityConfig struct {
+	// Identities for known Gerrit users, e.g. to use the address a
+	// user signed up to Buildkite with or to give bots a fixed
+	// identity.
+	Mappings []identityMapping `json:"mappings"`
+
+	// Whether to look up users in Gerrit's accounts API by username,
+	// which makes all of their email addresses available for matching
+	// mappings and uses their preferred name and email otherwise.
+	LookupAccounts bool `json:"lookupAccounts"`
+
+	// Policy for users without a mapping, one of "gerrit" (the
+	// default, use the identity known to Gerrit), "fallback" (use the
+	// fallback identity) or "skip" (do not build their changes; HEAD
+	// builds are always triggered).
+	Unknown  string `json:"unknown"`
+	Fallback Author `json:"fallback"`
+}
+
+// identityMapping maps a Gerrit user, matched by username or any of
+// their email addresses, to a build author.
+type identityMapping struct {
+	GerritUsername string `json:"gerritUsername"`
+	GerritEmail    string `json:"gerritEmail"`
+
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// validateIdentities fills in defaults of the identity configuration
+// and checks it for errors.
+func validateIdentities(cfg *identityConfig) error {
+	for i, m := range cfg.Mappings {
+		if m.GerritUsername == "" && m.GerritEmail == "" {
+			return fmt.Errorf("identity mapping %d must match 'gerritUsername' or 'gerritEmail'", i)
+		}
+
+		if m.Name == "" && m.Email == "" {
+			return fmt.Errorf("identity mapping %d must set 'name' or 'email'", i)
+		}
+	}
+
+	switch cfg.Unknown {
+	case "":
+		cfg.Unknown = "gerrit"
+	case "gerrit", "skip":
+	case "fallback":
+		if cfg.Fallback.Name == "" || cfg.Fallback.Email == "" {
+			return fmt.Errorf("the 'fallback' policy for unknown users requires a fallback name and email")
+		}
+	default:
+		return fmt.Errorf("unknown policy for unknown users %q", cfg.Unknown)
+	}
+
+	return nil
+}
+
+// lookupAccount fetches the account with the given username from
+// Gerrit, including all of its email addresses. It returns nil if the
+// account does not exist.
+func (g *gerritClient) lookupAccount(username string) (*accountInfo, error) {
+	var accounts []accountInfo
+	query := url.Values{"q": {"username:" + username}, "o": {"DETAILS", "ALL_EMAILS"}}
+	err := g.get("accounts/?"+query.Encode(), &accounts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up Gerrit account %q: %w", username, err)
+	}
+
+	if len(accounts) != 1 {
+		return nil, nil
+	}
+
+	return &accounts[0], nil
+}
+
+// matches returns true if the mapping applies to a Gerrit user with the
+// given username and email addresses.
+func (m *identityMapping) matches(username string, emails []string) bool {
+	if m.GerritUsername != "" && m.GerritUsername == username {
+		return true
+	}
+
+	return m.GerritEmail != "" && containsFold(emails, m.GerritEmail)
+}
+
+// buildAuthor determines the author of a build for the user that
+// triggered it. If the second return value is false, no build should
+// be triggered.
+func (s *Service) buildAuthor(trigger *buildTrigger) (Author, bool) {
+	cfg := &s.cfg.Identities
+	author := Author{Name: trigger.author, Email: trigger.email}
+	emails := []string{trigger.email}
+
+	if cfg.LookupAccounts && trigger.username != "" {
+		account, err := s.gerrit.lookupAccount(trigger.username)
+		if err != nil {
+			// The identity passed by Gerrit is still usable.
+			s.log.Err(fmt.Sprintf("failed to look up build author: %s", err))
+		} else if account != nil {
+			emails = append(emails, account.Email)
+			emails = append(emails, account.SecondaryEmails...)
+
+			if account.Email != "" {
+				author.Email = account.Email
+			}
+
+			if account.DisplayName != "" {
+				author.Name = account.DisplayName
+			} else if account.Name != "" {
+				author.Name = account.Name
+			}
+		}
+	}
+
+	for _, m := range cfg.Mappings {
+		if !m.matches(trigger.username, emails) {
+			continue
+		}
+
+		if m.Name != "" {
+			author.Name = m.Name
+		}
+
+		if m.Email != "" {
+			author.Email = m.Email
+		}
+
+		return author, true
+	}
+
+	switch cfg.Unknown {
+	case "fallback":
+		return cfg.Fallback, true
+	case "skip":
+		if trigger.changeId == "" {
+			break
+		}
+
+		s.log.Info(fmt.Sprintf("not building commit %q of unknown user %q <%s>", trigger.commit, trigger.username, trigger.email))
+		return Author{}, false
+	}
+
+	return author, true
+}
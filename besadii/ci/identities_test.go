@@ -0,0 +1,155 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const identityMappings = `"mappings": [
+	{"gerritUsername": "clbot", "name": "TVL bot", "email": "bot@buildkite.tvl.fyi"},
+	{"gerritEmail": "Jane@Example.COM", "email": "jane@buildkite.tvl.fyi"}
+]`
+
+// authorOf triggers a build for a patchset uploaded by the given user
+// and returns the author of the created build, if any.
+func authorOf(t *testing.T, env *testEnv, uploader, username string) *Author {
+	t.Helper()
+
+	err := env.s.PatchsetCreated(patchsetCreatedArgs("uploader", uploader, "uploader-username", username))
+	if err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) == 0 {
+		return nil
+	}
+	return &builds[len(builds)-1].Author
+}
+
+func TestIdentityMappings(t *testing.T) {
+	env := newTestEnv(t, `{"identities": {`+identityMappings+`}}`)
+
+	for _, test := range []struct {
+		uploader, username string
+		want               Author
+	}{
+		{`"Some Bot <clbot@tvl.su>"`, "clbot", Author{Name: "TVL bot", Email: "bot@buildkite.tvl.fyi"}},
+		{`"Jane <jane@example.com>"`, "jane", Author{Name: "Jane", Email: "jane@buildkite.tvl.fyi"}},
+		{`"Sam <sam@tvl.su>"`, "sam", Author{Name: "Sam", Email: "sam@tvl.su"}},
+	} {
+		if got := authorOf(t, env, test.uploader, test.username); got == nil || *got != test.want {
+			t.Errorf("unexpected author for %s: %+v (want %+v)", test.uploader, got, test.want)
+		}
+	}
+}
+
+func TestIdentityAccountLookup(t *testing.T) {
+	env := newTestEnv(t, `{"identities": {"lookupAccounts": true, `+identityMappings+`}}`)
+	env.gerrit.accounts["jane"] = accountInfo{
+		Name:            "Jane Doe",
+		DisplayName:     "jane",
+		Email:           "jane@tvl.su",
+		Username:        "jane",
+		SecondaryEmails: []string{"jane@example.com"},
+	}
+	env.gerrit.accounts["sam"] = accountInfo{
+		Name:     "Samantha",
+		Email:    "sam@tvl.su",
+		Username: "sam",
+	}
+
+	// Secondary emails match mappings ...
+	want := Author{Name: "jane", Email: "jane@buildkite.tvl.fyi"}
+	if got := authorOf(t, env, `"Jane Doe <jane@tvl.su>"`, "jane"); got == nil || *got != want {
+		t.Errorf("unexpected author for mapped user: %+v", got)
+	}
+
+	// ... and other users get their preferred identity.
+	want = Author{Name: "Samantha", Email: "sam@tvl.su"}
+	if got := authorOf(t, env, `"Sam <sam@users.noreply.tvl.fyi>"`, "sam"); got == nil || *got != want {
+		t.Errorf("unexpected author for looked up user: %+v", got)
+	}
+
+	// Users unknown to Gerrit's accounts API keep the identity passed
+	// by the hook.
+	want = Author{Name: "Alex", Email: "alex@tvl.su"}
+	if got := authorOf(t, env, `"Alex <alex@tvl.su>"`, "alex"); got == nil || *got != want {
+		t.Errorf("unexpected author for unknown user: %+v", got)
+	}
+}
+
+func TestIdentityAccountLookupError(t *testing.T) {
+	env := newTestEnv(t, `{"identities": {"lookupAccounts": true}}`)
+
+	// Only the account lookup is rejected.
+	authorized := env.gerrit.authorized
+	env.gerrit.authorized = func(r *http.Request) bool {
+		return !strings.HasPrefix(r.URL.Path, "/a/accounts/") && authorized(r)
+	}
+
+	want := Author{Name: "Jane Doe", Email: "jane@tvl.su"}
+	if got := authorOf(t, env, `"Jane Doe <jane@tvl.su>"`, "jane"); got == nil || *got != want {
+		t.Errorf("unexpected author: %+v", got)
+	}
+
+	if !env.log.contains(`failed to look up Gerrit account "jane"`) {
+		t.Errorf("expected lookup error to be logged, got %v", env.log.msgs)
+	}
+}
+
+func TestIdentityFallback(t *testing.T) {
+	env := newTestEnv(t, `{"identities": {"unknown": "fallback", "fallback": {"name": "TVL contributor", "email": "ci@tvl.fyi"}, `+identityMappings+`}}`)
+
+	want := Author{Name: "TVL contributor", Email: "ci@tvl.fyi"}
+	if got := authorOf(t, env, `"Sam <sam@tvl.su>"`, "sam"); got == nil || *got != want {
+		t.Errorf("unexpected author for unknown user: %+v", got)
+	}
+
+	want = Author{Name: "TVL bot", Email: "bot@buildkite.tvl.fyi"}
+	if got := authorOf(t, env, `"Some Bot <clbot@tvl.su>"`, "clbot"); got == nil || *got != want {
+		t.Errorf("unexpected author for mapped user: %+v", got)
+	}
+}
+
+func TestIdentitySkipUnknown(t *testing.T) {
+	env := newTestEnv(t, `{"identities": {"unknown": "skip", `+identityMappings+`}}`)
+
+	if got := authorOf(t, env, `"Sam <sam@tvl.su>"`, "sam"); got != nil {
+		t.Errorf("expected no build for unknown user, got author %+v", got)
+	}
+
+	if n := len(env.gerrit.postedReviews()); n != 0 {
+		t.Errorf("expected no reviews, got %d", n)
+	}
+
+	// HEAD builds are never skipped.
+	if err := env.s.ChangeMerged(changeMergedArgs()); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	builds := env.buildkite.createdBuilds()
+	if len(builds) != 1 || builds[0].Author.Email != "sam@tvl.su" {
+		t.Errorf("expected HEAD build by submitter, got %+v", builds)
+	}
+}
+
+func TestIdentityConfiguration(t *testing.T) {
+	for name, identities := range map[string]string{
+		"empty match":       `{"mappings": [{"name": "Nobody"}]}`,
+		"empty identity":    `{"mappings": [{"gerritUsername": "jane"}]}`,
+		"unknown policy":    `{"unknown": "ignore"}`,
+		"fallback identity": `{"unknown": "fallback", "fallback": {"name": "CI"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := `{"repository": "depot", "branch": "canon", "identities": ` + identities + `}`
+			if _, err := ParseConfig([]byte(cfg)); err == nil || !strings.Contains(err.Error(), "mapping") && !strings.Contains(err.Error(), "unknown") {
+				t.Errorf("expected identity configuration error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements policies for building work-in-progress and
+// private changes, and the hooks that are invoked by Gerrit when the
+// state of a change is modified.
+
+package ci
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// changePolicy configures how changes in special states are built.
+//
+// besadii serves a single route (one repository and branch), so the
+// policy applies to all of its changes. Routes that need different
+// policies are served by separate besadii configurations.
+//
+// Work-in-progress changes replace the drafts of older Gerrit
+// versions, and are handled by the same policy.
+type changePolicy struct {
+	// What to do with work-in-progress changes, one of "build"
+	// (default), "skip", "novote" (build without voting on the CL)
+	// or "lowpriority".
+	Wip string `json:"wip"`
+
+	// Buildkite priority of work-in-progress builds if the
+	// "lowpriority" policy is used. Defaults to -1.
+	WipPriority *int `json:"wipPriority"`
+
+	// What to do with private changes, one of "build" (default) or
+	// "skip". The code of private changes should usually not be sent
+	// to shared CI infrastructure.
+	Private string `json:"private"`
+}
+
+// Environment variables passed to Buildkite builds to configure how
+// they are reported and, in the case of the priority, how the steps
+// generated by //nix/buildkite are scheduled. The pipeline definition
+// passes the priority to mkPipeline.
+const (
+	noVoteEnv   = "BESADII_NO_VOTE"
+	priorityEnv = "BESADII_PRIORITY"
+)
+
+// validatePolicy checks the change policy configuration and fills in
+// defaults.
+func validatePolicy(policy *changePolicy) error {
+	switch policy.Wip {
+	case "":
+		policy.Wip = "build"
+	case "build", "skip", "novote", "lowpriority":
+	default:
+		return fmt.Errorf("invalid work-in-progress policy %q", policy.Wip)
+	}
+
+	switch policy.Private {
+	case "":
+		policy.Private = "build"
+	case "build", "skip":
+	default:
+		return fmt.Errorf("invalid private change policy %q", policy.Private)
+	}
+
+	if policy.WipPriority == nil {
+		priority := -1
+		policy.WipPriority = &priority
+	}
+
+	return nil
+}
+
+// applyChangePolicy updates a trigger according to the configured
+// policies for the change's state. It returns false if the change
+// should not be built.
+func (s *Service) applyChangePolicy(change *changeInfo, trigger *buildTrigger) bool {
+	cfg := s.cfg
+
+	if change.IsPrivate && cfg.ChangePolicy.Private == "skip" {
+		return false
+	}
+
+	if !change.WorkInProgress {
+		return true
+	}
+
+	switch cfg.ChangePolicy.Wip {
+	case "skip":
+		return false
+	case "novote":
+		trigger.noVote = true
+	case "lowpriority":
+		trigger.priority = cfg.ChangePolicy.WipPriority
+	}
+
+	return true
+}
+
+// policyNeedsChange returns true if the change policies require
+// information from Gerrit about a change before building it.
+func policyNeedsChange(cfg *Config) bool {
+	return cfg.ChangePolicy.Wip != "build" || cfg.ChangePolicy.Private != "build"
+}
+
+// hasVotingBuild returns true if a build that will vote on the CL
+// exists for the given commit.
+func (s *Service) hasVotingBuild(changeId, commit string) (bool, error) {
+	query := url.Values{}
+	query.Set("commit", commit)
+	query.Set("branch", fmt.Sprintf("%s/%s", s.cfg.GerritChangeName, changeId))
+
+	var builds []struct {
+		State string            `json:"state"`
+		Env   map[string]string `json:"env"`
+	}
+	err := s.buildkite.getJSON("/builds?"+query.Encode(), &builds)
+	if err != nil {
+		return false, fmt.Errorf("failed to list builds of commit %s: %w", commit, err)
+	}
+
+	for _, b := range builds {
+		if b.Env[noVoteEnv] == "" && b.State != "canceled" && b.State != "canceling" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// buildTriggerFromChange constructs a trigger for the current patchset
+// of a change fetched from Gerrit.
+func buildTriggerFromChange(change *changeInfo) (*buildTrigger, error) {
+	revision, ok := change.Revisions[change.CurrentRevision]
+	if !ok {
+		return nil, fmt.Errorf("change %d has no current revision", change.Number)
+	}
+
+	return &buildTrigger{
+		project:  change.Project,
+		ref:      revision.Ref,
+		commit:   change.CurrentRevision,
+		author:   revision.Uploader.Name,
+		email:    revision.Uploader.Email,
+		username: revision.Uploader.Username,
+		changeId: strconv.Itoa(change.Number),
+		patchset: strconv.Itoa(revision.Number),
+	}, nil
+}
+
+// Extract the buildtrigger struct out of the flags passed to besadii
+// when invoked as Gerrit's 'wip-state-changed' or
+// 'private-state-changed' hook.
+//
+// A change that is marked ready for review or made public is built if
+// there is no build that votes on its current patchset yet.
+func (s *Service) buildTriggerFromStateChanged(hook, stateFlag string, args []string) (*buildTrigger, error) {
+	cfg := s.cfg
+	var project, targetBranch, changeUrl, state string
+
+	flags := newFlagSet(hook)
+	flags.StringVar(&project, "project", "", "Gerrit project")
+	flags.StringVar(&targetBranch, "branch", "", "CL target branch")
+	flags.StringVar(&changeUrl, "change-url", "", "HTTPS URL of change")
+	flags.StringVar(&state, stateFlag, "", "New state of the change")
+
+	// The state change hooks also pass various flags which we don't
+	// need.
+	ignoreFlags(flags, []string{"change", "topic", "change-owner", "change-owner-username", "changer", "changer-username"})
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if project != cfg.Repository || targetBranch != cfg.Branch {
+		return nil, nil
+	}
+
+	// Changes becoming WIP or private have nothing to build.
+	if state != "false" {
+		return nil, nil
+	}
+
+	matches := changeIdRegexp.FindStringSubmatch(changeUrl)
+	if matches == nil {
+		return nil, fmt.Errorf("invalid change URL %q", changeUrl)
+	}
+
+	change, err := s.gerrit.fetchChange(matches[1])
+	if err != nil {
+		return nil, err
+	}
+
+	trigger, err := buildTriggerFromChange(change)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.applyChangePolicy(change, trigger) {
+		return nil, nil
+	}
+
+	exists, err := s.hasVotingBuild(trigger.changeId, trigger.commit)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, nil
+	}
+
+	return trigger, nil
+}
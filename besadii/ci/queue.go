@@ -0,0 +1,487 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the trigger queue of daemon mode. Hooks submit
+// their build triggers to the daemon, which limits the number of
+// builds running at once and coalesces triggers for the same change.
+
+package ci
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queueConfig configures the trigger queue.
+//
+// besadii serves a single route (one repository and branch, built by
+// one pipeline), so the in-flight limit applies to all of its builds.
+// Deployments with several routes run one daemon per route.
+type queueConfig struct {
+	// URL of the besadii daemon to which hooks submit triggers. If
+	// unset, hooks trigger builds directly.
+	Url string `json:"url"`
+
+	// Shared secret with which hooks authenticate to the daemon. The
+	// daemon only accepts triggers if it is set.
+	Token string `json:"token"`
+
+	// Maximum number of builds that may run at once, and the maximum
+	// number of builds of changes by one author among them. HEAD
+	// builds are not limited per author. Unset limits take their
+	// defaults, and -1 disables a limit.
+	MaxInFlight          int `json:"maxInFlight"`
+	MaxInFlightPerAuthor int `json:"maxInFlightPerAuthor"`
+
+	// Time after which a build is no longer considered in flight if
+	// Buildkite has not reported it as finished, e.g. "3h".
+	InFlightTimeout string `json:"inFlightTimeout"`
+
+	inFlightTimeout time.Duration
+}
+
+// noLimit disables a limit of the trigger queue.
+const noLimit = -1
+
+// Delay before a queued trigger whose build could not be created is
+// retried, which doubles with each failure up to the maximum.
+const (
+	queueRetryDelay    = 30 * time.Second
+	queueMaxRetryDelay = 30 * time.Minute
+)
+
+// validateQueue fills in defaults of the queue configuration and
+// checks it for errors.
+func validateQueue(cfg *queueConfig) error {
+	if cfg.Url != "" && cfg.Token == "" {
+		return fmt.Errorf("the trigger queue 'url' requires a 'token'")
+	}
+
+	// Up to 10 builds run at once, and 2 per author, unless specified
+	// otherwise.
+	if cfg.MaxInFlight == 0 {
+		cfg.MaxInFlight = 10
+	}
+
+	if cfg.MaxInFlightPerAuthor == 0 {
+		cfg.MaxInFlightPerAuthor = 2
+	}
+
+	if cfg.MaxInFlight < noLimit || cfg.MaxInFlightPerAuthor < noLimit {
+		return fmt.Errorf("trigger queue limits must be positive, or %d for no limit", noLimit)
+	}
+
+	if cfg.InFlightTimeout == "" {
+		cfg.InFlightTimeout = "3h"
+	}
+
+	var err error
+	cfg.inFlightTimeout, err = time.ParseDuration(cfg.InFlightTimeout)
+	if err != nil || cfg.inFlightTimeout <= 0 {
+		return fmt.Errorf("invalid trigger queue 'inFlightTimeout' %q", cfg.InFlightTimeout)
+	}
+
+	return nil
+}
+
+// queuedTrigger is the representation of a build trigger submitted to
+// the daemon.
+type queuedTrigger struct {
+	Project  string `json:"project"`
+	Ref      string `json:"ref"`
+	Commit   string `json:"commit"`
+	Author   string `json:"author"`
+	Email    string `json:"email"`
+	Username string `json:"username,omitempty"`
+	ChangeId string `json:"changeId,omitempty"`
+	Patchset string `json:"patchset,omitempty"`
+	NoVote   bool   `json:"noVote,omitempty"`
+	Priority *int   `json:"priority,omitempty"`
+}
+
+func queuedFromTrigger(t *buildTrigger) *queuedTrigger {
+	return &queuedTrigger{
+		Project:  t.project,
+		Ref:      t.ref,
+		Commit:   t.commit,
+		Author:   t.author,
+		Email:    t.email,
+		Username: t.username,
+		ChangeId: t.changeId,
+		Patchset: t.patchset,
+		NoVote:   t.noVote,
+		Priority: t.priority,
+	}
+}
+
+func (q *queuedTrigger) trigger() *buildTrigger {
+	return &buildTrigger{
+		project:  q.Project,
+		ref:      q.Ref,
+		commit:   q.Commit,
+		author:   q.Author,
+		email:    q.Email,
+		username: q.Username,
+		changeId: q.ChangeId,
+		patchset: q.Patchset,
+		noVote:   q.NoVote,
+		priority: q.Priority,
+	}
+}
+
+// inFlightBuild is a build triggered from the queue that has not
+// finished yet.
+type inFlightBuild struct {
+	author  string
+	head    bool
+	started time.Time
+}
+
+// triggerQueue holds triggers waiting to be built, and the builds that
+// are currently running.
+type triggerQueue struct {
+	mu       sync.Mutex
+	pending  []*buildTrigger
+	inFlight map[int]inFlightBuild
+
+	// No triggers are dispatched before retryAt after a build could
+	// not be created, to back off from an unavailable Buildkite.
+	retryAt    time.Time
+	retryDelay time.Duration
+
+	// Signalled when triggers may have become ready to build.
+	wake chan struct{}
+}
+
+func newTriggerQueue() *triggerQueue {
+	return &triggerQueue{
+		inFlight: make(map[int]inFlightBuild),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (q *triggerQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// authorKey identifies the author of a build for per-author limits,
+// by their Gerrit username if it is known.
+func authorKey(username, email string) string {
+	if username != "" {
+		return username
+	}
+	return strings.ToLower(email)
+}
+
+// newerPatchset returns true if patchset a is newer than patchset b.
+func newerPatchset(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	if errA != nil || errB != nil {
+		return a != b
+	}
+	return na > nb
+}
+
+// add queues a trigger. A pending trigger for another patchset of the
+// same change is replaced if the new one is newer, keeping its place
+// in the queue.
+func (q *triggerQueue) add(trigger *buildTrigger) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.notify()
+
+	if trigger.changeId != "" {
+		for i, p := range q.pending {
+			if p.changeId != trigger.changeId {
+				continue
+			}
+
+			if !newerPatchset(p.patchset, trigger.patchset) {
+				q.pending[i] = trigger
+			}
+			return
+		}
+	}
+
+	q.pending = append(q.pending, trigger)
+}
+
+// retry puts a trigger whose build could not be created back at the
+// front of the queue, and backs off from dispatching. It is dropped if
+// a newer patchset of the change was queued in the meantime.
+func (q *triggerQueue) retry(trigger *buildTrigger, now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.retryDelay = min(max(2*q.retryDelay, queueRetryDelay), queueMaxRetryDelay)
+	q.retryAt = now.Add(q.retryDelay)
+
+	if trigger.changeId != "" {
+		for _, p := range q.pending {
+			if p.changeId == trigger.changeId {
+				return q.retryDelay
+			}
+		}
+	}
+
+	q.pending = append([]*buildTrigger{trigger}, q.pending...)
+	return q.retryDelay
+}
+
+// next removes and returns the next trigger that can be built within
+// the in-flight limits, or nil if there is none. HEAD builds are
+// preferred over builds of changes.
+func (q *triggerQueue) next(cfg *queueConfig, now time.Time) *buildTrigger {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if now.Before(q.retryAt) {
+		return nil
+	}
+
+	authors := make(map[string]int)
+	for number, b := range q.inFlight {
+		if now.Sub(b.started) > cfg.inFlightTimeout {
+			delete(q.inFlight, number)
+			continue
+		}
+
+		if !b.head {
+			authors[b.author]++
+		}
+	}
+
+	if cfg.MaxInFlight != noLimit && len(q.inFlight) >= cfg.MaxInFlight {
+		return nil
+	}
+
+	pick := -1
+	for i, t := range q.pending {
+		if t.changeId == "" {
+			pick = i
+			break
+		}
+
+		if pick == -1 && (cfg.MaxInFlightPerAuthor == noLimit || authors[authorKey(t.username, t.email)] < cfg.MaxInFlightPerAuthor) {
+			pick = i
+		}
+	}
+
+	if pick == -1 {
+		return nil
+	}
+
+	trigger := q.pending[pick]
+	q.pending = append(q.pending[:pick], q.pending[pick+1:]...)
+	return trigger
+}
+
+// remove removes a pending trigger for the given ref and commit, if
+// there is one.
+func (q *triggerQueue) remove(ref, commit string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, p := range q.pending {
+		if p.ref == ref && p.commit == commit {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// started marks a build as in flight, which ends any backoff.
+func (q *triggerQueue) started(number int, b inFlightBuild) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight[number] = b
+	q.retryDelay = 0
+}
+
+// finished marks a build as no longer in flight.
+func (q *triggerQueue) finished(number int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.inFlight[number]; ok {
+		delete(q.inFlight, number)
+		q.notify()
+	}
+}
+
+// loadQueue restores the queue from the records. Recorded builds that
+// have not finished are marked as in flight, so that the limits hold
+// across daemon restarts, and triggers that were queued but not built
+// yet are queued again.
+func (s *Service) loadQueue() error {
+	builds, err := s.loadBuilds()
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	for _, b := range builds {
+		if b.Finished() || now.Sub(b.Started) > s.cfg.Queue.inFlightTimeout {
+			continue
+		}
+
+		s.queue.started(b.Build, inFlightBuild{
+			author:  authorKey(b.Username, b.Email),
+			head:    b.ChangeId == "",
+			started: b.Started,
+		})
+	}
+
+	// Replaying the queue's records in order restores the pending
+	// triggers, including the coalescing of patchsets.
+	return readRecords(s.cfg, func(rec *record) {
+		if rec.Queued != nil {
+			s.queue.add(rec.Queued.trigger())
+		}
+
+		if rec.Dequeued != nil {
+			s.queue.remove(rec.Dequeued.Ref, rec.Dequeued.Commit)
+		}
+	})
+}
+
+// dispatchQueue triggers builds for queued triggers until the queue
+// is empty, the in-flight limits are reached or a build can not be
+// created.
+func (s *Service) dispatchQueue() {
+	for {
+		trigger := s.queue.next(&s.cfg.Queue, s.now())
+		if trigger == nil {
+			return
+		}
+
+		// Errors that occur after the build was created (e.g. while
+		// reporting it to Gerrit) do not prevent it from running.
+		build, err := s.triggerBuild(trigger)
+		if err != nil && build == nil {
+			delay := s.queue.retry(trigger, s.now())
+			s.log.Err(fmt.Sprintf("failed to trigger queued build of commit %q, retrying in %s: %s", trigger.commit, delay, err))
+			return
+		}
+
+		if err != nil {
+			s.log.Err(fmt.Sprintf("failed to trigger queued build of commit %q: %s", trigger.commit, err))
+		}
+
+		// The trigger is only recorded as dequeued once its build has
+		// been triggered, so that it is not lost if the daemon stops
+		// in between.
+		err = s.appendRecord(&record{Dequeued: queuedFromTrigger(trigger)})
+		if err != nil {
+			s.log.Err(fmt.Sprintf("failed to record dequeued build of commit %q: %s", trigger.commit, err))
+		}
+
+		// Builds can be skipped, e.g. for unknown users.
+		if build != nil {
+			s.queue.started(build.Number, inFlightBuild{
+				author:  authorKey(trigger.username, trigger.email),
+				head:    trigger.changeId == "",
+				started: s.now(),
+			})
+		}
+	}
+}
+
+// runQueue dispatches queued triggers whenever the queue changes. It
+// also checks periodically, as in-flight builds can time out and
+// failed triggers are retried.
+func (s *Service) runQueue() {
+	for {
+		s.dispatchQueue()
+
+		select {
+		case <-s.queue.wake:
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// queueAuthorized returns true if a request to the daemon carries the
+// shared queue token.
+func (s *Service) queueAuthorized(r *http.Request) bool {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Queue.Token)) == 1
+}
+
+// handleQueueTrigger accepts a build trigger submitted by a hook.
+func (s *Service) handleQueueTrigger(w http.ResponseWriter, r *http.Request) {
+	if !s.queueAuthorized(r) {
+		http.Error(w, "invalid queue token", http.StatusUnauthorized)
+		return
+	}
+
+	var queued queuedTrigger
+	if err := json.NewDecoder(r.Body).Decode(&queued); err != nil || queued.Ref == "" || queued.Commit == "" {
+		http.Error(w, "invalid trigger", http.StatusBadRequest)
+		return
+	}
+
+	// Hooks trigger builds directly if the daemon fails to accept
+	// their trigger, which is better than losing it on a restart.
+	if err := s.appendRecord(&record{Queued: &queued}); err != nil {
+		s.log.Err(fmt.Sprintf("failed to record queued build of commit %q: %s", queued.Commit, err))
+		http.Error(w, "failed to record trigger", http.StatusInternalServerError)
+		return
+	}
+
+	s.queue.add(queued.trigger())
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// submitToDaemon sends a JSON request to the given path of the
+// daemon, which must accept it.
+func (s *Service) submitToDaemon(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.cfg.Queue.Url, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create an HTTP request: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+s.cfg.Queue.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.queueClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("received non-success response from daemon: %s (%v)", strings.TrimSpace(string(respBody)), resp.Status)
+	}
+
+	return nil
+}
+
+// submitTrigger submits a build trigger to the daemon's queue.
+func (s *Service) submitTrigger(trigger *buildTrigger) error {
+	err := s.submitToDaemon("/triggers", queuedFromTrigger(trigger))
+	if err != nil {
+		return fmt.Errorf("failed to submit trigger: %w", err)
+	}
+
+	s.log.Info(fmt.Sprintf("queued build for ref %q at commit %q", trigger.ref, trigger.commit))
+	return nil
+}
@@ -0,0 +1,362 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newQueueTestEnv creates a test environment in which hooks submit
+// triggers to the service's own daemon handler.
+func newQueueTestEnv(t *testing.T, limits string) *testEnv {
+	return newQueueTestEnvWith(t, limits, "")
+}
+
+// newQueueTestEnvWith creates a test environment whose hooks submit to a
+// daemon served by the same service. The queue settings and extra
+// configuration fields are spliced into the configuration.
+func newQueueTestEnvWith(t *testing.T, queue, extra string) *testEnv {
+	var daemon http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		daemon.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	records := filepath.Join(t.TempDir(), "records.jsonl")
+	env := newTestEnv(t, fmt.Sprintf(`{
+		"recordsPath": %q,
+		"buildkiteWebhookToken": "hook-token",
+		"queue": {"url": %q, "token": "queue-token" %s}
+		%s
+	}`, records, server.URL, queue, extra))
+
+	daemon = env.s.Handler()
+	return env
+}
+
+// finishBuild reports a build as finished through the webhook.
+func (env *testEnv) finishBuild(t *testing.T, number int) {
+	t.Helper()
+
+	hook := fmt.Sprintf(`{"event": "build.finished", "build": {"number": %d, "state": "passed"}, "pipeline": {"slug": "depot"}}`, number)
+	if w := env.request("POST", "/webhook/buildkite", "hook-token", hook); w.Code != http.StatusNoContent {
+		t.Fatalf("webhook failed with %d: %s", w.Code, w.Body)
+	}
+}
+
+// clBuilt returns the change and patchset of created builds, or "HEAD"
+// for builds of the HEAD branch.
+func (env *testEnv) clBuilt() []string {
+	built := []string{}
+	for _, b := range env.buildkite.createdBuilds() {
+		if id, ok := b.Env["GERRIT_CHANGE_ID"]; ok {
+			built = append(built, id+"/"+b.Env["GERRIT_PATCHSET"])
+		} else {
+			built = append(built, "HEAD")
+		}
+	}
+	return built
+}
+
+// uploadBy returns the arguments of a patchset upload by the given
+// uploader, whose username is the local part of their email address.
+func uploadBy(change, patchset, uploader string) []string {
+	_, email, _ := strings.Cut(uploader, "<")
+	username, _, _ := strings.Cut(email, "@")
+
+	return patchsetCreatedArgs(
+		"change-url", "https://cl.tvl.fyi/c/depot/+/"+change,
+		"patchset", patchset,
+		"uploader", uploader,
+		"uploader-username", strings.ToLower(username),
+	)
+}
+
+func TestQueueCoalescesPatchsets(t *testing.T) {
+	env := newQueueTestEnv(t, "")
+
+	for _, args := range [][]string{
+		uploadBy("1234", "1", `"Jane <jane@tvl.su>"`),
+		uploadBy("1234", "3", `"Jane <jane@tvl.su>"`),
+		uploadBy("5678", "1", `"Sam <sam@tvl.su>"`),
+		// Delivered late, and older than the queued patchset.
+		uploadBy("1234", "2", `"Jane <jane@tvl.su>"`),
+	} {
+		if err := env.s.PatchsetCreated(args); err != nil {
+			t.Fatalf("PatchsetCreated failed: %s", err)
+		}
+	}
+
+	// Hooks only queue builds.
+	if n := len(env.buildkite.createdBuilds()); n != 0 {
+		t.Fatalf("expected no builds before dispatching, got %d", n)
+	}
+
+	env.s.dispatchQueue()
+
+	built := strings.Join(env.clBuilt(), " ")
+	if built != "1234/3 5678/1" {
+		t.Errorf("unexpected builds: %s", built)
+	}
+
+	// Triggers are still reported to Gerrit when they are built.
+	if n := len(env.gerrit.postedReviews()); n != 2 {
+		t.Errorf("expected 2 reviews, got %d", n)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	env := newQueueTestEnv(t, `, "maxInFlight": 2, "maxInFlightPerAuthor": 1`)
+
+	for _, args := range [][]string{
+		uploadBy("1", "1", `"Jane <jane@tvl.su>"`),
+		uploadBy("2", "1", `"Jane <Jane@tvl.su>"`),
+		uploadBy("3", "1", `"Sam <sam@tvl.su>"`),
+	} {
+		if err := env.s.PatchsetCreated(args); err != nil {
+			t.Fatalf("PatchsetCreated failed: %s", err)
+		}
+	}
+
+	if err := env.s.ChangeMerged(changeMergedArgs("submitter", `"Jane <jane@tvl.su>"`)); err != nil {
+		t.Fatalf("ChangeMerged failed: %s", err)
+	}
+
+	expect := func(want string) {
+		t.Helper()
+		env.s.dispatchQueue()
+		if built := strings.Join(env.clBuilt(), " "); built != want {
+			t.Errorf("unexpected builds:\n got: %s\nwant: %s", built, want)
+		}
+	}
+
+	// HEAD builds go first, and do not count towards the author's
+	// limit.
+	expect("HEAD 1/1")
+
+	// Builds of Jane's other change wait for her first build.
+	env.finishBuild(t, 1)
+	expect("HEAD 1/1 3/1")
+
+	env.finishBuild(t, 3)
+	expect("HEAD 1/1 3/1")
+
+	env.finishBuild(t, 2)
+	expect("HEAD 1/1 3/1 2/1")
+}
+
+func TestQueueInFlightTimeout(t *testing.T) {
+	env := newQueueTestEnv(t, `, "maxInFlight": 1, "inFlightTimeout": "1h"`)
+
+	for _, change := range []string{"1", "2"} {
+		if err := env.s.PatchsetCreated(uploadBy(change, "1", `"Jane <jane@tvl.su>"`)); err != nil {
+			t.Fatalf("PatchsetCreated failed: %s", err)
+		}
+	}
+
+	env.s.dispatchQueue()
+	if n := len(env.buildkite.createdBuilds()); n != 1 {
+		t.Fatalf("expected 1 build, got %d", n)
+	}
+
+	// Buildkite never reports the build as finished.
+	env.now = env.now.Add(61 * time.Minute)
+	env.s.dispatchQueue()
+
+	if n := len(env.buildkite.createdBuilds()); n != 2 {
+		t.Errorf("expected timed out build to be replaced, got %d builds", n)
+	}
+}
+
+func TestQueueUnlimited(t *testing.T) {
+	env := newQueueTestEnv(t, `, "maxInFlight": -1, "maxInFlightPerAuthor": -1`)
+
+	for _, change := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"} {
+		if err := env.s.PatchsetCreated(uploadBy(change, "1", `"Jane <jane@tvl.su>"`)); err != nil {
+			t.Fatalf("PatchsetCreated failed: %s", err)
+		}
+	}
+
+	env.s.dispatchQueue()
+	if n := len(env.buildkite.createdBuilds()); n != 12 {
+		t.Errorf("expected all 12 builds to start, got %d", n)
+	}
+}
+
+func TestQueueRetriesFailedTriggers(t *testing.T) {
+	env := newQueueTestEnv(t, "")
+
+	for _, change := range []string{"1", "2"} {
+		if err := env.s.PatchsetCreated(uploadBy(change, "1", `"Jane <jane@tvl.su>"`)); err != nil {
+			t.Fatalf("PatchsetCreated failed: %s", err)
+		}
+	}
+
+	env.buildkite.setFail(true)
+	env.s.dispatchQueue()
+
+	if !env.log.contains("retrying in 30s") {
+		t.Errorf("expected failed trigger to be retried, got %v", env.log.msgs)
+	}
+
+	// Failed triggers are not recorded as dequeued, so that they
+	// survive restarts.
+	err := readRecords(env.s.cfg, func(rec *record) {
+		if rec.Dequeued != nil {
+			t.Errorf("failed trigger recorded as dequeued: %+v", rec.Dequeued)
+		}
+	})
+	if err != nil {
+		t.Fatalf("failed to read records: %s", err)
+	}
+
+	// Nothing is dispatched while backing off, and the backoff
+	// doubles with each failure.
+	env.buildkite.setFail(false)
+	env.s.dispatchQueue()
+	if n := len(env.buildkite.createdBuilds()); n != 0 {
+		t.Fatalf("expected no builds while backing off, got %d", n)
+	}
+
+	env.buildkite.setFail(true)
+	env.now = env.now.Add(31 * time.Second)
+	env.s.dispatchQueue()
+	if !env.log.contains("retrying in 1m0s") {
+		t.Errorf("expected backoff to double, got %v", env.log.msgs)
+	}
+
+	env.buildkite.setFail(false)
+	env.now = env.now.Add(61 * time.Second)
+	env.s.dispatchQueue()
+	if built := strings.Join(env.clBuilt(), " "); built != "1/1 2/1" {
+		t.Errorf("unexpected builds after retrying: %s", built)
+	}
+}
+
+func TestQueueLoadsInFlightBuilds(t *testing.T) {
+	env := newQueueTestEnv(t, `, "maxInFlight": 1`)
+
+	// A build triggered before the daemon was (re)started is still
+	// running.
+	err := env.s.appendRecord(&record{Build: 41, State: "running", Branch: "cl/1", ChangeId: "1", Patchset: "1"})
+	if err != nil {
+		t.Fatalf("failed to record build: %s", err)
+	}
+
+	if err := env.s.loadQueue(); err != nil {
+		t.Fatalf("failed to load queue: %s", err)
+	}
+
+	if err := env.s.PatchsetCreated(uploadBy("2", "1", `"Jane <jane@tvl.su>"`)); err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	env.s.dispatchQueue()
+	if n := len(env.buildkite.createdBuilds()); n != 0 {
+		t.Fatalf("expected no builds while limit is reached, got %d", n)
+	}
+
+	env.finishBuild(t, 41)
+	env.s.dispatchQueue()
+	if n := len(env.buildkite.createdBuilds()); n != 1 {
+		t.Errorf("expected 1 build, got %d", n)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	env := newQueueTestEnv(t, `, "maxInFlight": 1`)
+
+	for _, args := range [][]string{
+		uploadBy("1", "1", `"Jane <jane@tvl.su>"`),
+		uploadBy("2", "1", `"Sam <sam@tvl.su>"`),
+		uploadBy("2", "2", `"Sam <sam@tvl.su>"`),
+	} {
+		if err := env.s.PatchsetCreated(args); err != nil {
+			t.Fatalf("PatchsetCreated failed: %s", err)
+		}
+	}
+
+	env.s.dispatchQueue()
+
+	// The daemon restarts with an empty queue, and restores it from
+	// the records.
+	env.s.queue = newTriggerQueue()
+	if err := env.s.loadQueue(); err != nil {
+		t.Fatalf("failed to load queue: %s", err)
+	}
+
+	env.s.dispatchQueue()
+	if built := strings.Join(env.clBuilt(), " "); built != "1/1" {
+		t.Fatalf("expected no builds while limit is reached, got %s", built)
+	}
+
+	env.finishBuild(t, 1)
+	env.s.dispatchQueue()
+	if built := strings.Join(env.clBuilt(), " "); built != "1/1 2/2" {
+		t.Errorf("unexpected builds after restart: %s", built)
+	}
+
+	// Queue records are not shown as builds.
+	builds, err := env.s.loadBuilds()
+	if err != nil {
+		t.Fatalf("failed to load builds: %s", err)
+	}
+
+	for _, b := range builds {
+		if b.Build == 0 {
+			t.Errorf("queue record loaded as build: %+v", b)
+		}
+	}
+}
+
+func TestQueueUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	env := newTestEnv(t, `{"queue": {"url": "`+server.URL+`", "token": "queue-token"}}`)
+
+	if err := env.s.PatchsetCreated(patchsetCreatedArgs()); err != nil {
+		t.Fatalf("PatchsetCreated failed: %s", err)
+	}
+
+	if n := len(env.buildkite.createdBuilds()); n != 1 {
+		t.Errorf("expected build to be triggered directly, got %d builds", n)
+	}
+
+	if !env.log.contains("failed to queue build, triggering it directly") {
+		t.Errorf("expected queue failure to be logged, got %v", env.log.msgs)
+	}
+}
+
+func TestQueueAuthentication(t *testing.T) {
+	env := newQueueTestEnv(t, "")
+
+	for token, want := range map[string]int{
+		"":                   http.StatusUnauthorized,
+		"Bearer wrong":       http.StatusUnauthorized,
+		"Bearer queue-token": http.StatusAccepted,
+	} {
+		req := httptest.NewRequest("POST", "/triggers", strings.NewReader(`{"ref": "refs/heads/canon", "commit": "f00"}`))
+		req.Header.Set("Authorization", token)
+
+		w := httptest.NewRecorder()
+		env.s.Handler().ServeHTTP(w, req)
+
+		if w.Code != want {
+			t.Errorf("expected status %d for %q, got %d", want, token, w.Code)
+		}
+	}
+
+	// Without a token the daemon does not accept triggers at all.
+	env = newDaemonTestEnv(t)
+	if w := env.request("POST", "/triggers", "", `{}`); w.Code != http.StatusNotFound && w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected queue to be disabled, got %d", w.Code)
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements besadii's build records, which are used to
+// display build status to users without access to Buildkite.
+
+package ci
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// record is a single entry in besadii's build log. Records are
+// appended by the Gerrit hooks when builds are triggered, and by the
+// daemon when Buildkite reports a change in build state.
+//
+// Fields that are unknown at the time a record is written are left
+// empty, and filled in from other records of the same build.
+type record struct {
+	Time     time.Time `json:"time"`
+	Build    int       `json:"build"`
+	Url      string    `json:"url,omitempty"`
+	State    string    `json:"state"`
+	Branch   string    `json:"branch,omitempty"`
+	Commit   string    `json:"commit,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	Username string    `json:"username,omitempty"`
+	ChangeId string    `json:"changeId,omitempty"`
+	Patchset string    `json:"patchset,omitempty"`
+
+	// Records of the daemon's trigger queue are not about a build, but
+	// about a trigger that was queued, or removed from the queue when
+	// its build was triggered. They are used to restore the queue when
+	// the daemon restarts.
+	Queued   *queuedTrigger `json:"queued,omitempty"`
+	Dequeued *queuedTrigger `json:"dequeued,omitempty"`
+}
+
+// isQueueRecord returns true if the record is about the trigger queue
+// instead of a build.
+func (r *record) isQueueRecord() bool {
+	return r.Queued != nil || r.Dequeued != nil
+}
+
+// branchName returns the name of a branch without its "refs/heads/"
+// prefix. Builds of branches are recorded under this name, although
+// Buildkite reports them under the full ref.
+func branchName(ref string) string {
+	return strings.TrimPrefix(ref, "refs/heads/")
+}
+
+// buildStatus is the current state of a single build, assembled from
+// all records about it.
+type buildStatus struct {
+	record
+
+	// Time at which the build was first seen.
+	Started time.Time
+}
+
+// stateRank orders Buildkite build states by how far along a build
+// is, which is used to discard records that arrive out of order.
+func stateRank(state string) int {
+	switch state {
+	case "scheduled":
+		return 0
+	case "running", "blocked":
+		return 1
+	case "canceling", "failing":
+		return 2
+	case "passed", "failed", "canceled", "skipped", "not_run":
+		return 3
+	}
+
+	return 0
+}
+
+// Finished returns true if the build is in a terminal state.
+func (b *buildStatus) Finished() bool {
+	return stateRank(b.State) == 3
+}
+
+// lockRecords opens the records file and locks it exclusively. The
+// daemon replaces the file when it compacts it, so the lock is only
+// returned once it is held on the current file.
+func lockRecords(path string, flag int) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, flag|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open records file: %w", err)
+		}
+
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock records file: %w", err)
+		}
+
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to stat records file: %w", err)
+		}
+
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+
+		// Closing the file also releases the lock.
+		f.Close()
+	}
+}
+
+// appendRecord adds a record to the configured records file. If no
+// records file is configured, nothing is recorded.
+//
+// Records are appended by independent hook processes, so the file is
+// locked while writing.
+func (s *Service) appendRecord(rec *record) error {
+	cfg := s.cfg
+	if cfg.RecordsPath == "" {
+		return nil
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = s.now().UTC()
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	f, err := lockRecords(cfg.RecordsPath, os.O_APPEND|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	return nil
+}
+
+// readRecordsFrom calls a function with each complete record in a
+// records file after the given offset, in the order in which they were
+// written, and returns the offset after the last complete record.
+func readRecordsFrom(file io.ReadSeeker, offset int64, f func(rec *record)) (int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, fmt.Errorf("failed to seek in records file: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A record without a newline is still being written, and
+			// is read again next time.
+			return offset, nil
+		} else if err != nil {
+			return offset, fmt.Errorf("failed to read records file: %w", err)
+		}
+
+		offset += int64(len(line))
+
+		var rec record
+		if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			// Partially written records are skipped, they should not
+			// make the whole dashboard unavailable.
+			continue
+		}
+
+		f(&rec)
+	}
+}
+
+// readRecords calls a function with each record in the records file,
+// in the order in which they were written.
+func readRecords(cfg *Config, f func(rec *record)) error {
+	file, err := os.Open(cfg.RecordsPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open records file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = readRecordsFrom(file, 0, f)
+	return err
+}
+
+// addRecord merges a build record into the status of its build.
+func addRecord(builds map[int]*buildStatus, rec *record) {
+	if rec.isQueueRecord() {
+		return
+	}
+
+	b, ok := builds[rec.Build]
+	if !ok {
+		builds[rec.Build] = &buildStatus{record: *rec, Started: rec.Time}
+		return
+	}
+
+	mergeRecord(b, rec)
+}
+
+// expired returns true if a build has not been updated within the
+// retention period of the records. A zero retention keeps all builds.
+func expired(cfg *Config, b *buildStatus, now time.Time) bool {
+	return cfg.recordsRetention > 0 && now.Sub(b.Time) > cfg.recordsRetention
+}
+
+// buildCache holds the status of builds parsed from the records file,
+// so that the daemon only reads the records appended since it last
+// looked at the file.
+type buildCache struct {
+	mu     sync.Mutex
+	file   os.FileInfo
+	offset int64
+	builds map[int]*buildStatus
+}
+
+// update reads the records appended to the records file since the
+// last update. The file is read from the start if it was replaced.
+func (c *buildCache) update(cfg *Config, now time.Time) error {
+	file, err := os.Open(cfg.RecordsPath)
+	if os.IsNotExist(err) {
+		c.file, c.builds = nil, nil
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open records file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat records file: %w", err)
+	}
+
+	if c.file == nil || !os.SameFile(c.file, info) || info.Size() < c.offset {
+		c.file, c.offset, c.builds = info, 0, make(map[int]*buildStatus)
+	}
+
+	c.offset, err = readRecordsFrom(file, c.offset, func(rec *record) {
+		addRecord(c.builds, rec)
+	})
+	if err != nil {
+		return err
+	}
+
+	for number, b := range c.builds {
+		if expired(cfg, b, now) {
+			delete(c.builds, number)
+		}
+	}
+
+	return nil
+}
+
+// loadBuilds returns the current status of each recorded build within
+// the retention period, ordered from newest to oldest.
+func (s *Service) loadBuilds() ([]*buildStatus, error) {
+	c := &s.records
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.update(s.cfg, s.now()); err != nil {
+		return nil, err
+	}
+
+	// Callers get copies, as the cached builds change with every
+	// update.
+	all := make([]*buildStatus, 0, len(c.builds))
+	for _, b := range c.builds {
+		copied := *b
+		all = append(all, &copied)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Build > all[j].Build
+	})
+
+	return all, nil
+}
+
+// compactRecords rewrites the records file, dropping the records of
+// builds that expired and of triggers that are no longer queued.
+//
+// The new file replaces the old one while it is locked, and writers
+// waiting for the lock move on to the new file (see lockRecords).
+func (s *Service) compactRecords() error {
+	cfg := s.cfg
+	f, err := lockRecords(cfg.RecordsPath, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records := []*record{}
+	builds := make(map[int]*buildStatus)
+	queue := newTriggerQueue()
+
+	_, err = readRecordsFrom(f, 0, func(rec *record) {
+		switch {
+		case rec.Queued != nil:
+			queue.add(rec.Queued.trigger())
+		case rec.Dequeued != nil:
+			queue.remove(rec.Dequeued.Ref, rec.Dequeued.Commit)
+		default:
+			records = append(records, rec)
+			addRecord(builds, rec)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if !expired(cfg, builds[rec.Build], now) {
+			enc.Encode(rec)
+		}
+	}
+
+	// Triggers that are still queued are recorded again, in the order
+	// in which they are built.
+	for _, t := range queue.pending {
+		enc.Encode(&record{Time: now.UTC(), Queued: queuedFromTrigger(t)})
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.RecordsPath), ".records-*")
+	if err != nil {
+		return fmt.Errorf("failed to create compacted records file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(buf.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write compacted records file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write compacted records file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), cfg.RecordsPath); err != nil {
+		return fmt.Errorf("failed to replace records file: %w", err)
+	}
+
+	return nil
+}
+
+// runCompaction compacts the records file periodically.
+func (s *Service) runCompaction() {
+	for {
+		if err := s.compactRecords(); err != nil {
+			s.log.Err(fmt.Sprintf("failed to compact records: %s", err))
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// mergeRecord updates a build's status with a newer record. Fields
+// other than the state are only filled in if they were previously
+// unknown.
+func mergeRecord(b *buildStatus, rec *record) {
+	// Webhooks and hook records can arrive out of order, but a build
+	// never goes back to an earlier state.
+	if stateRank(rec.State) >= stateRank(b.State) {
+		b.State = rec.State
+	}
+
+	b.Time = rec.Time
+
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+
+	fill(&b.Url, rec.Url)
+	fill(&b.Branch, rec.Branch)
+	fill(&b.Commit, rec.Commit)
+	fill(&b.Author, rec.Author)
+	fill(&b.Email, rec.Email)
+	fill(&b.Username, rec.Username)
+	fill(&b.ChangeId, rec.ChangeId)
+	fill(&b.Patchset, rec.Patchset)
+}
@@ -0,0 +1,206 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements rules for selecting Buildkite build settings,
+// such as agent queues and priorities, based on properties of the
+// build trigger.
+
+package ci
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Environment variable passed to Buildkite builds to select the agent
+// queue. The pipeline definition passes it to mkPipeline of
+// //nix/buildkite, which uses it in the agent configuration of steps.
+const queueEnv = "BESADII_AGENT_QUEUE"
+
+// buildRule selects build settings for triggers matching all of its
+// conditions. Conditions that are not set always match.
+//
+// Conditions on hashtags and paths only match builds of CLs.
+type buildRule struct {
+	// Gerrit project of the change.
+	Project string `json:"project"`
+
+	// Domains of the author's email address, e.g. "tvl.su".
+	EmailDomains []string `json:"emailDomains"`
+
+	// Exact email addresses of authors, e.g. for automation accounts.
+	Emails []string `json:"emails"`
+
+	// Hashtags of the change, matching if any of them is set.
+	Hashtags []string `json:"hashtags"`
+
+	// Path prefixes, matching if any file touched by the change is
+	// inside of one of them.
+	Paths []string `json:"paths"`
+
+	// Settings applied to matching builds. Settings of later rules
+	// override those of earlier ones.
+	MetaData      map[string]string `json:"metaData"`
+	Priority      *int              `json:"priority"`
+	CleanCheckout *bool             `json:"cleanCheckout"`
+	Queue         string            `json:"queue"`
+}
+
+// changeDetails contains information about a change that is fetched
+// from Gerrit on demand, as only some rules need it.
+type changeDetails struct {
+	gerrit  *gerritClient
+	trigger *buildTrigger
+
+	fetched  bool
+	hashtags []string
+	files    []string
+}
+
+func (d *changeDetails) fetch() error {
+	if d.fetched {
+		return nil
+	}
+	d.fetched = true
+
+	err := d.gerrit.get(fmt.Sprintf("changes/%s/hashtags", d.trigger.changeId), &d.hashtags)
+	if err != nil {
+		return fmt.Errorf("failed to fetch hashtags of change %s: %w", d.trigger.changeId, err)
+	}
+
+	d.files, err = d.gerrit.fetchChangeFiles(d.trigger.changeId, d.trigger.patchset)
+	return err
+}
+
+// matches returns true if the rule matches a trigger.
+func (r *buildRule) matches(trigger *buildTrigger, details *changeDetails) (bool, error) {
+	if r.Project != "" && r.Project != trigger.project {
+		return false, nil
+	}
+
+	email := strings.ToLower(trigger.email)
+	if len(r.Emails) > 0 && !containsFold(r.Emails, email) {
+		return false, nil
+	}
+
+	if len(r.EmailDomains) > 0 {
+		_, domain, _ := strings.Cut(email, "@")
+		if !containsFold(r.EmailDomains, domain) {
+			return false, nil
+		}
+	}
+
+	if len(r.Hashtags) == 0 && len(r.Paths) == 0 {
+		return true, nil
+	}
+
+	if trigger.changeId == "" {
+		return false, nil
+	}
+
+	if err := details.fetch(); err != nil {
+		return false, err
+	}
+
+	if len(r.Hashtags) > 0 && !anyContained(r.Hashtags, details.hashtags) {
+		return false, nil
+	}
+
+	if len(r.Paths) > 0 && !touchesPaths(r.Paths, details.files) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// containsFold returns true if the list contains the string, ignoring
+// case.
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// anyContained returns true if any element of 'want' is in 'have'.
+func anyContained(want, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// touchesPaths returns true if any file is inside of one of the path
+// prefixes.
+func touchesPaths(prefixes, files []string) bool {
+	for _, prefix := range prefixes {
+		prefix = strings.Trim(prefix, "/")
+		for _, file := range files {
+			if file == prefix || strings.HasPrefix(file, prefix+"/") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// applyBuildRules applies all matching build rules to a build. Rules
+// that can not be evaluated (e.g. because Gerrit is unavailable) are
+// skipped, as the build should still happen.
+func (s *Service) applyBuildRules(trigger *buildTrigger, build *Build) {
+	details := changeDetails{gerrit: s.gerrit, trigger: trigger}
+	priority := trigger.priority
+
+	for i := range s.cfg.BuildRules {
+		rule := &s.cfg.BuildRules[i]
+
+		match, err := rule.matches(trigger, &details)
+		if err != nil {
+			s.log.Err(fmt.Sprintf("failed to evaluate build rule %d: %s", i, err))
+			continue
+		}
+
+		if !match {
+			continue
+		}
+
+		for k, v := range rule.MetaData {
+			if build.MetaData == nil {
+				build.MetaData = make(map[string]string)
+			}
+			build.MetaData[k] = v
+		}
+
+		if rule.Priority != nil {
+			priority = rule.Priority
+		}
+
+		if rule.CleanCheckout != nil {
+			build.CleanCheckout = *rule.CleanCheckout
+		}
+
+		if rule.Queue != "" {
+			build.Env[queueEnv] = rule.Queue
+		}
+	}
+
+	// Work-in-progress builds must not be raised above their policy's
+	// priority by rules.
+	if priority != nil && trigger.priority != nil && *trigger.priority < *priority {
+		priority = trigger.priority
+	}
+
+	if priority != nil {
+		build.Env[priorityEnv] = strconv.Itoa(*priority)
+	}
+}
@@ -0,0 +1,581 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements test reports, which summarise the JUnit XML or
+// 'go test -json' output uploaded as artifacts of a build on Buildkite
+// and on the CL, and optionally upload it to Buildkite Test Engine.
+
+package ci
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Maximum number of failed tests listed in a report.
+const maxFailedTests = 20
+
+// Context of the Buildkite annotation containing the test report,
+// which is replaced when the report is created again.
+const testAnnotationContext = "besadii-tests"
+
+// testReportConfig configures the test reports created by the
+// post-command hook.
+type testReportConfig struct {
+	// Patterns (as understood by path.Match) of the build artifacts
+	// containing JUnit XML or 'go test -json' output. Test reports are
+	// disabled if unset.
+	Artifacts []string `json:"artifacts"`
+
+	// How the report is added to the Buildkite build: "agent" runs
+	// 'buildkite-agent annotate', "api" uses the REST API and "none"
+	// disables annotations. Defaults to "agent".
+	Annotate string `json:"annotate"`
+
+	// Path of the Buildkite agent binary. Defaults to finding
+	// 'buildkite-agent' in $PATH.
+	AgentCommand string `json:"agentCommand"`
+
+	// API token of a Buildkite Test Engine (formerly Test Analytics)
+	// suite to which test reports are uploaded, and the URL of the
+	// upload API. Reports are not uploaded if no token is set.
+	AnalyticsToken string `json:"analyticsToken"`
+	AnalyticsUrl   string `json:"analyticsUrl"`
+}
+
+// validateTestReports fills in defaults of the test report
+// configuration and checks it for errors.
+func validateTestReports(cfg *testReportConfig) error {
+	for _, pattern := range cfg.Artifacts {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid test report artifact pattern %q", pattern)
+		}
+	}
+
+	switch cfg.Annotate {
+	case "":
+		cfg.Annotate = "agent"
+	case "agent", "api", "none":
+	default:
+		return fmt.Errorf("unknown test report 'annotate' method %q", cfg.Annotate)
+	}
+
+	if cfg.AgentCommand == "" {
+		cfg.AgentCommand = "buildkite-agent"
+	}
+
+	if cfg.AnalyticsUrl == "" {
+		cfg.AnalyticsUrl = "https://analytics-api.buildkite.com/v1/uploads"
+	}
+
+	return nil
+}
+
+// testSummary counts the results of all tests in a build. Failures
+// are counted by failedTests.
+type testSummary struct {
+	Passed   int
+	Skipped  int
+	Failures []string
+}
+
+func (t *testSummary) add(name, result string) {
+	switch result {
+	case "passed":
+		t.Passed++
+	case "failed":
+		t.Failures = append(t.Failures, name)
+	case "skipped":
+		t.Skipped++
+	}
+}
+
+// failedTests returns the names of failed tests, omitting tests whose
+// failure is only caused by failed subtests.
+func (t *testSummary) failedTests() []string {
+	failures := []string{}
+	for _, name := range t.Failures {
+		parent := false
+		for _, other := range t.Failures {
+			if strings.HasPrefix(other, name+"/") {
+				parent = true
+				break
+			}
+		}
+
+		if !parent {
+			failures = append(failures, name)
+		}
+	}
+
+	sort.Strings(failures)
+	return failures
+}
+
+// counts formats the number of tests with each result. Tests that
+// only failed because of failed subtests are not counted.
+func (t *testSummary) counts() string {
+	return fmt.Sprintf("%d failed, %d passed, %d skipped", len(t.failedTests()), t.Passed, t.Skipped)
+}
+
+// junitTestSuite is the subset of the JUnit XML format used by
+// besadii. Test suites may be nested, and the root element may be
+// either <testsuites> or <testsuite>.
+type junitTestSuite struct {
+	TestSuites []junitTestSuite `xml:"testsuite"`
+	TestCases  []struct {
+		Name      string    `xml:"name,attr"`
+		Classname string    `xml:"classname,attr"`
+		Failure   *struct{} `xml:"failure"`
+		Error     *struct{} `xml:"error"`
+		Skipped   *struct{} `xml:"skipped"`
+	} `xml:"testcase"`
+}
+
+func (s *junitTestSuite) summarise(summary *testSummary) {
+	for _, suite := range s.TestSuites {
+		suite.summarise(summary)
+	}
+
+	for _, tc := range s.TestCases {
+		name := tc.Name
+		if tc.Classname != "" {
+			name = tc.Classname + "." + tc.Name
+		}
+
+		switch {
+		case tc.Failure != nil || tc.Error != nil:
+			summary.add(name, "failed")
+		case tc.Skipped != nil:
+			summary.add(name, "skipped")
+		default:
+			summary.add(name, "passed")
+		}
+	}
+}
+
+// parseJUnit adds the results of a JUnit XML report to the summary.
+func parseJUnit(data []byte, summary *testSummary) error {
+	var suite junitTestSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		return fmt.Errorf("invalid JUnit XML: %w", err)
+	}
+
+	suite.summarise(summary)
+	return nil
+}
+
+// goTestEvent is an event emitted by 'go test -json', as described in
+// 'go doc test2json'.
+type goTestEvent struct {
+	Action  string
+	Package string
+	Test    string
+}
+
+// goTestResult is the result of a test (or of a package without a
+// failing test) in 'go test -json' output.
+type goTestResult struct {
+	Package string
+	Test    string
+	Result  string
+}
+
+// name returns the name of the test as shown in reports.
+func (r *goTestResult) name() string {
+	if r.Test == "" {
+		return r.Package
+	}
+
+	return r.Package + "." + r.Test
+}
+
+// goTestResults reads the results of tests from 'go test -json'
+// output. Packages that fail without a failing test (e.g. because they
+// do not compile) are reported as failures of the package.
+func goTestResults(data []byte) ([]goTestResult, error) {
+	var packageFailures []goTestResult
+	results := make(map[string]*goTestResult)
+	var order []string
+	failedTests := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+
+		// Output of the go command itself may be interleaved.
+		if !bytes.HasPrefix(line, []byte("{")) {
+			continue
+		}
+
+		var event goTestEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("invalid 'go test -json' event: %w", err)
+		}
+
+		var result string
+		switch event.Action {
+		case "pass":
+			result = "passed"
+		case "fail":
+			result = "failed"
+		case "skip":
+			result = "skipped"
+		default:
+			continue
+		}
+
+		if event.Test == "" {
+			// Package results only matter if no test explains them.
+			if result == "failed" && !failedTests[event.Package] {
+				packageFailures = append(packageFailures, goTestResult{Package: event.Package, Result: result})
+			}
+			continue
+		}
+
+		r := goTestResult{Package: event.Package, Test: event.Test, Result: result}
+		if _, ok := results[r.name()]; !ok {
+			order = append(order, r.name())
+		}
+		results[r.name()] = &r
+
+		if result == "failed" {
+			failedTests[event.Package] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read 'go test -json' output: %w", err)
+	}
+
+	all := packageFailures
+	for _, name := range order {
+		all = append(all, *results[name])
+	}
+
+	return all, nil
+}
+
+// parseGoTest adds the results of 'go test -json' output to the
+// summary.
+func parseGoTest(data []byte, summary *testSummary) error {
+	results, err := goTestResults(data)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		summary.add(r.name(), r.Result)
+	}
+
+	return nil
+}
+
+// isJUnit returns true if a test report is in the JUnit XML format,
+// and not 'go test -json' output.
+func isJUnit(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("<"))
+}
+
+// parseTestReport adds the results of a test report in either format
+// to the summary.
+func parseTestReport(data []byte, summary *testSummary) error {
+	if isJUnit(data) {
+		return parseJUnit(data, summary)
+	}
+
+	return parseGoTest(data, summary)
+}
+
+// matchesAny returns true if the artifact path matches one of the
+// patterns.
+func matchesAny(patterns []string, artifactPath string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, artifactPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// testReport is a test report uploaded as an artifact of a build.
+type testReport struct {
+	path string
+	data []byte
+}
+
+// collectTestResults summarises the test reports uploaded as artifacts
+// of a build, and returns the reports. It returns a nil summary if the
+// build has no test reports.
+func (s *Service) collectTestResults(buildNumber string) (*testSummary, []testReport, error) {
+	if buildNumber == "" {
+		return nil, nil, fmt.Errorf("build number is unknown")
+	}
+
+	artifacts, err := s.buildkite.listArtifacts(buildNumber)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list artifacts of build %s: %w", buildNumber, err)
+	}
+
+	var summary *testSummary
+	var reports []testReport
+	for _, a := range artifacts {
+		if a.State != "finished" || !matchesAny(s.cfg.TestReports.Artifacts, a.Path) {
+			continue
+		}
+
+		data, err := s.buildkite.get(a.DownloadUrl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download test report %s: %w", a.Path, err)
+		}
+
+		if summary == nil {
+			summary = &testSummary{}
+		}
+
+		if err := parseTestReport(data, summary); err != nil {
+			return nil, nil, fmt.Errorf("test report %s: %w", a.Path, err)
+		}
+
+		reports = append(reports, testReport{path: a.Path, data: data})
+	}
+
+	return summary, reports, nil
+}
+
+// formatTestSummary formats test results for inclusion in a Gerrit
+// message.
+func formatTestSummary(summary *testSummary) string {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "\n\nTests: %s\n", summary.counts())
+
+	failures := summary.failedTests()
+	if len(failures) == 0 {
+		return msg.String()
+	}
+
+	msg.WriteString("\nFailed tests:\n\n")
+	for i, name := range failures {
+		if i == maxFailedTests {
+			fmt.Fprintf(&msg, "\n... and %d more\n", len(failures)-maxFailedTests)
+			break
+		}
+		fmt.Fprintf(&msg, "* %s\n", name)
+	}
+
+	return msg.String()
+}
+
+// testAnnotation creates the Buildkite annotation for test results,
+// formatted as Markdown.
+func testAnnotation(summary *testSummary) *buildkiteAnnotation {
+	annotation := &buildkiteAnnotation{
+		Style:   "success",
+		Context: testAnnotationContext,
+	}
+
+	var body strings.Builder
+	failures := summary.failedTests()
+	if len(failures) == 0 {
+		fmt.Fprintf(&body, "**Tests passed** (%s)\n", summary.counts())
+	} else {
+		annotation.Style = "error"
+		fmt.Fprintf(&body, "**Tests failed** (%s)\n\n", summary.counts())
+
+		for i, name := range failures {
+			if i == maxFailedTests {
+				fmt.Fprintf(&body, "\n... and %d more\n", len(failures)-maxFailedTests)
+				break
+			}
+			fmt.Fprintf(&body, "* `%s`\n", name)
+		}
+	}
+
+	annotation.Body = body.String()
+	return annotation
+}
+
+// annotateBuild adds an annotation to a build with the configured
+// method.
+func (s *Service) annotateBuild(buildNumber string, annotation *buildkiteAnnotation) error {
+	switch s.cfg.TestReports.Annotate {
+	case "agent":
+		// The agent annotates the build of the job it is running.
+		var stderr bytes.Buffer
+		cmd := exec.Command(s.cfg.TestReports.AgentCommand, "annotate", "--style", annotation.Style, "--context", annotation.Context)
+		cmd.Stdin = strings.NewReader(annotation.Body)
+		cmd.Stderr = &stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("'buildkite-agent annotate' failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+		}
+
+	case "api":
+		_, err := s.buildkite.do("POST", "/builds/"+buildNumber+"/annotations", annotation, http.StatusCreated)
+		if err != nil {
+			return fmt.Errorf("failed to annotate build %s: %w", buildNumber, err)
+		}
+	}
+
+	return nil
+}
+
+// reportTests summarises the test reports of the build running the
+// post-command hook, and annotates the build with the results. Errors
+// are printed, as they must not prevent reporting the build result. It
+// returns nil if there are no test results.
+func (s *Service) reportTests(getenv func(string) string) *testSummary {
+	if len(s.cfg.TestReports.Artifacts) == 0 {
+		return nil
+	}
+
+	buildNumber := getenv("BUILDKITE_BUILD_NUMBER")
+	summary, reports, err := s.collectTestResults(buildNumber)
+	if err != nil {
+		fmt.Fprintf(s.out, "failed to summarise test reports: %s\n", err)
+		return nil
+	}
+
+	if summary == nil {
+		fmt.Fprintf(s.out, "no test reports found\n")
+		return nil
+	}
+
+	if err := s.annotateBuild(buildNumber, testAnnotation(summary)); err != nil {
+		fmt.Fprintf(s.out, "failed to annotate build with test results: %s\n", err)
+	}
+
+	if s.cfg.TestReports.AnalyticsToken != "" {
+		for _, report := range reports {
+			if err := s.uploadTestReport(getenv, &report); err != nil {
+				fmt.Fprintf(s.out, "failed to upload test report %s: %s\n", report.path, err)
+			}
+		}
+	}
+
+	return summary
+}
+
+// junitSuiteOutput is the JUnit XML format into which 'go test -json'
+// output is converted for Test Engine.
+type junitSuiteOutput struct {
+	XMLName   xml.Name `xml:"testsuite"`
+	Name      string   `xml:"name,attr"`
+	TestCases []junitCaseOutput
+}
+
+type junitCaseOutput struct {
+	XMLName   xml.Name  `xml:"testcase"`
+	Name      string    `xml:"name,attr"`
+	Classname string    `xml:"classname,attr,omitempty"`
+	Failure   *struct{} `xml:"failure"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+// goTestJUnit converts 'go test -json' output to JUnit XML.
+func goTestJUnit(name string, data []byte) ([]byte, error) {
+	results, err := goTestResults(data)
+	if err != nil {
+		return nil, err
+	}
+
+	report := junitSuiteOutput{Name: name}
+	for _, r := range results {
+		tc := junitCaseOutput{Name: r.name()}
+		if r.Test != "" {
+			tc.Name = r.Test
+			tc.Classname = r.Package
+		}
+
+		switch r.Result {
+		case "failed":
+			tc.Failure = &struct{}{}
+		case "skipped":
+			tc.Skipped = &struct{}{}
+		}
+
+		report.TestCases = append(report.TestCases, tc)
+	}
+
+	out, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), out...), nil
+}
+
+// uploadTestReport uploads a test report to the configured Buildkite
+// Test Engine suite, as JUnit XML.
+//
+// https://buildkite.com/docs/test-engine/importing-junit-xml
+func (s *Service) uploadTestReport(getenv func(string) string, report *testReport) error {
+	data := report.data
+	if !isJUnit(data) {
+		var err error
+		data, err = goTestJUnit(report.path, data)
+		if err != nil {
+			return fmt.Errorf("failed to convert to JUnit XML: %w", err)
+		}
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("format", "junit")
+
+	// The run environment identifies the build in Test Engine.
+	form.WriteField("run_env[CI]", "buildkite")
+	for field, env := range map[string]string{
+		"key":        "BUILDKITE_BUILD_ID",
+		"url":        "BUILDKITE_BUILD_URL",
+		"branch":     "BUILDKITE_BRANCH",
+		"commit_sha": "BUILDKITE_COMMIT",
+		"number":     "BUILDKITE_BUILD_NUMBER",
+		"job_id":     "BUILDKITE_JOB_ID",
+		"message":    "BUILDKITE_MESSAGE",
+	} {
+		form.WriteField("run_env["+field+"]", getenv(env))
+	}
+
+	file, err := form.CreateFormFile("data", path.Base(report.path))
+	if err != nil {
+		return err
+	}
+	file.Write(data)
+
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.cfg.TestReports.AnalyticsUrl, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create an HTTP request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Token token=%q", s.cfg.TestReports.AnalyticsToken))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := s.buildkite.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("received non-success response: %s (%v)", strings.TrimSpace(string(respBody)), resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const junitReport = `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="magrathea">
+    <testcase classname="magrathea" name="test_init"/>
+    <testcase classname="magrathea" name="test_build">
+      <failure message="assertion failed">expected 0, got 1</failure>
+    </testcase>
+    <testcase classname="magrathea" name="test_shell"><skipped/></testcase>
+  </testsuite>
+</testsuites>`
+
+const goTestReport = `{"Action":"start","Package":"code.tvl.fyi/ops/besadii/ci"}
+{"Action":"run","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestQueue"}
+{"Action":"run","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestQueue/limits"}
+{"Action":"output","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestQueue/limits","Output":"--- FAIL: TestQueue/limits\n"}
+{"Action":"fail","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestQueue/limits"}
+{"Action":"fail","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestQueue"}
+{"Action":"pass","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestConfig"}
+{"Action":"fail","Package":"code.tvl.fyi/ops/besadii/ci"}
+FAIL	code.tvl.fyi/ops/besadii/broken [build failed]
+{"Action":"fail","Package":"code.tvl.fyi/ops/besadii/broken"}
+`
+
+// newTestReportEnv creates a test environment for the post-command hook
+// in build 1, which has uploaded test reports.
+func newTestReportEnv(t *testing.T, annotate string) (*testEnv, *fakeBuild) {
+	env := newTestEnv(t, `{"testReports": {"artifacts": ["tests/*.xml", "tests/*.json"], "annotate": "`+annotate+`"}}`)
+
+	fb := env.buildkite.add(Build{Commit: "f00", Branch: "cl/1234"}, "running")
+	fb.artifacts["tests/magrathea.xml"] = junitReport
+	fb.artifacts["tests/besadii.json"] = goTestReport
+	fb.artifacts["pipeline/drvmap.json"] = testDrvmap
+
+	// The test reports are not on the first page of artifacts.
+	for i := 0; i < 120; i++ {
+		fb.artifacts[fmt.Sprintf("logs/%03d.txt", i)] = "log"
+	}
+
+	return env, fb
+}
+
+func TestPostCommandTestReports(t *testing.T) {
+	env, fb := newTestReportEnv(t, "api")
+
+	if err := env.s.PostCommand(postCommandEnv(map[string]string{"BUILDKITE_COMMAND_EXIT_STATUS": "1"})); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 {
+		t.Fatalf("expected 1 review, got %d", len(reviews))
+	}
+
+	msg := reviews[0].review.Message
+	for _, want := range []string{
+		// Parents of failed subtests are not counted as failures.
+		"Tests: 3 failed, 2 passed, 1 skipped",
+		"* code.tvl.fyi/ops/besadii/broken\n",
+		"* code.tvl.fyi/ops/besadii/ci.TestQueue/limits\n",
+		"* magrathea.test_build\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected message to contain %q, got:\n%s", want, msg)
+		}
+	}
+
+	// Parents of failed subtests are not listed separately.
+	if strings.Contains(msg, "TestQueue\n") {
+		t.Errorf("expected parent test to be omitted, got:\n%s", msg)
+	}
+
+	if len(fb.annotations) != 1 {
+		t.Fatalf("expected 1 annotation, got %d", len(fb.annotations))
+	}
+
+	annotation := fb.annotations[0]
+	if annotation.Style != "error" || annotation.Context != testAnnotationContext || !strings.Contains(annotation.Body, "* `magrathea.test_build`") {
+		t.Errorf("unexpected annotation: %+v", annotation)
+	}
+}
+
+func TestPostCommandTestReportsBranch(t *testing.T) {
+	env, fb := newTestReportEnv(t, "api")
+	delete(fb.artifacts, "tests/magrathea.xml")
+	fb.artifacts["tests/besadii.json"] = `{"Action":"pass","Package":"code.tvl.fyi/ops/besadii/ci","Test":"TestConfig"}`
+
+	err := env.s.PostCommand(postCommandEnv(map[string]string{"GERRIT_CHANGE_ID": "", "GERRIT_PATCHSET": ""}))
+	if err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	// Builds of branches are annotated, but nothing is posted on Gerrit.
+	if n := len(env.gerrit.postedReviews()); n != 0 {
+		t.Errorf("expected no reviews, got %d", n)
+	}
+
+	if len(fb.annotations) != 1 || fb.annotations[0].Style != "success" {
+		t.Errorf("unexpected annotations: %+v", fb.annotations)
+	}
+}
+
+func TestPostCommandTestReportsError(t *testing.T) {
+	env, fb := newTestReportEnv(t, "none")
+	fb.artifacts["tests/magrathea.xml"] = "<testsuites><testsuite>"
+
+	if err := env.s.PostCommand(postCommandEnv(nil)); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	// Broken reports do not prevent the vote.
+	reviews := env.gerrit.postedReviews()
+	if len(reviews) != 1 || reviews[0].review.Labels["Verified"] != 1 {
+		t.Fatalf("expected vote to be posted, got %+v", reviews)
+	}
+
+	if strings.Contains(reviews[0].review.Message, "Tests:") {
+		t.Errorf("expected no test summary, got:\n%s", reviews[0].review.Message)
+	}
+
+	if !strings.Contains(env.out.String(), "failed to summarise test reports: test report tests/magrathea.xml: invalid JUnit XML") {
+		t.Errorf("expected report error to be printed, got:\n%s", env.out)
+	}
+
+	if len(fb.annotations) != 0 {
+		t.Errorf("expected no annotations, got %+v", fb.annotations)
+	}
+}
+
+func TestPostCommandTestAnalytics(t *testing.T) {
+	type upload struct {
+		auth   string
+		fields map[string]string
+		data   string
+	}
+
+	var uploads []upload
+	analytics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1024 * 1024); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u := upload{auth: r.Header.Get("Authorization"), fields: make(map[string]string)}
+		for field, values := range r.MultipartForm.Value {
+			u.fields[field] = values[0]
+		}
+
+		file, _, err := r.FormFile("data")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		u.data = string(data)
+
+		uploads = append(uploads, u)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(analytics.Close)
+
+	env := newTestEnv(t, `{"testReports": {"artifacts": ["tests/*"], "annotate": "none", "analyticsToken": "suite-token", "analyticsUrl": "`+analytics.URL+`"}}`)
+	fb := env.buildkite.add(Build{Commit: "f00", Branch: "cl/1234"}, "running")
+	fb.artifacts["tests/besadii.json"] = goTestReport
+	fb.artifacts["tests/magrathea.xml"] = junitReport
+
+	if err := env.s.PostCommand(postCommandEnv(map[string]string{"BUILDKITE_BUILD_ID": "build-uuid"})); err != nil {
+		t.Fatalf("PostCommand failed: %s", err)
+	}
+
+	if len(uploads) != 2 {
+		t.Fatalf("expected 2 uploads, got %d (output: %s)", len(uploads), env.out)
+	}
+
+	for _, u := range uploads {
+		if u.auth != `Token token="suite-token"` {
+			t.Errorf("unexpected authorization: %q", u.auth)
+		}
+
+		if u.fields["format"] != "junit" || u.fields["run_env[CI]"] != "buildkite" || u.fields["run_env[key]"] != "build-uuid" || u.fields["run_env[number]"] != "1" {
+			t.Errorf("unexpected upload fields: %v", u.fields)
+		}
+	}
+
+	// Artifacts are listed in order, and 'go test -json' output is
+	// converted to JUnit XML.
+	for _, want := range []string{
+		`<testcase name="code.tvl.fyi/ops/besadii/broken">`,
+		`<testcase name="TestQueue/limits" classname="code.tvl.fyi/ops/besadii/ci">`,
+		`<testcase name="TestConfig" classname="code.tvl.fyi/ops/besadii/ci"></testcase>`,
+	} {
+		if !strings.Contains(uploads[0].data, want) {
+			t.Errorf("expected converted report to contain %q, got:\n%s", want, uploads[0].data)
+		}
+	}
+
+	if uploads[1].data != junitReport {
+		t.Errorf("expected JUnit report to be uploaded unchanged, got:\n%s", uploads[1].data)
+	}
+}
+
+func TestTestReportConfiguration(t *testing.T) {
+	for name, reports := range map[string]string{
+		"invalid pattern": `{"artifacts": ["tests/[.xml"]}`,
+		"unknown method":  `{"artifacts": ["*.xml"], "annotate": "email"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := `{"repository": "depot", "branch": "canon", "testReports": ` + reports + `}`
+			if _, err := ParseConfig([]byte(cfg)); err == nil || !strings.Contains(err.Error(), "test report") {
+				t.Errorf("expected test report configuration error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+//
+// This file implements the HTTP transport settings used for requests
+// to Gerrit, Buildkite and the targets of post-merge actions.
+
+package ci
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// transportConfig configures the HTTP client used for one kind of
+// endpoint. Unset fields are inherited from the 'default' transport
+// configuration.
+type transportConfig struct {
+	// Path to a PEM file of CA certificates used to verify the
+	// server, instead of the system roots.
+	CaBundle string `json:"caBundle"`
+
+	// Paths to a PEM client certificate and key presented to the
+	// server.
+	ClientCert string `json:"clientCert"`
+	ClientKey  string `json:"clientKey"`
+
+	// URL of the proxy to send requests through. Defaults to the
+	// proxy set in the environment (e.g. $HTTPS_PROXY).
+	Proxy string `json:"proxy"`
+
+	// Time limits for establishing a connection and for a complete
+	// request, e.g. "10s".
+	ConnectTimeout string `json:"connectTimeout"`
+	Timeout        string `json:"timeout"`
+
+	// User-Agent header sent with every request.
+	UserAgent string `json:"userAgent"`
+
+	connectTimeout time.Duration
+	timeout        time.Duration
+	proxy          *url.URL
+}
+
+// transportConfigs holds the transport settings of each endpoint.
+type transportConfigs struct {
+	Default   transportConfig `json:"default"`
+	Gerrit    transportConfig `json:"gerrit"`
+	Buildkite transportConfig `json:"buildkite"`
+	Actions   transportConfig `json:"actions"`
+	Queue     transportConfig `json:"queue"`
+}
+
+// inherit fills unset fields of the transport configuration from
+// another configuration.
+func (t *transportConfig) inherit(from *transportConfig) {
+	if t.CaBundle == "" {
+		t.CaBundle = from.CaBundle
+	}
+
+	if t.ClientCert == "" && t.ClientKey == "" {
+		t.ClientCert = from.ClientCert
+		t.ClientKey = from.ClientKey
+	}
+
+	if t.Proxy == "" {
+		t.Proxy = from.Proxy
+	}
+
+	if t.ConnectTimeout == "" {
+		t.ConnectTimeout = from.ConnectTimeout
+	}
+
+	if t.Timeout == "" {
+		t.Timeout = from.Timeout
+	}
+
+	if t.UserAgent == "" {
+		t.UserAgent = from.UserAgent
+	}
+}
+
+// validate parses the settings of a transport configuration.
+func (t *transportConfig) validate() error {
+	var err error
+
+	if (t.ClientCert == "") != (t.ClientKey == "") {
+		return fmt.Errorf("'clientCert' and 'clientKey' must be set together")
+	}
+
+	if t.Proxy != "" {
+		t.proxy, err = url.Parse(t.Proxy)
+		if err != nil || t.proxy.Host == "" {
+			return fmt.Errorf("invalid proxy URL %q", t.Proxy)
+		}
+	}
+
+	t.connectTimeout, err = time.ParseDuration(t.ConnectTimeout)
+	if err != nil || t.connectTimeout <= 0 {
+		return fmt.Errorf("invalid connect timeout %q", t.ConnectTimeout)
+	}
+
+	t.timeout, err = time.ParseDuration(t.Timeout)
+	if err != nil || t.timeout <= 0 {
+		return fmt.Errorf("invalid timeout %q", t.Timeout)
+	}
+
+	return nil
+}
+
+// validateTransports fills in defaults of the transport configuration
+// and checks it for errors.
+func validateTransports(cfg *transportConfigs) error {
+	// Requests time out after 30 seconds, and connections after 10,
+	// unless specified otherwise. Gerrit hooks must never hang
+	// forever.
+	cfg.Default.inherit(&transportConfig{
+		ConnectTimeout: "10s",
+		Timeout:        "30s",
+		UserAgent:      "besadii",
+	})
+
+	for name, t := range map[string]*transportConfig{
+		"gerrit":    &cfg.Gerrit,
+		"buildkite": &cfg.Buildkite,
+		"actions":   &cfg.Actions,
+		"queue":     &cfg.Queue,
+	} {
+		t.inherit(&cfg.Default)
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("invalid %s transport configuration: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// userAgentTransport sets the User-Agent header of all requests.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (u *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", u.userAgent)
+	return u.base.RoundTrip(req)
+}
+
+// newHTTPClient creates an HTTP client from a validated transport
+// configuration.
+func newHTTPClient(t *transportConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if t.CaBundle != "" {
+		pem, err := os.ReadFile(t.CaBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", t.CaBundle)
+		}
+	}
+
+	if t.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if t.proxy != nil {
+		proxy = http.ProxyURL(t.proxy)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{
+		Timeout:   t.connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+
+	return &http.Client{
+		Timeout: t.timeout,
+		Transport: &userAgentTransport{
+			userAgent: t.UserAgent,
+			base:      transport,
+		},
+	}, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+package ci
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePEM writes a PEM block to a file in the test's temporary
+// directory and returns its path.
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write %s: %s", name, err)
+	}
+	return path
+}
+
+// clientCertificate creates a self-signed client certificate and
+// returns the paths of the certificate and key files.
+func clientCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "besadii"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+
+	return writePEM(t, "client.crt", "CERTIFICATE", cert), writePEM(t, "client.key", "PRIVATE KEY", keyDer)
+}
+
+// transportClient validates a transport configuration (inheriting the
+// defaults) and creates a client from it.
+func transportClient(t *testing.T, tc transportConfig) (*http.Client, error) {
+	cfg := transportConfigs{Gerrit: tc}
+	if err := validateTransports(&cfg); err != nil {
+		t.Fatalf("invalid transport configuration: %s", err)
+	}
+	return newHTTPClient(&cfg.Gerrit)
+}
+
+func TestTransportClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) != 1 || r.TLS.PeerCertificates[0].Subject.CommonName != "besadii" {
+			http.Error(w, "unknown client", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(r.UserAgent()))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	caBundle := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	cert, key := clientCertificate(t)
+
+	// Without the CA bundle the server's certificate is not trusted.
+	client, err := transportClient(t, transportConfig{ClientCert: cert, ClientKey: key})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected certificate verification error, got %v", err)
+	}
+
+	client, err = transportClient(t, transportConfig{
+		CaBundle:   caBundle,
+		ClientCert: cert,
+		ClientKey:  key,
+		UserAgent:  "besadii-test/1.0",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(body) != "besadii-test/1.0" {
+		t.Errorf("unexpected response (%d): %s", resp.StatusCode, body)
+	}
+}
+
+func TestTransportProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte(r.UserAgent()))
+	}))
+	defer proxy.Close()
+
+	client, err := transportClient(t, transportConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	resp, err := client.Get("http://buildkite.invalid/v2/builds")
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if len(proxied) != 1 || proxied[0] != "http://buildkite.invalid/v2/builds" {
+		t.Errorf("expected request to go through proxy, got %v", proxied)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "besadii" {
+		t.Errorf("expected default user agent, got %q", body)
+	}
+}
+
+func TestTransportTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client, err := transportClient(t, transportConfig{Timeout: "50ms"})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestTransportConfiguration(t *testing.T) {
+	cfg := transportConfigs{
+		Default:   transportConfig{Proxy: "http://egress:3128", UserAgent: "tvl-ci"},
+		Gerrit:    transportConfig{Timeout: "5s"},
+		Buildkite: transportConfig{Proxy: "http://other:8080"},
+	}
+
+	if err := validateTransports(&cfg); err != nil {
+		t.Fatalf("invalid transport configuration: %s", err)
+	}
+
+	if cfg.Gerrit.timeout != 5*time.Second || cfg.Gerrit.connectTimeout != 10*time.Second || cfg.Gerrit.Proxy != "http://egress:3128" {
+		t.Errorf("unexpected Gerrit transport: %+v", cfg.Gerrit)
+	}
+
+	if cfg.Buildkite.timeout != 30*time.Second || cfg.Buildkite.proxy.Host != "other:8080" || cfg.Buildkite.UserAgent != "tvl-ci" {
+		t.Errorf("unexpected Buildkite transport: %+v", cfg.Buildkite)
+	}
+
+	for name, invalid := range map[string]transportConfig{
+		"cert without key": {ClientCert: "client.crt"},
+		"invalid proxy":    {Proxy: "egress"},
+		"invalid timeout":  {Timeout: "forever"},
+		"negative timeout": {ConnectTimeout: "-1s"},
+	} {
+		cfg := transportConfigs{Actions: invalid}
+		if err := validateTransports(&cfg); err == nil {
+			t.Errorf("%s: expected configuration error", name)
+		}
+	}
+
+	if _, err := transportClient(t, transportConfig{CaBundle: "/does/not/exist.pem"}); err == nil {
+		t.Errorf("expected error for missing CA bundle")
+	}
+}
@@ -1,8 +1,57 @@
 # This program is used as a Gerrit hook to trigger builds on
 # Buildkite, Sourcegraph reindexing and other maintenance tasks.
-{ depot, ... }:
+{ depot, pkgs, ... }:
 
-depot.nix.buildGo.program {
+let
+  inherit (depot.nix.buildGo) go package program;
+
+  # All of besadii's logic lives in this library, which can be tested
+  # without running the hooks against real services.
+  ci = package {
+    name = "besadii-ci";
+    path = "code.tvl.fyi/ops/besadii/ci";
+    srcs = [
+      ./ci/actions.go
+      ./ci/attention.go
+      ./ci/attestations.go
+      ./ci/auth.go
+      ./ci/besadii.go
+      ./ci/buildkite.go
+      ./ci/config.go
+      ./ci/daemon.go
+      ./ci/drvmap.go
+      ./ci/failures.go
+      ./ci/gerrit.go
+      ./ci/hooks.go
+      ./ci/identities.go
+      ./ci/policy.go
+      ./ci/queue.go
+      ./ci/records.go
+      ./ci/rules.go
+      ./ci/testreports.go
+      ./ci/transport.go
+    ];
+  };
+
+  # The tests only use the standard library, but need a module
+  # declaration for the go command to enable current language and
+  # net/http behaviour. The derivation map tests run git.
+  tests = pkgs.runCommand "besadii-tests" { nativeBuildInputs = [ pkgs.git ]; } ''
+    set -o pipefail
+    export HOME=$TMPDIR GOCACHE=$TMPDIR/cache GOPATH=$TMPDIR/go GOFLAGS=-mod=mod GOTOOLCHAIN=local
+    cp -r ${./ci} ci && chmod -R +w ci && cd ci
+    printf 'module code.tvl.fyi/ops/besadii/ci\ngo 1.22\n' > go.mod
+    ${go}/bin/go test -v . | tee $out
+  '';
+in
+(program {
   name = "besadii";
   srcs = [ ./main.go ];
-}
+  deps = [ ci ];
+}).overrideAttrs (_: {
+  passthru.tests = tests;
+
+  # The tests are run as a CI subtarget only, not as a separate step
+  # of the workspace pipeline.
+  meta.ci.targets = [ "tests" ];
+})
@@ -0,0 +1,171 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This tool instruments the Go files of a package for coverage with
+// `go tool cover`, writing them to an output directory together with
+// the file that registers the package's coverage variables and the
+// configuration for the compiler's `-coveragecfg` flag.
+//
+// Files are named after their originals without the Nix store hash,
+// so that coverage profiles refer to them by their import path and
+// file name. Test files are copied without being instrumented.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// coverPkgConfig is the package configuration read by `go tool cover`
+// with its -pkgcfg flag (see cmd/internal/cov/covcmd).
+type coverPkgConfig struct {
+	OutConfig   string
+	PkgPath     string
+	PkgName     string
+	Granularity string
+	ModulePath  string
+}
+
+var storeHash = regexp.MustCompile(`^[a-z0-9]{32}-`)
+
+// baseName returns the name of a file without its directory and the
+// hash of the Nix store path it may be in.
+func baseName(file string) string {
+	return storeHash.ReplaceAllString(filepath.Base(file), "")
+}
+
+// packageName reads the package name from the package clause of a Go
+// file.
+func packageName(file string) (string, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return "", err
+	}
+
+	return f.Name.Name, nil
+}
+
+// copyFile copies a file to the given path.
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(to, data, 0644)
+}
+
+// instrument runs `go tool cover` on the (renamed) files of a package,
+// writing the instrumented files to outdir.
+func instrument(goTool, importpath, mode, outdir string, files []string) error {
+	tmp, err := os.MkdirTemp("", "cover")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	name, err := packageName(files[0])
+	if err != nil {
+		return fmt.Errorf("failed to read package name: %w", err)
+	}
+
+	cfg, err := json.Marshal(coverPkgConfig{
+		OutConfig:   filepath.Join(outdir, "coveragecfg"),
+		PkgPath:     importpath,
+		PkgName:     name,
+		Granularity: "perblock",
+	})
+	if err != nil {
+		return err
+	}
+
+	pkgcfg := filepath.Join(tmp, "pkgcfg.json")
+	if err := os.WriteFile(pkgcfg, cfg, 0644); err != nil {
+		return err
+	}
+
+	// The first output of `go tool cover` is the file declaring the
+	// coverage variables, followed by one file for each input.
+	outputs := []string{filepath.Join(outdir, "covervars.go")}
+	inputs := []string{}
+	for _, file := range files {
+		renamed := filepath.Join(tmp, baseName(file))
+		if err := copyFile(file, renamed); err != nil {
+			return err
+		}
+
+		inputs = append(inputs, renamed)
+		outputs = append(outputs, filepath.Join(outdir, baseName(file)))
+	}
+
+	outfilelist := filepath.Join(tmp, "outfiles.txt")
+	if err := os.WriteFile(outfilelist, []byte(strings.Join(outputs, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	// Coverage variables are named after the import path, so that they
+	// are unique among the packages of a program.
+	varName := fmt.Sprintf("goCover_%x_", sha256.Sum256([]byte(importpath)))[:21]
+
+	args := append([]string{"tool", "cover", "-pkgcfg", pkgcfg, "-mode", mode, "-var", varName, "-outfilelist", outfilelist}, inputs...)
+	cmd := exec.Command(goTool, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("go tool cover failed: %w", err)
+	}
+
+	return nil
+}
+
+func main() {
+	goTool := flag.String("go", "go", "path of the go command")
+	path := flag.String("path", "", "import path of the package")
+	mode := flag.String("mode", "set", "coverage mode: set, count or atomic")
+	output := flag.String("o", "", "directory to write the instrumented files to")
+
+	flag.Parse()
+
+	if *path == "" || *output == "" {
+		log.Fatalf("-path and -o flags must be specified")
+	}
+
+	outdir, err := filepath.Abs(*output)
+	if err != nil {
+		log.Fatalf("failed to resolve output directory: %s", err)
+	}
+
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		log.Fatalf("failed to create output directory: %s", err)
+	}
+
+	var files []string
+	for _, file := range flag.Args() {
+		if strings.HasSuffix(baseName(file), "_test.go") {
+			if err := copyFile(file, filepath.Join(outdir, baseName(file))); err != nil {
+				log.Fatalf("failed to copy test file: %s", err)
+			}
+		} else {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) == 0 {
+		log.Fatalf("no Go files to instrument in %s", *path)
+	}
+
+	if err := instrument(*goTool, *path, *mode, outdir, files); err != nil {
+		log.Fatalf("failed to instrument %s: %s", *path, err)
+	}
+}
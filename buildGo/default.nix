@@ -5,6 +5,11 @@
 # rules_go.
 
 { pkgs ? import <nixpkgs> { }
+  # Platform that Go code is built for, which defaults to the platform
+  # targeted by the Go toolchain in pkgs.
+, platform ? { goos = pkgs.go.GOOS; goarch = pkgs.go.GOARCH; }
+  # Additional build tags for the analysis of external packages.
+, tags ? [ ]
 , ...
 }:
 
@@ -15,6 +20,7 @@ let
     dirOf
     elemAt
     filter
+    head
     listToAttrs
     map
     match
@@ -22,8 +28,23 @@ let
     replaceStrings
     toString;
 
-  inherit (pkgs) lib runCommand fetchFromGitHub protobuf symlinkJoin go;
-  goStdlib = buildStdlib go;
+  inherit (pkgs) lib runCommand runCommandCC fetchFromGitHub protobuf symlinkJoin go;
+  goStdlib = buildStdlib { inherit go; };
+
+  # When building for another platform, tools that run during the
+  # build (such as the analyser) are built for the host platform.
+  crossCompiling = platform != { goos = go.GOOS; goarch = go.GOARCH; };
+  hostProgram = if crossCompiling then (import ./. { inherit pkgs; }).program else program;
+
+  # Environment of all Go tool invocations.
+  goEnv = {
+    GOOS = platform.goos;
+    GOARCH = platform.goarch;
+  };
+
+  # Packages using cgo, and programs linking them, are built against a
+  # standard library that was built with cgo enabled.
+  goStdlibCgo = buildStdlib { inherit go; cgo = true; };
 
   # Helpers for low-level Go compiler invocations
   spaceOut = lib.concatStringsSep " ";
@@ -38,10 +59,22 @@ let
   srcCopy = path: src: "cp ${src} $out/${path}/${srcBasename src}";
   srcList = path: srcs: lib.concatStringsSep "\n" (map (srcCopy path) srcs);
 
+  # Name of a (C or Go) source file without the store path hash.
+  fileBasename = src: elemAt (match "([a-z0-9]{32}\-)?(.*)" (baseNameOf src)) 1;
+
   allDeps = deps: lib.unique (lib.flatten (deps ++ (map (d: d.goDeps) deps)));
 
   xFlags = x_defs: spaceOut (map (k: "-X ${k}=${x_defs."${k}"}") (attrNames x_defs));
 
+  # Files embedded with //go:embed are passed to the compiler in a JSON
+  # configuration, which maps each pattern to the names of the files it
+  # matches (relative to the package directory), and those names to
+  # the files' locations.
+  embedFlag = name: embed: lib.optionalString (embed != { }) "-embedcfg ${pkgs.writeText "${name}-embedcfg.json" (builtins.toJSON {
+    Patterns = embed.patterns;
+    Files = embed.files;
+  })}";
+
   pathToName = p: replaceStrings [ "/" ] [ "_" ] (toString p);
 
   # Add an `overrideGo` attribute to a function result that works
@@ -51,10 +84,13 @@ let
     overrideGo = new: makeOverridable f (orig // (new orig));
   };
 
-  buildStdlib = go: runCommand "go-stdlib-${go.version}"
-    {
+  usesCgo = deps: lib.any (d: d.goCgo or false) deps;
+
+  buildStdlib = { go, cgo ? false }: (if cgo then runCommandCC else runCommand)
+    "go-stdlib-${go.version}${lib.optionalString crossCompiling "-${platform.goos}_${platform.goarch}"}${lib.optionalString cgo "-cgo"}"
+    (goEnv // {
       nativeBuildInputs = [ go ];
-    } ''
+    }) ''
     HOME=$NIX_BUILD_TOP/home
     mkdir $HOME
 
@@ -62,6 +98,7 @@ let
     cp -R "$goroot/src" "$goroot/pkg" .
 
     chmod -R +w .
+    export CGO_ENABLED=${if cgo then "1" else "0"}
     GODEBUG=installgoroot=all GOROOT=$NIX_BUILD_TOP go install -v --trimpath std
 
     mkdir $out
@@ -74,9 +111,9 @@ let
     done > $out/importcfg
   '';
 
-  importcfgCmd = { name, deps, out ? "importcfg" }: ''
+  importcfgCmd = { name, deps, cgo ? usesCgo deps, out ? "importcfg" }: ''
     echo "# nix buildGo ${name}" > "${out}"
-    cat "${goStdlib}/importcfg" >> "${out}"
+    cat "${if cgo then goStdlibCgo else goStdlib}/importcfg" >> "${out}"
     ${lib.concatStringsSep "\n" (map (dep: ''
       find "${dep}" -name '*.a' | while read -r pkgp; do
         relpath="''${pkgp#"${dep}/"}"
@@ -89,21 +126,51 @@ let
   # High-level build functions
 
   # Build a Go program out of the specified files and dependencies.
-  program = { name, srcs, deps ? [ ], x_defs ? { } }:
-    let uniqueDeps = allDeps (map (d: d.gopkg) deps);
-    in runCommand name { } ''
-      ${importcfgCmd { inherit name; deps = uniqueDeps; }}
-      ${go}/bin/go tool compile -o ${name}.a -importcfg=importcfg -trimpath=$PWD -trimpath=${go} -p main ${includeSources uniqueDeps} ${spaceOut srcs}
+  #
+  # With `cgoStdlib`, the program is built against the standard library
+  # with cgo enabled even if none of its dependencies use cgo.
+  program = { name, srcs, deps ? [ ], x_defs ? { }, embed ? { }, cgoStdlib ? false }:
+    let
+      uniqueDeps = allDeps (map (d: d.gopkg) deps);
+
+      # Programs depending on cgo packages are linked with the C
+      # toolchain, which also resolves their C libraries.
+      cgo = cgoStdlib || usesCgo uniqueDeps;
+      cgoLink = lib.optionalString cgo "-linkmode external -extld cc";
+    in
+    (if cgo then runCommandCC else runCommand) name goEnv ''
+      ${importcfgCmd { inherit name cgo; deps = uniqueDeps; }}
+      ${go}/bin/go tool compile -o ${name}.a -importcfg=importcfg -trimpath=$PWD -trimpath=${go} -p main ${embedFlag name embed} ${includeSources uniqueDeps} ${spaceOut srcs}
       mkdir -p $out/bin
       export GOROOT_FINAL=go
-      ${go}/bin/go tool link -o $out/bin/${name} -importcfg=importcfg -buildid nix ${xFlags x_defs} ${includeLibs uniqueDeps} ${name}.a
+      ${go}/bin/go tool link -o $out/bin/${name} -importcfg=importcfg -buildid nix ${cgoLink} ${xFlags x_defs} ${includeLibs uniqueDeps} ${name}.a
     '';
 
   # Build a Go library assembled out of the specified files.
   #
   # This outputs both the sources and compiled binary, as both are
   # needed when downstream packages depend on it.
-  package = { name, srcs, deps ? [ ], path ? name, sfiles ? [ ] }:
+  package =
+    { name
+    , srcs
+    , deps ? [ ]
+    , path ? name
+    , sfiles ? [ ]
+    , embed ? { }
+      # cgo sources, flags and the packages providing C libraries
+    , cgofiles ? [ ]
+    , cfiles ? [ ]
+    , hfiles ? [ ]
+    , cflags ? [ ]
+    , ldflags ? [ ]
+    , pkgconfig ? [ ]
+    , cdeps ? [ ]
+      # Build against the standard library with cgo enabled, even
+      # without cgo files
+    , cgoStdlib ? false
+      # Instrument the package for coverage
+    , coverage ? false
+    }:
     let
       uniqueDeps = allDeps (map (d: d.gopkg) deps);
 
@@ -113,38 +180,244 @@ let
       # This is required for several popular packages (e.g. x/sys).
       ifAsm = do: lib.optionalString (sfiles != [ ]) do;
       asmBuild = ifAsm ''
-        ${go}/bin/go tool asm -p ${path} -trimpath $PWD -I $PWD -I ${go}/share/go/pkg/include -D GOOS_linux -D GOARCH_amd64 -gensymabis -o ./symabis ${spaceOut sfiles}
-        ${go}/bin/go tool asm -p ${path} -trimpath $PWD -I $PWD -I ${go}/share/go/pkg/include -D GOOS_linux -D GOARCH_amd64 -o ./asm.o ${spaceOut sfiles}
+        ${go}/bin/go tool asm -p ${path} -trimpath $PWD -I $PWD -I ${go}/share/go/pkg/include -D GOOS_${platform.goos} -D GOARCH_${platform.goarch} -gensymabis -o ./symabis ${spaceOut sfiles}
+        ${go}/bin/go tool asm -p ${path} -trimpath $PWD -I $PWD -I ${go}/share/go/pkg/include -D GOOS_${platform.goos} -D GOARCH_${platform.goarch} -o ./asm.o ${spaceOut sfiles}
       '';
       asmLink = ifAsm "-symabis ./symabis -asmhdr $out/go_asm.h";
       asmPack = ifAsm ''
         ${go}/bin/go tool pack r $out/${path}.a ./asm.o
       '';
 
-      gopkg = (runCommand "golib-${name}" { } ''
+      # Packages with cgo files are processed by `go tool cgo`, which
+      # generates Go files and C files that are compiled with the C
+      # compiler and packed into the package archive. This follows the
+      # same steps as `go build`.
+      cgo = lib.throwIf (cgofiles != [ ] && crossCompiling)
+        "cgo is not supported when cross-compiling, but '${path}' uses it"
+        (cgofiles != [ ]);
+      ifCgo = do: lib.optionalString cgo do;
+      cgoSrc = f: "cgo-src/${fileBasename f}";
+      cgoFlags = var: flags: pkgConfigFlag: ''
+        export ${var}="${spaceOut flags}${lib.optionalString (pkgconfig != [ ]) " $(pkg-config ${pkgConfigFlag} ${spaceOut pkgconfig})"}"
+      '';
+      cgoBuild = ifCgo ''
+        mkdir -p cgo-src cgo-obj cgo-o
+        export CC=cc
+        ${lib.concatMapStringsSep "\n" (f: "cp ${f} ${cgoSrc f}") (cgofiles ++ cfiles ++ hfiles)}
+        ${cgoFlags "CGO_CFLAGS" cflags "--cflags"}
+        ${cgoFlags "CGO_LDFLAGS" ldflags "--libs"}
+
+        ${go}/bin/go tool cgo -objdir cgo-obj -importpath ${path} -trimpath $PWD -- -I cgo-obj -I cgo-src $CGO_CFLAGS ${spaceOut (map cgoSrc cgofiles)}
+
+        for c in cgo-obj/*.cgo2.c cgo-obj/_cgo_export.c ${spaceOut (map cgoSrc cfiles)}; do
+          cc -c -fPIC -pthread -I cgo-obj -I cgo-src $CGO_CFLAGS -o "cgo-o/$(basename "$c" .c).o" "$c"
+        done
+
+        # The dynamic imports of the C code are determined by linking it
+        # with a stub main function.
+        cc -c -fPIC -pthread -I cgo-obj -I cgo-src $CGO_CFLAGS -o cgo-obj/_cgo_main.o cgo-obj/_cgo_main.c
+        cc -o cgo-obj/_cgo_.o cgo-obj/_cgo_main.o cgo-o/*.o -pthread $CGO_LDFLAGS
+        ${go}/bin/go tool cgo -dynpackage "$(sed -n 's/^package //p' cgo-obj/_cgo_gotypes.go | head -n 1)" \
+          -dynimport cgo-obj/_cgo_.o -dynout cgo-obj/_cgo_import.go
+      '';
+      cgoGoFiles = ifCgo "cgo-obj/_cgo_gotypes.go cgo-obj/*.cgo1.go cgo-obj/_cgo_import.go";
+      cgoPack = ifCgo ''
+        ${go}/bin/go tool pack r $out/${path}.a cgo-o/*.o
+      '';
+
+      # Packages depending on cgo packages are compiled against the
+      # same standard library as them.
+      stdlibCgo = cgo || cgoStdlib || usesCgo uniqueDeps;
+
+      # Packages built with coverage are compiled from sources
+      # instrumented by the cover tool, which registers the package's
+      # coverage variables with the compiler's -coveragecfg flag.
+      cover = lib.throwIf (coverage && cgo)
+        "coverage is not supported with cgo, but '${path}' uses it"
+        (lib.throwIf (coverage && !coverSupported)
+          "coverage of '${path}' requires Go ${coverGoVersions.min} to ${coverGoVersions.max}, but Go ${go.version} is used"
+          coverage);
+      coverBuild = lib.optionalString cover ''
+        ${coverTool}/bin/cover -go ${go}/bin/go -path ${path} -o cover ${spaceOut srcs}
+      '';
+      coverFlag = lib.optionalString cover "-coveragecfg=cover/coveragecfg";
+      goSrcs = if cover then "cover/*.go" else spaceOut srcs;
+
+      gopkg = ((if cgo then runCommandCC else runCommand) "golib-${name}"
+        (goEnv // {
+          nativeBuildInputs = lib.optional (pkgconfig != [ ]) pkgs.pkg-config;
+          buildInputs = cdeps;
+        }) ''
         mkdir -p $out/${path}
         ${srcList path (map (s: "${s}") srcs)}
         ${asmBuild}
-        ${importcfgCmd { inherit name; deps = uniqueDeps; }}
-        ${go}/bin/go tool compile -pack ${asmLink} -o $out/${path}.a -importcfg=importcfg -trimpath=$PWD -trimpath=${go} -p ${path} ${includeSources uniqueDeps} ${spaceOut srcs}
+        ${cgoBuild}
+        ${coverBuild}
+        ${importcfgCmd { inherit name; deps = uniqueDeps; cgo = stdlibCgo; }}
+        ${go}/bin/go tool compile -pack ${asmLink} -o $out/${path}.a -importcfg=importcfg -trimpath=$PWD -trimpath=${go} -p ${path} ${coverFlag} ${embedFlag name embed} ${includeSources uniqueDeps} ${goSrcs} ${cgoGoFiles}
         ${asmPack}
+        ${cgoPack}
       '').overrideAttrs (_: {
         passthru = {
           inherit gopkg;
           goDeps = uniqueDeps;
           goImportPath = path;
+          goCgo = stdlibCgo;
+          goCover = cover;
         };
       });
     in
     gopkg;
 
+  # Tool generating the main function of test binaries.
+  testmain = hostProgram {
+    name = "testmain";
+
+    srcs = [
+      ./external/testfuncs.go
+      ./testmain/main.go
+    ];
+  };
+
+  # The cover and testmain tools use the unexported interface between
+  # cmd/go, `go tool cover` and the runtime's coverage support
+  # (internal/coverage/cfile and the Cover* variables of
+  # testing/internal/testdeps), which can change with any Go release.
+  # Coverage is only supported with the releases it was checked
+  # against, and the maximum is raised once a new release is checked.
+  coverGoVersions = { min = "1.23"; max = "1.27"; };
+  coverSupported =
+    let version = lib.versions.majorMinor go.version;
+    in lib.versionAtLeast version coverGoVersions.min
+      && lib.versionAtLeast coverGoVersions.max version;
+
+  # Tool instrumenting the sources of packages for coverage.
+  coverTool = hostProgram {
+    name = "cover";
+    srcs = [ ./cover/main.go ];
+  };
+
+  # Write a coverage profile and an HTML report to $out from the raw
+  # coverage data in the given directories, which is merged with `go
+  # tool covdata`. The profile names files by their import path, and
+  # the report reads them from the outputs of the covered packages.
+  coverReportCmd = dirs: covered: ''
+    ${go}/bin/go tool covdata textfmt -i=${lib.concatStringsSep "," dirs} -o $out/coverage.out
+    sed -E ${spaceOut (map (p: "-e 's|^${lib.escapeRegex p.goImportPath}/([^/]+\\.go:)|${p}/${p.goImportPath}/\\1|'") covered)} \
+      $out/coverage.out > coverage-sources.out
+    ${go}/bin/go tool cover -html=coverage-sources.out -o $out/coverage.html
+  '';
+
+  # Merge the coverage data of several test runs, skipping those
+  # without any instrumented packages.
+  coverReport = { name, tests }:
+    let covering = lib.filter (t: t.goCovered != [ ]) tests;
+    in runCommand "gocoverage-${name}" { } ''
+      mkdir -p $out
+      ${coverReportCmd (map (t: "${t}/gocoverdir") covering) (lib.unique (lib.concatMap (t: t.goCovered) covering))}
+    '';
+
+  # Build and run the tests of a Go package.
+  #
+  # The package is compiled together with its internal test files, and
+  # the external test files (in the `_test` package) are compiled
+  # against that variant. A generated main function runs both in a
+  # test binary, like `go test` does.
+  #
+  # If the package is built with coverage, the test run also writes the
+  # coverage of all instrumented packages in the test binary.
+  test =
+    { tests ? [ ]
+    , xtests ? [ ]
+    , testDeps ? [ ]
+    , testFlags ? [ ]
+      # Working directory of the test binary, which defaults to the
+      # directory of the package sources.
+    , dir ? dirOf (head args.srcs)
+    , ...
+    }@args:
+    let
+      pkgArgs = removeAttrs args [ "tests" "xtests" "testDeps" "testFlags" "dir" ];
+      inherit (pkgArgs) name;
+      path = pkgArgs.path or name;
+
+      testVariant = package (pkgArgs // {
+        name = "${name}-test";
+        srcs = pkgArgs.srcs ++ tests;
+        deps = (pkgArgs.deps or [ ]) ++ testDeps;
+      });
+
+      xtestPkg = package {
+        name = "${name}_test";
+        path = "${path}_test";
+        srcs = xtests;
+        deps = [ testVariant ] ++ (pkgArgs.deps or [ ]) ++ testDeps;
+        embed = pkgArgs.embed or { };
+      };
+
+      # External tests may import packages that depend on the package
+      # under test. `go test` recompiles those against the test variant,
+      # but here they would link the package a second time.
+      dependsOnSelf = d: lib.any (p: p.goImportPath == path) ([ d ] ++ d.goDeps or [ ]);
+      dependants = lib.filter dependsOnSelf (map (d: d.gopkg) ((pkgArgs.deps or [ ]) ++ testDeps));
+
+      binaryDeps = [ testVariant ] ++ lib.optional (xtests != [ ]) xtestPkg;
+      covered = lib.filter (d: d.goCover or false) (allDeps binaryDeps);
+      coverFlags = lib.optionalString (covered != [ ])
+        "-cover set -coverpkgs ${lib.concatMapStringsSep "," (d: d.goImportPath) covered}";
+
+      testmainSrc = runCommand "${name}-testmain.go" { } ''
+        ${testmain}/bin/testmain -path ${path} ${coverFlags} -o $out ${spaceOut (tests ++ xtests)}
+      '';
+
+      testBinary = program {
+        name = "${name}.test";
+        srcs = [ testmainSrc ];
+        deps = binaryDeps;
+      };
+    in
+    if crossCompiling then throw "tests of '${path}' cannot be run when cross-compiling"
+    else if tests == [ ] && xtests == [ ] then throw "'${path}' has no test files"
+    else if dependants != [ ] then throw "tests of '${path}' import ${lib.concatMapStringsSep ", " (d: "'${d.goImportPath}'") (lib.unique dependants)}, which depend on '${path}' itself and would have to be rebuilt with its test files, which buildGo does not support"
+    else
+      ((if usesCgo [ testVariant ] then runCommandCC else runCommand) "gotest-${name}" { } ''
+        export HOME=$NIX_BUILD_TOP/home
+        mkdir -p $HOME $out
+
+        # Tests may write to their working directory.
+        cp -r ${dir} pkgdir
+        chmod -R +w pkgdir
+        cd pkgdir
+
+        set -o pipefail
+        ${lib.optionalString (covered != [ ]) "mkdir $out/gocoverdir"}
+        ${testBinary}/bin/${name}.test -test.v -test.paniconexit0 \
+          ${lib.optionalString (covered != [ ]) "-test.gocoverdir=$out/gocoverdir"} \
+          ${spaceOut testFlags} 2>&1 | tee $out/test.log
+
+        ${lib.optionalString (covered != [ ]) ''
+          cd $NIX_BUILD_TOP
+          ${coverReportCmd [ "$out/gocoverdir" ] covered}
+        ''}
+      '').overrideAttrs (_: {
+        passthru = {
+          inherit testBinary;
+          goCovered = covered;
+        };
+      });
+
   # Build a tree of Go libraries out of an external Go source
   # directory that follows the standard Go layout and was not built
   # with buildGo.nix.
   #
   # The derivation for each actual package will reside in an attribute
   # named "gopkg", and an attribute named "gobin" for binaries.
-  external = import ./external { inherit pkgs program package; };
+  external = import ./external { inherit pkgs program package test coverReport hostProgram platform tags; };
+
+  # Build a Go module and all of its dependencies from a lock file
+  # generated by the gomodlock tool from go.mod and go.sum.
+  inherit (import ./gomodlock { inherit pkgs external; program = hostProgram; })
+    gomodlock modules;
 
 in
 {
@@ -152,7 +425,14 @@ in
   # overrideable.
   program = makeOverridable program;
   package = makeOverridable package;
+  test = makeOverridable test;
   external = makeOverridable external;
+  inherit modules gomodlock;
+
+  # Validation of the analyser's output format, built by CI as a
+  # subtarget.
+  tests = import ./external/tests.nix { inherit pkgs external; };
+  meta.ci.targets = [ "tests" ];
 
   # re-expose the Go version used
   inherit go;
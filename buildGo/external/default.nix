@@ -1,9 +1,10 @@
 # Copyright 2019 Google LLC.
 # SPDX-License-Identifier: Apache-2.0
-{ pkgs, program, package }:
+{ pkgs, program, package, test, coverReport, hostProgram, platform, tags }:
 
 let
   inherit (builtins)
+    attrValues
     elemAt
     foldl'
     fromJSON
@@ -18,6 +19,14 @@ let
 
   inherit (pkgs) lib runCommand go jq ripgrep;
 
+  # Version of the analysis format (see analysis.schema.json) that this
+  # file understands.
+  schemaVersion = 1;
+
+  checkSchemaVersion = analysis:
+    if analysis.schemaVersion or null == schemaVersion then analysis
+    else throw "unsupported analysis schema version ${toString (analysis.schemaVersion or "(none)")}, expected ${toString schemaVersion}";
+
   pathToName = p: replaceStrings [ "/" ] [ "_" ] (toString p);
 
   # Collect all non-vendored dependencies from the Go standard library
@@ -33,11 +42,16 @@ let
       > $out
   '';
 
-  analyser = program {
+  analyser = hostProgram {
     name = "analyser";
 
     srcs = [
+      ./embed.go
+      ./gomod.go
       ./main.go
+      ./testfuncs.go
+      ./tests.go
+      ./vendor.go
     ];
 
     x_defs = {
@@ -46,48 +60,137 @@ let
   };
 
   mkset = path: value:
-    if path == [ ] then { gopkg = value; }
+    if path == [ ] then value
     else { "${head path}" = mkset (tail path) value; };
 
   last = l: elemAt l ((length l) - 1);
 
-  toPackage = self: src: path: depMap: entry:
+  # Build the tree node of a package, which contains its derivation in
+  # "gopkg" and, for libraries with tests, the test run in "gotest".
+  toPackage = self: src: path: depMap: cgo: cdeps: coverage: entry:
     let
-      localDeps = map
-        (d: lib.attrByPath (d ++ [ "gopkg" ])
-          (
-            throw "missing local dependency '${lib.concatStringsSep "." d}' in '${path}'"
-          )
-          self)
-        entry.localDeps;
-
-      foreignDeps = map
-        (d: lib.attrByPath [ d.path ]
-          (
-            throw "missing foreign dependency '${d.path}' in '${path}, imported at ${d.position}'"
-          )
-          depMap)
-        entry.foreignDeps;
+      resolveDeps = deps:
+        let
+          localDeps = map
+            (d: lib.attrByPath (d ++ [ "gopkg" ])
+              (
+                throw "missing local dependency '${lib.concatStringsSep "." d}' in '${path}'"
+              )
+              self)
+            deps.localDeps;
+
+          foreignDeps = map
+            (d: lib.attrByPath [ d.path ]
+              (
+                throw "missing foreign dependency '${d.path}' in '${path}, imported at ${d.position}'"
+              )
+              depMap)
+            deps.foreignDeps;
+        in
+        localDeps ++ foreignDeps;
+
+      # Embedded files are named relative to the package directory.
+      embedArgs = embed: lib.optionalAttrs (embed != { }) {
+        patterns = embed;
+        files = listToAttrs (map
+          (f: {
+            name = f;
+            value = src + ("/" + lib.concatStringsSep "/" (entry.locator ++ [ f ]));
+          })
+          (lib.unique (lib.flatten (attrValues embed))));
+      };
+
+      vendored = entry.locator != [ ] && head entry.locator == "vendor";
 
+      # With cgo, every package and program is built against the
+      # standard library with cgo enabled, so that packages with and
+      # without cgo files can be linked together.
       args = {
         srcs = map (f: src + ("/" + f)) entry.files;
-        deps = localDeps ++ foreignDeps;
+        deps = resolveDeps entry;
+        embed = embedArgs entry.embed;
+        cgoStdlib = cgo;
       };
 
       libArgs = args // {
         name = pathToName entry.name;
-        path = lib.concatStringsSep "/" ([ path ] ++ entry.locator);
+        path = entry.name;
         sfiles = map (f: src + ("/" + f)) entry.sfiles;
+      } // lib.optionalAttrs (entry.cgoFiles != [ ]) {
+        cgofiles = map (f: src + ("/" + f)) entry.cgoFiles;
+        cfiles = map (f: src + ("/" + f)) entry.cFiles;
+        hfiles = map (f: src + ("/" + f)) entry.hFiles;
+        cflags = entry.cgoCFLAGS;
+        ldflags = entry.cgoLDFLAGS;
+        pkgconfig = entry.cgoPkgConfig;
+        inherit cdeps;
+      } // lib.optionalAttrs (coverage && entry.cgoFiles == [ ] && !vendored) {
+        coverage = true;
       };
 
       binArgs = args // {
         name = (last ((lib.splitString "/" path) ++ entry.locator));
       };
+
+      # Tests are run in the package directory, with the test files
+      # embedding files in addition to the package itself.
+      testArgs = libArgs // {
+        tests = map (f: src + ("/" + f)) entry.test.testGoFiles;
+        xtests = map (f: src + ("/" + f)) entry.test.xTestGoFiles;
+        testDeps = resolveDeps entry.test;
+        embed = embedArgs (entry.embed // entry.test.embed);
+        dir = if entry.locator == [ ] then src else src + ("/" + lib.concatStringsSep "/" entry.locator);
+      };
+    in
+    if entry.isCommand && entry.cgoFiles != [ ]
+    then throw "cgo is only supported in library packages, but the program '${entry.name}' uses it"
+    else if entry.isCommand then { gopkg = program binArgs; }
+    else {
+      gopkg = package libArgs;
+    } // lib.optionalAttrs (entry.test != null) {
+      # Errors in the test files only fail the build of the tests.
+      gotest =
+        if entry.test.error != null
+        then throw "tests of '${entry.name}' cannot be built: ${entry.test.error}"
+        else test testArgs;
+    };
+
+  # Check that every module required directly by the go.mod file of the
+  # analysed source is vendored or provided by at least one of the
+  # dependencies, and that the module does not require a newer Go
+  # version.
+  checkModule = path: deps: vendored: module:
+    let
+      provides = req: lib.any (v: v.path == req.path) vendored || lib.any
+        (d: d.goImportPath == req.path || lib.hasPrefix "${req.path}/" d.goImportPath)
+        deps;
+
+      missing = map (req: "${req.path}@${req.version}")
+        (lib.filter (req: !req.indirect && !(provides req)) module.require);
     in
-    if entry.isCommand then (program binArgs) else (package libArgs);
+    if module.goVersion != "" && lib.versionOlder go.version module.goVersion
+    then throw "'${path}' requires Go ${module.goVersion}, but buildGo uses Go ${go.version}"
+    else if missing != [ ]
+    then throw "missing dependencies required by go.mod of '${path}': ${lib.concatStringsSep ", " missing}"
+    else true;
 
 in
-{ src, path, deps ? [ ] }:
+{ src
+, path ? null
+, deps ? [ ]
+  # Check go.mod requirements against deps. Off by default, as modules
+  # only used by tests are required too.
+, checkRequires ? false
+  # Build packages with cgo, using the C libraries in cdeps. All
+  # packages in the tree and its dependencies are then built against
+  # the standard library with cgo enabled.
+, cgo ? false
+, cdeps ? [ ]
+  # Build library packages (except vendored ones and those using cgo)
+  # with coverage, and merge the coverage of all tests in the
+  # "gocoverage" attribute.
+, coverage ? false
+}:
 let
   # Build a map of dependencies (from their import paths to their
   # derivation) so that they can be conditionally imported only in
@@ -99,14 +202,47 @@ let
     })
     (map (d: d.gopkg) deps));
 
-  name = pathToName path;
+  # Without an explicit path, the import path is taken from the module
+  # directive in the go.mod file of the source.
+  name = pathToName (if path != null then path else baseNameOf src);
+  pathFlag = lib.optionalString (path != null) "-path ${path}";
+  tagsFlag = lib.optionalString (tags != [ ]) "-tags ${lib.concatStringsSep "," tags}";
+  # Only the schema version of the output is checked here, to keep the
+  # analysis free of anything but Go. The output is validated against
+  # the full schema in tests.nix.
   analysisOutput = runCommand "${name}-structure.json" { } ''
-    ${analyser}/bin/analyser -path ${path} -source ${src} > $out
+    ${analyser}/bin/analyser ${pathFlag} ${lib.optionalString cgo "-cgo"} \
+      -goos ${platform.goos} -goarch ${platform.goarch} ${tagsFlag} \
+      -source ${src} > $out
   '';
   # readFile adds the references of the read in file to the string context for
   # Nix >= 2.6 which would break the attribute set construction in fromJSON
-  analysis = fromJSON (unsafeDiscardStringContext (readFile analysisOutput));
+  analysis = checkSchemaVersion (fromJSON (unsafeDiscardStringContext (readFile analysisOutput)));
+  importPath = if path != null then path else analysis.module.path;
+
+  packages = analysis.packages or [ ];
+  tested = lib.filter (entry: entry.test != null && !entry.isCommand) packages;
+
+  checked = !checkRequires || analysis.module == null
+    || checkModule importPath (map (d: d.gopkg) deps) analysis.vendored analysis.module;
+
+  # Packages built against different standard libraries can not be
+  # linked together, so with cgo all dependencies must be built with
+  # cgo too.
+  nonCgoDeps = lib.filter (d: !(d.goCgo or false))
+    (lib.concatMap (d: [ d.gopkg ] ++ d.gopkg.goDeps or [ ]) deps);
+
+  cgoChecked = !cgo || nonCgoDeps == [ ]
+    || throw "'${importPath}' is built with cgo, but its dependencies are not: ${lib.concatMapStringsSep ", " (d: d.goImportPath) (lib.unique nonCgoDeps)}";
 in
+assert checked && cgoChecked;
 lib.fix (self: foldl' lib.recursiveUpdate { } (
-  map (entry: mkset entry.locator (toPackage self src path depMap entry)) analysis
-))
+  map (entry: mkset entry.locator (toPackage self src importPath depMap cgo cdeps coverage entry)) packages
+) // {
+  goanalysis = analysisOutput;
+} // lib.optionalAttrs coverage {
+  gocoverage = coverReport {
+    inherit name;
+    tests = map (entry: lib.getAttrFromPath (entry.locator ++ [ "gotest" ]) self) tested;
+  };
+})
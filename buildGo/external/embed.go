@@ -0,0 +1,138 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This file implements the resolution of `//go:embed` patterns to the
+// files they embed, following the rules of the go command.
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// isBadEmbedName returns true for names that can never be embedded,
+// such as version control directories.
+func isBadEmbedName(name string) bool {
+	switch name {
+	case "", ".bzr", ".hg", ".git", ".svn":
+		return true
+	}
+	return false
+}
+
+// inOtherModule returns true if a directory between the package
+// directory and the file contains a go.mod file.
+func inOtherModule(pkgdir, file string) bool {
+	for dir := filepath.Dir(file); len(dir) > len(pkgdir); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveEmbed resolves the `//go:embed` patterns of the package in
+// pkgdir, returning the files (relative to pkgdir) matched by each
+// pattern.
+//
+// Directories are embedded recursively, excluding files whose names
+// begin with '.' or '_' unless the pattern has an "all:" prefix.
+func resolveEmbed(pkgdir string, patterns []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+
+	for _, pattern := range patterns {
+		glob, all := strings.CutPrefix(pattern, "all:")
+		if _, err := path.Match(glob, ""); err != nil || glob == "." || !fs.ValidPath(glob) {
+			return nil, fmt.Errorf("pattern %s: invalid pattern syntax", pattern)
+		}
+
+		matches, err := filepath.Glob(filepath.Join(pkgdir, filepath.FromSlash(glob)))
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s: %w", pattern, err)
+		}
+
+		found := make(map[string]bool)
+		for _, file := range matches {
+			rel := filepath.ToSlash(strings.TrimPrefix(file, pkgdir+string(filepath.Separator)))
+
+			info, err := os.Lstat(file)
+			if err != nil {
+				return nil, fmt.Errorf("pattern %s: %w", pattern, err)
+			}
+
+			for _, elem := range strings.Split(rel, "/") {
+				if isBadEmbedName(elem) {
+					return nil, fmt.Errorf("pattern %s: cannot embed %s: invalid name %s", pattern, rel, elem)
+				}
+			}
+
+			if inOtherModule(pkgdir, file) {
+				return nil, fmt.Errorf("pattern %s: cannot embed %s: in different module", pattern, rel)
+			}
+
+			switch {
+			case info.Mode().IsRegular():
+				found[rel] = true
+
+			case info.IsDir():
+				count := 0
+				err := filepath.Walk(file, func(p string, info os.FileInfo, err error) error {
+					if err != nil {
+						return err
+					}
+
+					name := info.Name()
+					if p != file && (isBadEmbedName(name) || ((name[0] == '.' || name[0] == '_') && !all)) {
+						if info.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+
+					if info.IsDir() {
+						if _, err := os.Stat(filepath.Join(p, "go.mod")); err == nil && p != file {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+
+					if info.Mode().IsRegular() {
+						count++
+						found[filepath.ToSlash(strings.TrimPrefix(p, pkgdir+string(filepath.Separator)))] = true
+					}
+					return nil
+				})
+
+				if err != nil {
+					return nil, fmt.Errorf("pattern %s: %w", pattern, err)
+				}
+
+				if count == 0 {
+					return nil, fmt.Errorf("pattern %s: cannot embed directory %s: contains no embeddable files", pattern, rel)
+				}
+
+			default:
+				return nil, fmt.Errorf("pattern %s: cannot embed irregular file %s", pattern, rel)
+			}
+		}
+
+		if len(found) == 0 {
+			return nil, fmt.Errorf("pattern %s: no matching files found", pattern)
+		}
+
+		files := []string{}
+		for f := range found {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		result[pattern] = files
+	}
+
+	return result, nil
+}
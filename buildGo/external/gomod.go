@@ -0,0 +1,215 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This file implements a minimal reader for `go.mod` files, which only
+// understands the directives that are relevant for the analysis.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// module describes the `go.mod` file at the root of the source
+// directory.
+type module struct {
+	Path      string    `json:"path"`
+	GoVersion string    `json:"goVersion"`
+	Require   []require `json:"require"`
+
+	// Replacements and exclusions are only used when resolving the
+	// module graph, and not part of the analysis output.
+	Replace []replace    `json:"-"`
+	Exclude []modVersion `json:"-"`
+}
+
+// require is a single `require` directive of a module.
+type require struct {
+	Path     string `json:"path"`
+	Version  string `json:"version"`
+	Indirect bool   `json:"indirect"`
+}
+
+// modVersion identifies a module at a specific version. The version
+// is empty where any version of the module is meant.
+type modVersion struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+}
+
+// replace is a single `replace` directive of a module. Replacements
+// with a local directory have an empty version in New.
+type replace struct {
+	Old modVersion
+	New modVersion
+}
+
+// modArgs splits a line of a `go.mod` file into its (possibly quoted)
+// arguments and returns them with the trailing comment, if any.
+func modArgs(line string) ([]string, string, error) {
+	args := []string{}
+	for {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			return args, "", nil
+		}
+
+		if strings.HasPrefix(line, "//") {
+			return args, strings.TrimSpace(strings.TrimPrefix(line, "//")), nil
+		}
+
+		if line[0] == '"' || line[0] == '`' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, "", err
+			}
+
+			arg, _ := strconv.Unquote(quoted)
+			args = append(args, arg)
+			line = line[len(quoted):]
+			continue
+		}
+
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		if c := strings.Index(line[:end], "//"); c > 0 {
+			end = c
+		}
+
+		args = append(args, line[:end])
+		line = line[end:]
+	}
+}
+
+// parseReplace parses the arguments of a `replace` directive, which
+// have the form `old [version] => new [version]`.
+func parseReplace(args []string) (replace, bool) {
+	arrow := -1
+	for i, arg := range args {
+		if arg == "=>" {
+			arrow = i
+		}
+	}
+
+	if arrow < 1 {
+		return replace{}, false
+	}
+
+	old, new := args[:arrow], args[arrow+1:]
+	if len(old) > 2 || len(new) < 1 || len(new) > 2 {
+		return replace{}, false
+	}
+
+	r := replace{Old: modVersion{Path: old[0]}, New: modVersion{Path: new[0]}}
+	if len(old) == 2 {
+		r.Old.Version = old[1]
+	}
+	if len(new) == 2 {
+		r.New.Version = new[1]
+	}
+
+	// Only local directories can be used without a version.
+	local := strings.HasPrefix(r.New.Path, "./") || strings.HasPrefix(r.New.Path, "../") || strings.HasPrefix(r.New.Path, "/")
+	if local != (r.New.Version == "") {
+		return replace{}, false
+	}
+
+	return r, true
+}
+
+// readModule reads the `go.mod` file at the given path. Directives
+// other than `module`, `go`, `require`, `replace` and `exclude` are
+// ignored.
+func readModule(file string) (*module, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mod := module{Require: []require{}}
+	block := ""
+	lineNo := 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		args, comment, err := modArgs(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		verb := block
+		if block == "" {
+			verb, args = args[0], args[1:]
+			if len(args) == 1 && args[0] == "(" {
+				block = verb
+				continue
+			}
+		} else if args[0] == ")" {
+			block = ""
+			continue
+		}
+
+		switch verb {
+		case "module":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: module module/path", file, lineNo)
+			}
+			mod.Path = args[0]
+
+		case "go":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s:%d: usage: go 1.23", file, lineNo)
+			}
+			mod.GoVersion = args[0]
+
+		case "require":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%s:%d: usage: require module/path v1.2.3", file, lineNo)
+			}
+			mod.Require = append(mod.Require, require{
+				Path:     args[0],
+				Version:  args[1],
+				Indirect: comment == "indirect" || strings.HasPrefix(comment, "indirect;"),
+			})
+
+		case "replace":
+			r, ok := parseReplace(args)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: usage: replace module/path [v1.2.3] => other/module v1.4.5 or ./local/dir", file, lineNo)
+			}
+			mod.Replace = append(mod.Replace, r)
+
+		case "exclude":
+			if len(args) != 2 {
+				return nil, fmt.Errorf("%s:%d: usage: exclude module/path v1.2.3", file, lineNo)
+			}
+			mod.Exclude = append(mod.Exclude, modVersion{Path: args[0], Version: args[1]})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	if block != "" {
+		return nil, fmt.Errorf("%s: unterminated %s block", file, block)
+	}
+
+	if mod.Path == "" {
+		return nil, fmt.Errorf("%s: missing module directive", file)
+	}
+
+	return &mod, nil
+}
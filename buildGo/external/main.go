@@ -10,14 +10,21 @@ import (
 	"flag"
 	"fmt"
 	"go/build"
+	"go/token"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 )
 
+// Version of the analysis output format described by
+// analysis.schema.json, which is incremented on incompatible changes.
+const schemaVersion = 1
+
 // Path to a JSON file describing all standard library import paths.
 // This file is generated and set here by Nix during the build
 // process.
@@ -36,6 +43,54 @@ type pkg struct {
 	LocalDeps   [][]string   `json:"localDeps"`
 	ForeignDeps []foreignDep `json:"foreignDeps"`
 	IsCommand   bool         `json:"isCommand"`
+
+	// Files embedded by each //go:embed pattern, relative to the
+	// package directory.
+	Embed map[string][]string `json:"embed"`
+
+	// cgo sources and flags, which are only analysed with -cgo. The C
+	// flags include the preprocessor flags.
+	CgoFiles     []string `json:"cgoFiles"`
+	CFiles       []string `json:"cFiles"`
+	HFiles       []string `json:"hFiles"`
+	CgoCFLAGS    []string `json:"cgoCFLAGS"`
+	CgoLDFLAGS   []string `json:"cgoLDFLAGS"`
+	CgoPkgConfig []string `json:"cgoPkgConfig"`
+
+	// Test files and functions, if the package has any tests.
+	Test *testInfo `json:"test"`
+}
+
+// metadata describes the analyser and the settings of an analysis.
+type metadata struct {
+	GoVersion string `json:"goVersion"`
+
+	// Target platform, or all analysed platforms with -platforms.
+	Goos      string   `json:"goos,omitempty"`
+	Goarch    string   `json:"goarch,omitempty"`
+	Platforms []string `json:"platforms,omitempty"`
+
+	Tags []string `json:"tags"`
+	Cgo  bool     `json:"cgo"`
+}
+
+// analysis is the result of analysing a source directory.
+type analysis struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Analyser      metadata `json:"analyser"`
+
+	// Module read from the go.mod file at the root of the source
+	// directory, if it has one.
+	Module *module `json:"module"`
+
+	// Modules vendored in the source directory, if it has a
+	// vendor/modules.txt file.
+	Vendored []modVersion `json:"vendored"`
+
+	// Packages for the target platform, or for each of the platforms
+	// (keyed by "goos/goarch") if several are analysed.
+	Packages  []pkg            `json:"packages,omitempty"`
+	Platforms map[string][]pkg `json:"platforms,omitempty"`
 }
 
 type foreignDep struct {
@@ -46,7 +101,11 @@ type foreignDep struct {
 
 // findGoDirs returns a filepath.WalkFunc that identifies all
 // directories that contain Go source code in a certain tree.
-func findGoDirs(at string) ([]string, error) {
+//
+// Directories below the root that contain their own go.mod file belong
+// to a different module and are skipped, as is the vendor directory if
+// the dependencies are vendored.
+func findGoDirs(at string, vendored bool) ([]string, error) {
 	dirSet := make(map[string]bool)
 
 	err := filepath.Walk(at, func(path string, info os.FileInfo, err error) error {
@@ -60,6 +119,16 @@ func findGoDirs(at string) ([]string, error) {
 			return filepath.SkipDir
 		}
 
+		if info.IsDir() && vendored && path == filepath.Join(at, "vendor") {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() && path != at {
+			if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+		}
+
 		// If the current file is a Go file, then the directory is popped
 		// (i.e. marked as a Go directory).
 		if !info.IsDir() && strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
@@ -77,31 +146,27 @@ func findGoDirs(at string) ([]string, error) {
 	for k, _ := range dirSet {
 		goDirs = append(goDirs, k)
 	}
+	sort.Strings(goDirs)
 
 	return goDirs, nil
 }
 
-// analysePackage loads and analyses the imports of a single Go
-// package, returning the data that is required by the Nix code to
-// generate a derivation for this package.
-func analysePackage(root, source, importpath string, stdlib map[string]bool) (pkg, error) {
-	ctx := build.Default
-	ctx.CgoEnabled = false
-
-	p, err := ctx.ImportDir(source, build.IgnoreVendor)
-	if err != nil {
-		return pkg{}, err
-	}
-
+// classifyImports sorts the non-stdlib imports of a package into local
+// dependencies (by their locator) and foreign dependencies. Imports of
+// the package itself (by external tests) are skipped.
+func classifyImports(imports []string, positions map[string][]token.Position, importpath, self string, stdlib, vendored map[string]bool) ([][]string, []foreignDep) {
 	local := [][]string{}
 	foreign := []foreignDep{}
 
-	for _, i := range p.Imports {
-		if stdlib[i] {
+	for _, i := range imports {
+		// "C" is the pseudo-package of cgo.
+		if stdlib[i] || i == "C" || i == self {
 			continue
 		}
 
-		if i == importpath {
+		if vendored[i] {
+			local = append(local, append([]string{"vendor"}, strings.Split(i, "/")...))
+		} else if i == importpath {
 			local = append(local, []string{})
 		} else if strings.HasPrefix(i, importpath+"/") {
 			local = append(local, strings.Split(strings.TrimPrefix(i, importpath+"/"), "/"))
@@ -110,11 +175,37 @@ func analysePackage(root, source, importpath string, stdlib map[string]bool) (pk
 			// The value is a list, presumably because an import can appear
 			// multiple times in a package. Let’s just take the first one,
 			// should be enough for a good error message.
-			firstPos := p.ImportPos[i][0].String()
+			firstPos := positions[i][0].String()
 			foreign = append(foreign, foreignDep{Path: i, Position: firstPos})
 		}
 	}
 
+	return local, foreign
+}
+
+// analysePackage loads and analyses the imports of a single Go
+// package, returning the data that is required by the Nix code to
+// generate a derivation for this package.
+//
+// Imports of vendored packages are local dependencies on the packages
+// in the vendor directory.
+func analysePackage(ctx build.Context, root, source, importpath string, stdlib, vendored map[string]bool) (pkg, error) {
+	p, err := ctx.ImportDir(source, build.IgnoreVendor)
+	if err != nil {
+		return pkg{}, err
+	}
+
+	if ctx.CgoEnabled && len(p.CgoFiles) > 0 && (len(p.CXXFiles) > 0 || len(p.MFiles) > 0 || len(p.FFiles) > 0) {
+		return pkg{}, fmt.Errorf("only C sources are supported in cgo packages")
+	}
+
+	embed, err := resolveEmbed(source, p.EmbedPatterns)
+	if err != nil {
+		return pkg{}, err
+	}
+
+	local, foreign := classifyImports(p.Imports, p.ImportPos, importpath, "", stdlib, vendored)
+
 	prefix := strings.TrimPrefix(source, root+"/")
 
 	locator := []string{}
@@ -126,27 +217,126 @@ func analysePackage(root, source, importpath string, stdlib map[string]bool) (pk
 		prefix = ""
 	}
 
-	files := []string{}
-	for _, f := range p.GoFiles {
-		files = append(files, path.Join(prefix, f))
+	withPrefix := func(names []string) []string {
+		files := []string{}
+		for _, f := range names {
+			files = append(files, path.Join(prefix, f))
+		}
+		return files
 	}
 
-	sfiles := []string{}
-	for _, f := range p.SFiles {
-		sfiles = append(sfiles, path.Join(prefix, f))
-	}
+	files := withPrefix(p.GoFiles)
+	sfiles := withPrefix(p.SFiles)
+
+	name := path.Join(importpath, prefix)
+	tests := analyseTests(p, source, importpath, name, stdlib, vendored, withPrefix(p.TestGoFiles), withPrefix(p.XTestGoFiles))
 
 	return pkg{
-		Name:        path.Join(importpath, prefix),
-		Locator:     locator,
-		Files:       files,
-		SFiles:      sfiles,
-		LocalDeps:   local,
-		ForeignDeps: foreign,
-		IsCommand:   p.IsCommand(),
+		Name:         name,
+		Locator:      locator,
+		Files:        files,
+		SFiles:       sfiles,
+		Embed:        embed,
+		CgoFiles:     withPrefix(p.CgoFiles),
+		CFiles:       withPrefix(p.CFiles),
+		HFiles:       withPrefix(p.HFiles),
+		CgoCFLAGS:    append(append([]string{}, p.CgoCPPFLAGS...), p.CgoCFLAGS...),
+		CgoLDFLAGS:   append([]string{}, p.CgoLDFLAGS...),
+		CgoPkgConfig: append([]string{}, p.CgoPkgConfig...),
+		LocalDeps:    local,
+		ForeignDeps:  foreign,
+		IsCommand:    p.IsCommand(),
+		Test:         tests,
 	}, nil
 }
 
+// sortPackages sorts packages by their locator, and the files and
+// dependencies of each package by name, so that the output of the
+// analyser is reproducible.
+func sortPackages(pkgs []pkg) {
+	sort.Slice(pkgs, func(i, j int) bool {
+		return strings.Join(pkgs[i].Locator, "/") < strings.Join(pkgs[j].Locator, "/")
+	})
+
+	for i := range pkgs {
+		p := &pkgs[i]
+		for _, files := range [][]string{p.Files, p.SFiles, p.CgoFiles, p.CFiles, p.HFiles} {
+			sort.Strings(files)
+		}
+
+		sort.Slice(p.LocalDeps, func(i, j int) bool {
+			return strings.Join(p.LocalDeps[i], "/") < strings.Join(p.LocalDeps[j], "/")
+		})
+		sort.Slice(p.ForeignDeps, func(i, j int) bool {
+			return p.ForeignDeps[i].Path < p.ForeignDeps[j].Path
+		})
+
+		if t := p.Test; t != nil {
+			sort.Strings(t.TestGoFiles)
+			sort.Strings(t.XTestGoFiles)
+			sort.Slice(t.LocalDeps, func(i, j int) bool {
+				return strings.Join(t.LocalDeps[i], "/") < strings.Join(t.LocalDeps[j], "/")
+			})
+			sort.Slice(t.ForeignDeps, func(i, j int) bool {
+				return t.ForeignDeps[i].Path < t.ForeignDeps[j].Path
+			})
+		}
+	}
+}
+
+// analyseAll analyses the packages in all Go directories of the
+// source, and all vendored packages, for the platform and build tags of
+// the build context.
+func analyseAll(ctx build.Context, source, importpath string, goDirs []string, vendor *vendorInfo, stdlib map[string]bool) ([]pkg, error) {
+	// Vendored packages are analysed under their real import paths, and
+	// located in the "vendor" attribute of the package tree.
+	vendored := make(map[string]bool)
+	if vendor != nil {
+		for _, p := range vendor.Packages {
+			vendored[p] = true
+		}
+	}
+
+	all := []pkg{}
+	for _, d := range goDirs {
+		analysed, err := analysePackage(ctx, source, d, importpath, stdlib, vendored)
+
+		// If the Go source analysis returned "no buildable Go files",
+		// that directory should be skipped.
+		//
+		// This might be due to `+build` flags on the platform and other
+		// reasons (such as test files).
+		if _, ok := err.(*build.NoGoError); ok {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to analyse package at %q: %w", d, err)
+		}
+		all = append(all, analysed)
+	}
+
+	if vendor != nil {
+		for _, p := range vendor.Packages {
+			d := filepath.Join(source, "vendor", filepath.FromSlash(p))
+			analysed, err := analysePackage(ctx, source, d, importpath, stdlib, vendored)
+			if _, ok := err.(*build.NoGoError); ok {
+				continue
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to analyse vendored package %q: %w", p, err)
+			}
+
+			analysed.Name = p
+			all = append(all, analysed)
+		}
+	}
+
+	sortPackages(all)
+	return all, nil
+}
+
 func loadStdlibPkgs(from string) (pkgs map[string]bool, err error) {
 	f, err := ioutil.ReadFile(from)
 	if err != nil {
@@ -159,7 +349,12 @@ func loadStdlibPkgs(from string) (pkgs map[string]bool, err error) {
 
 func main() {
 	source := flag.String("source", "", "path to directory with sources to process")
-	path := flag.String("path", "", "import path for the package")
+	path := flag.String("path", "", "import path for the package (defaults to the module path in go.mod)")
+	cgo := flag.Bool("cgo", false, "analyse cgo files of packages")
+	goos := flag.String("goos", build.Default.GOOS, "target operating system")
+	goarch := flag.String("goarch", build.Default.GOARCH, "target architecture")
+	tags := flag.String("tags", "", "comma-separated list of additional build tags")
+	platforms := flag.String("platforms", "", "comma-separated list of goos/goarch pairs to analyse instead of -goos and -goarch")
 
 	flag.Parse()
 
@@ -167,35 +362,82 @@ func main() {
 		log.Fatalf("-source flag must be specified")
 	}
 
+	mod, err := readModule(filepath.Join(*source, "go.mod"))
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("failed to read module file: %s", err)
+	}
+
+	if *path == "" {
+		if mod == nil {
+			log.Fatalf("-path flag must be specified for sources without a go.mod file")
+		}
+		*path = mod.Path
+	}
+
 	stdlibPkgs, err := loadStdlibPkgs(stdlibList)
 	if err != nil {
 		log.Fatalf("failed to load standard library index from %q: %s\n", stdlibList, err)
 	}
 
-	goDirs, err := findGoDirs(*source)
+	vendor, err := readVendor(*source)
+	if err != nil {
+		log.Fatalf("failed to read vendored modules: %s", err)
+	}
+
+	goDirs, err := findGoDirs(*source, vendor != nil)
 	if err != nil {
 		log.Fatalf("failed to walk source directory '%s': %s", *source, err)
 	}
 
-	all := []pkg{}
-	for _, d := range goDirs {
-		analysed, err := analysePackage(*source, d, *path, stdlibPkgs)
+	ctx := build.Default
+	ctx.CgoEnabled = *cgo
+	ctx.GOOS = *goos
+	ctx.GOARCH = *goarch
+	if *tags != "" {
+		ctx.BuildTags = strings.Split(*tags, ",")
+	}
 
-		// If the Go source analysis returned "no buildable Go files",
-		// that directory should be skipped.
-		//
-		// This might be due to `+build` flags on the platform and other
-		// reasons (such as test files).
-		if _, ok := err.(*build.NoGoError); ok {
-			continue
-		}
+	result := analysis{
+		SchemaVersion: schemaVersion,
+		Analyser: metadata{
+			GoVersion: runtime.Version(),
+			Goos:      ctx.GOOS,
+			Goarch:    ctx.GOARCH,
+			Tags:      append([]string{}, ctx.BuildTags...),
+			Cgo:       ctx.CgoEnabled,
+		},
+		Module:   mod,
+		Vendored: []modVersion{},
+	}
+
+	if vendor != nil {
+		result.Vendored = vendor.Modules
+	}
 
+	if *platforms == "" {
+		result.Packages, err = analyseAll(ctx, *source, *path, goDirs, vendor, stdlibPkgs)
 		if err != nil {
-			log.Fatalf("failed to analyse package at %q: %s", d, err)
+			log.Fatalln(err)
+		}
+	} else {
+		result.Analyser.Goos, result.Analyser.Goarch = "", ""
+		result.Analyser.Platforms = strings.Split(*platforms, ",")
+		result.Platforms = make(map[string][]pkg)
+		for _, platform := range strings.Split(*platforms, ",") {
+			goos, goarch, ok := strings.Cut(platform, "/")
+			if !ok {
+				log.Fatalf("invalid platform %q, expected goos/goarch", platform)
+			}
+
+			ctx.GOOS = goos
+			ctx.GOARCH = goarch
+			result.Platforms[platform], err = analyseAll(ctx, *source, *path, goDirs, vendor, stdlibPkgs)
+			if err != nil {
+				log.Fatalf("%s: %s", platform, err)
+			}
 		}
-		all = append(all, analysed)
 	}
 
-	j, _ := json.Marshal(all)
+	j, _ := json.Marshal(result)
 	fmt.Println(string(j))
 }
@@ -0,0 +1,154 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This file implements finding the tests, benchmarks, fuzz targets and
+// examples in test files the same way as `go test`. It is shared with
+// the testmain generator in ../testmain.
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"unicode"
+	"unicode/utf8"
+)
+
+// testFunc is a test function in a test file.
+type testFunc struct {
+	Name string `json:"name"`
+
+	// Whether the function is in an external test file.
+	XTest bool `json:"xtest"`
+}
+
+// testFuncs lists the test functions of a package, in the order in
+// which they are defined.
+type testFuncs struct {
+	Tests       []testFunc `json:"tests"`
+	Benchmarks  []testFunc `json:"benchmarks"`
+	FuzzTargets []testFunc `json:"fuzzTargets"`
+	Examples    []example  `json:"examples"`
+
+	// TestMain function of the package, if any.
+	Main *testFunc `json:"main"`
+}
+
+// example is an example function with output, which is run as a test.
+// Examples without an output comment are compiled, but not run.
+type example struct {
+	testFunc
+	Output    string `json:"output"`
+	Unordered bool   `json:"unordered"`
+}
+
+// isTest returns true if name is a test function name with the given
+// prefix, e.g. "TestFoo" but not "Testfoo".
+func isTest(name, prefix string) bool {
+	if len(name) < len(prefix) || name[:len(prefix)] != prefix {
+		return false
+	}
+
+	if len(name) == len(prefix) {
+		return true
+	}
+
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// isTestFunc returns true if the function takes a single argument of
+// type *testing.<arg> and has no results or type parameters.
+func isTestFunc(fn *ast.FuncDecl, arg string) bool {
+	if fn.Type.Results != nil && len(fn.Type.Results.List) > 0 ||
+		fn.Type.Params.List == nil ||
+		len(fn.Type.Params.List) != 1 ||
+		len(fn.Type.Params.List[0].Names) > 1 ||
+		fn.Type.TypeParams != nil {
+		return false
+	}
+
+	ptr, ok := fn.Type.Params.List[0].Type.(*ast.StarExpr)
+	if !ok {
+		return false
+	}
+
+	// How the testing package is imported is not known, so only the
+	// name of the type is checked.
+	if name, ok := ptr.X.(*ast.Ident); ok && name.Name == arg {
+		return true
+	}
+
+	if sel, ok := ptr.X.(*ast.SelectorExpr); ok && sel.Sel.Name == arg {
+		return true
+	}
+
+	return false
+}
+
+// findTestFuncs adds the test functions in the given test files of the
+// package in dir to info.
+func findTestFuncs(info *testFuncs, dir string, files []string, xtest bool) error {
+	fset := token.NewFileSet()
+
+	for _, name := range files {
+		f, err := parser.ParseFile(fset, filepath.Join(dir, name), nil, parser.ParseComments)
+		if err != nil {
+			return err
+		}
+
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv != nil {
+				continue
+			}
+
+			fun := testFunc{Name: fn.Name.Name, XTest: xtest}
+			pos := fset.Position(fn.Pos())
+
+			switch {
+			case fun.Name == "TestMain" && isTestFunc(fn, "M"):
+				if info.Main != nil {
+					return fmt.Errorf("%s: multiple definitions of TestMain", pos)
+				}
+				info.Main = &fun
+
+			case isTest(fun.Name, "Test"):
+				if !isTestFunc(fn, "T") {
+					return fmt.Errorf("%s: wrong signature for %s, must be: func %s(t *testing.T)", pos, fun.Name, fun.Name)
+				}
+				info.Tests = append(info.Tests, fun)
+
+			case isTest(fun.Name, "Benchmark"):
+				if !isTestFunc(fn, "B") {
+					return fmt.Errorf("%s: wrong signature for %s, must be: func %s(b *testing.B)", pos, fun.Name, fun.Name)
+				}
+				info.Benchmarks = append(info.Benchmarks, fun)
+
+			case isTest(fun.Name, "Fuzz"):
+				if !isTestFunc(fn, "F") {
+					return fmt.Errorf("%s: wrong signature for %s, must be: func %s(f *testing.F)", pos, fun.Name, fun.Name)
+				}
+				info.FuzzTargets = append(info.FuzzTargets, fun)
+			}
+		}
+
+		for _, e := range doc.Examples(f) {
+			if e.Output == "" && !e.EmptyOutput {
+				continue
+			}
+
+			info.Examples = append(info.Examples, example{
+				testFunc:  testFunc{Name: "Example" + e.Name, XTest: xtest},
+				Output:    e.Output,
+				Unordered: e.Unordered,
+			})
+		}
+	}
+
+	return nil
+}
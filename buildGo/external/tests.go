@@ -0,0 +1,92 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This file implements the analysis of the test files of a package.
+
+package main
+
+import (
+	"go/build"
+	"go/token"
+)
+
+// testInfo describes the tests of a package.
+//
+// Test files in the package itself ("internal" tests) and in the
+// package with the "_test" suffix ("external" tests) are listed
+// separately, but share their dependencies.
+type testInfo struct {
+	TestGoFiles  []string `json:"testGoFiles"`
+	XTestGoFiles []string `json:"xTestGoFiles"`
+
+	// Dependencies of the test files, excluding the package under test.
+	LocalDeps   [][]string   `json:"localDeps"`
+	ForeignDeps []foreignDep `json:"foreignDeps"`
+
+	// Files embedded by the test files, relative to the package
+	// directory.
+	Embed map[string][]string `json:"embed"`
+
+	// Error that prevents the tests from being built, such as a test
+	// function with the wrong signature. It only fails the build of
+	// the tests, not that of the package.
+	Error *string `json:"error"`
+
+	testFuncs
+}
+
+// analyseTests analyses the test files of a package, which are given
+// relative to the source root. Errors in the test files are recorded
+// in the result instead of being returned.
+func analyseTests(p *build.Package, source, importpath, self string, stdlib, vendored map[string]bool, testFiles, xtestFiles []string) *testInfo {
+	if len(p.TestGoFiles) == 0 && len(p.XTestGoFiles) == 0 {
+		return nil
+	}
+
+	info := testInfo{
+		TestGoFiles:  testFiles,
+		XTestGoFiles: xtestFiles,
+		testFuncs: testFuncs{
+			Tests:       []testFunc{},
+			Benchmarks:  []testFunc{},
+			FuzzTargets: []testFunc{},
+			Examples:    []example{},
+		},
+	}
+
+	imports := append(append([]string{}, p.TestImports...), p.XTestImports...)
+	positions := make(map[string][]token.Position)
+	for _, m := range []map[string][]token.Position{p.XTestImportPos, p.TestImportPos} {
+		for i, pos := range m {
+			positions[i] = pos
+		}
+	}
+
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, i := range imports {
+		if !seen[i] {
+			seen[i] = true
+			unique = append(unique, i)
+		}
+	}
+	info.LocalDeps, info.ForeignDeps = classifyImports(unique, positions, importpath, self, stdlib, vendored)
+
+	info.Embed = map[string][]string{}
+	embed, err := resolveEmbed(source, append(append([]string{}, p.TestEmbedPatterns...), p.XTestEmbedPatterns...))
+	if err == nil {
+		info.Embed = embed
+		err = findTestFuncs(&info.testFuncs, source, p.TestGoFiles, false)
+	}
+
+	if err == nil {
+		err = findTestFuncs(&info.testFuncs, source, p.XTestGoFiles, true)
+	}
+
+	if err != nil {
+		msg := err.Error()
+		info.Error = &msg
+	}
+
+	return &info
+}
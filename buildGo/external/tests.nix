@@ -0,0 +1,27 @@
+# Copyright 2026 The TVL Authors
+# SPDX-License-Identifier: Apache-2.0
+
+# Validates the output of the analyser against analysis.schema.json,
+# which the analysis itself does not do to keep it free of anything
+# but Go. buildGo's own sources serve as the analysed source.
+{ pkgs, external }:
+
+let
+  inherit (pkgs) lib runCommand check-jsonschema;
+
+  # The example mixes two packages in one directory, which the
+  # analyser rejects.
+  src = lib.cleanSourceWith {
+    src = ./..;
+    filter = path: type: baseNameOf path != "example";
+  };
+
+  tree = external {
+    inherit src;
+    path = "code.tvl.fyi/nix/buildGo";
+  };
+in
+runCommand "buildgo-analysis-schema" { } ''
+  ${check-jsonschema}/bin/check-jsonschema --schemafile ${./analysis.schema.json} ${tree.goanalysis}
+  touch $out
+''
@@ -0,0 +1,81 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This file implements support for sources that vendor their
+// dependencies, as described by `vendor/modules.txt`.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vendorInfo describes the vendored dependencies of a module.
+type vendorInfo struct {
+	// Modules that are vendored, under the path that they are
+	// imported with (i.e. before replacements).
+	Modules []modVersion
+
+	// Import paths of all vendored packages.
+	Packages []string
+}
+
+// readVendor reads `vendor/modules.txt` in the source directory. It
+// returns nil if the source does not vendor its dependencies.
+func readVendor(root string) (*vendorInfo, error) {
+	file := filepath.Join(root, "vendor", "modules.txt")
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := vendorInfo{
+		Modules:  []modVersion{},
+		Packages: []string{},
+	}
+
+	// Packages are listed below the line naming their module, e.g.:
+	//
+	//   # golang.org/x/sys v0.1.0
+	//   ## explicit; go 1.17
+	//   golang.org/x/sys/unix
+	//
+	// Replacements without any packages are listed as "# old => new".
+	inModule := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "## "):
+			continue
+
+		case strings.HasPrefix(line, "# "):
+			fields := strings.Fields(line[2:])
+			inModule = len(fields) >= 2 && fields[1] != "=>"
+			if inModule {
+				info.Modules = append(info.Modules, modVersion{Path: fields[0], Version: fields[1]})
+			}
+
+		case inModule:
+			info.Packages = append(info.Packages, line)
+
+		default:
+			return nil, fmt.Errorf("%s: package %s is not part of a vendored module", file, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	return &info, nil
+}
@@ -0,0 +1,96 @@
+# Copyright 2026 The TVL Authors
+# SPDX-License-Identifier: Apache-2.0
+{ pkgs, program, external }:
+
+let
+  inherit (builtins)
+    attrNames
+    attrValues
+    concatMap
+    filter
+    fromJSON
+    isAttrs
+    listToAttrs
+    readFile
+    replaceStrings
+    substring;
+
+  inherit (pkgs) lib runCommand fetchurl unzip;
+
+  pathToName = p: replaceStrings [ "/" "~" ] [ "_" "_" ] (toString p);
+
+  # Tool generating lock files, e.g.:
+  #
+  #   $(nix-build -A gomodlock)/bin/gomodlock -o gomod.lock.json
+  gomodlock = program {
+    name = "gomodlock";
+
+    srcs = [
+      ../external/gomod.go
+      ./main.go
+    ];
+  };
+
+  # Fetch the source directory of a locked module. Local replacements
+  # are relative to the source of the main module.
+  fetchModule = src: m:
+    if m.source.type == "local"
+    then
+      (if substring 0 1 m.source.dir == "/" then /. + m.source.dir else src + "/${m.source.dir}")
+    else
+      runCommand "gomod-${pathToName m.source.module}-${m.source.version}"
+        {
+          nativeBuildInputs = [ unzip ];
+          zip = fetchurl {
+            url = m.source.url;
+            hash = m.source.sha256;
+          };
+        } ''
+        unzip -q $zip
+        mv "${m.source.module}@${m.source.version}" $out
+      '';
+
+  # Collect all library packages in a tree created by buildGo.external.
+  packagesOf = tree:
+    (lib.optional (tree ? gopkg && tree.gopkg ? goImportPath) tree)
+    ++ concatMap packagesOf (filter isAttrs (attrValues (removeAttrs tree [ "gopkg" "gotest" "gocoverage" "goanalysis" ])));
+
+in
+{
+  inherit gomodlock;
+
+  # Build the main module in `src` and all modules it depends on from
+  # a lock file generated by gomodlock.
+  #
+  # Every module can use packages from all other locked modules, which
+  # are matched by import path. With cgo, all modules are built with
+  # cgo, using the C libraries in cdeps.
+  modules = { src, lockFile ? src + "/gomod.lock.json", cgo ? false, cdeps ? [ ] }:
+    let
+      lock = fromJSON (readFile lockFile);
+
+      depsExcept = path: concatMap (p: packagesOf modules."${p}")
+        (filter (p: p != path) (attrNames modules));
+
+      modules = listToAttrs (map
+        (m: {
+          name = m.path;
+          value = external {
+            inherit (m) path;
+            inherit cgo cdeps;
+            src = fetchModule src m;
+            deps = depsExcept m.path;
+          };
+        })
+        lock.modules);
+    in
+    {
+      inherit modules;
+
+      main = external {
+        inherit src cgo cdeps;
+        path = lock.module;
+        deps = depsExcept null;
+      };
+    };
+}
@@ -0,0 +1,445 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This tool resolves the module graph of a Go module from its `go.mod`
+// and `go.sum` files, and writes a lock file from which Nix can fetch
+// and build every module with `buildGo.external`.
+//
+// The `go.mod` reader is shared with the analyser in ../external.
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// lockFile is the format of the generated lock file.
+type lockFile struct {
+	// Path and Go version of the main module.
+	Module    string `json:"module"`
+	GoVersion string `json:"goVersion"`
+
+	// All modules in the build list of the main module, sorted by
+	// their path.
+	Modules []lockedModule `json:"modules"`
+}
+
+// lockedModule describes a single module that the main module
+// depends on.
+type lockedModule struct {
+	// Path under which the module's packages are imported, and the
+	// version selected by the main module.
+	Path    string `json:"path"`
+	Version string `json:"version"`
+
+	// Go checksum database hash of the module's contents (from go.sum).
+	// Empty for local replacements.
+	Hash string `json:"hash,omitempty"`
+
+	Source source `json:"source"`
+}
+
+// source describes where the contents of a module are fetched from.
+type source struct {
+	// Either "proxy" for module zips fetched from a module proxy, or
+	// "local" for replacements with a local directory.
+	Type string `json:"type"`
+
+	// Module path and version of the zip, which differ from the
+	// locked module if it has been replaced.
+	Module  string `json:"module,omitempty"`
+	Version string `json:"version,omitempty"`
+	Url     string `json:"url,omitempty"`
+
+	// SRI hash of the zip file, as used by Nix's fetchurl.
+	Sha256 string `json:"sha256,omitempty"`
+
+	// Directory of a local replacement, relative to the main module.
+	Dir string `json:"dir,omitempty"`
+}
+
+// escapePath escapes a module path or version for use in module proxy
+// URLs and module cache paths, which replaces upper-case letters with
+// an exclamation mark followed by the lower-case letter.
+func escapePath(p string) string {
+	var b strings.Builder
+	for _, r := range p {
+		if unicode.IsUpper(r) {
+			b.WriteRune('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// compareVersions compares two semantic versions (with the leading
+// 'v'), returning -1, 0 or 1 like strings.Compare.
+func compareVersions(a, b string) int {
+	split := func(v string) ([]string, []string) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexByte(v, '+'); i >= 0 {
+			v = v[:i]
+		}
+
+		pre := []string{}
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			pre = strings.Split(v[i+1:], ".")
+			v = v[:i]
+		}
+
+		return strings.Split(v, "."), pre
+	}
+
+	// Identifiers are compared numerically if both are numbers, and
+	// numbers sort before other identifiers.
+	compareIdent := func(x, y string) int {
+		nx, errx := strconv.Atoi(x)
+		ny, erry := strconv.Atoi(y)
+		switch {
+		case errx == nil && erry == nil:
+			return compareInts(nx, ny)
+		case errx == nil:
+			return -1
+		case erry == nil:
+			return 1
+		}
+		return strings.Compare(x, y)
+	}
+
+	coreA, preA := split(a)
+	coreB, preB := split(b)
+
+	for i := 0; i < len(coreA) && i < len(coreB); i++ {
+		if c := compareIdent(coreA[i], coreB[i]); c != 0 {
+			return c
+		}
+	}
+
+	// Releases sort after their pre-releases.
+	switch {
+	case len(preA) == 0 && len(preB) == 0:
+		return 0
+	case len(preA) == 0:
+		return 1
+	case len(preB) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(preA) && i < len(preB); i++ {
+		if c := compareIdent(preA[i], preB[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(preA), len(preB))
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// readSums reads a `go.sum` file into a map from "path version" to the
+// hash of the module's contents. Hashes of `go.mod` files are skipped.
+func readSums(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: malformed line", file, lineNo)
+		}
+
+		if !strings.HasSuffix(fields[1], "/go.mod") {
+			sums[fields[0]+" "+fields[1]] = fields[2]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	return sums, nil
+}
+
+// buildList returns the modules selected by the main module, with the
+// highest required version of each module.
+//
+// Since Go 1.17, the `go.mod` file of a module lists every module that
+// provides a package imported by it (module graph pruning), so the
+// build list can be determined without reading the `go.mod` files of
+// any dependencies.
+func buildList(mod *module) ([]modVersion, error) {
+	if mod.GoVersion == "" || compareVersions(mod.GoVersion, "1.17") < 0 {
+		return nil, fmt.Errorf("module %s declares go %q, but resolving its dependencies requires go 1.17 or later (run `go mod tidy -go=1.17`)", mod.Path, mod.GoVersion)
+	}
+
+	selected := make(map[string]string)
+	for _, req := range mod.Require {
+		if v, ok := selected[req.Path]; !ok || compareVersions(req.Version, v) > 0 {
+			selected[req.Path] = req.Version
+		}
+	}
+
+	for _, ex := range mod.Exclude {
+		if selected[ex.Path] == ex.Version {
+			return nil, fmt.Errorf("required module %s@%s is excluded (run `go mod tidy` to select another version)", ex.Path, ex.Version)
+		}
+	}
+
+	list := []modVersion{}
+	for path, version := range selected {
+		list = append(list, modVersion{Path: path, Version: version})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+
+	return list, nil
+}
+
+// replacement returns the replacement of a module, if any. Replacements
+// of a specific version take precedence over those of all versions.
+func replacement(mod *module, m modVersion) (modVersion, bool) {
+	var found *replace
+	for i, r := range mod.Replace {
+		if r.Old.Path != m.Path {
+			continue
+		}
+
+		if r.Old.Version == m.Version {
+			return r.New, true
+		}
+
+		if r.Old.Version == "" {
+			found = &mod.Replace[i]
+		}
+	}
+
+	if found == nil {
+		return modVersion{}, false
+	}
+	return found.New, true
+}
+
+// httpClient is used for downloads from the module proxy. The timeout
+// covers the whole download of a module zip.
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// fetchZip returns the zip file of a module, either from the local
+// module cache or from the module proxy.
+func fetchZip(proxy, cache string, m modVersion) ([]byte, error) {
+	name := escapePath(m.Path) + "/@v/" + escapePath(m.Version) + ".zip"
+
+	if cache != "" {
+		data, err := os.ReadFile(filepath.Join(cache, "cache", "download", filepath.FromSlash(name)))
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	resp, err := httpClient.Get(proxy + "/" + name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s@%s: %w", m.Path, m.Version, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s@%s: %s", m.Path, m.Version, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// hashZip computes the "h1:" hash of the files in a module zip, as it
+// is recorded in `go.sum`.
+func hashZip(data []byte) (string, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	files := []*zip.File{}
+	for _, f := range r.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	var summary strings.Builder
+	for _, f := range files {
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", f.Name, err)
+		}
+
+		fmt.Fprintf(&summary, "%x  %s\n", h.Sum(nil), f.Name)
+	}
+
+	hash := sha256.Sum256([]byte(summary.String()))
+	return "h1:" + base64.StdEncoding.EncodeToString(hash[:]), nil
+}
+
+// lockModule determines the source of a single module in the build
+// list, verifying the contents of fetched zips against `go.sum`.
+func lockModule(mod *module, sums map[string]string, proxy, cache string, m modVersion) (lockedModule, error) {
+	locked := lockedModule{Path: m.Path, Version: m.Version}
+
+	fetch := m
+	if r, ok := replacement(mod, m); ok {
+		if r.Version == "" {
+			locked.Source = source{Type: "local", Dir: r.Path}
+			return locked, nil
+		}
+		fetch = r
+	}
+
+	hash, ok := sums[fetch.Path+" "+fetch.Version]
+	if !ok {
+		return locked, fmt.Errorf("missing go.sum entry for %s@%s (run `go mod download %s`)", fetch.Path, fetch.Version, fetch.Path)
+	}
+
+	data, err := fetchZip(proxy, cache, fetch)
+	if err != nil {
+		return locked, err
+	}
+
+	actual, err := hashZip(data)
+	if err != nil {
+		return locked, fmt.Errorf("invalid zip for %s@%s: %w", fetch.Path, fetch.Version, err)
+	}
+
+	if actual != hash {
+		return locked, fmt.Errorf("checksum mismatch for %s@%s: go.sum has %s, downloaded zip has %s", fetch.Path, fetch.Version, hash, actual)
+	}
+
+	zipHash := sha256.Sum256(data)
+	locked.Hash = hash
+	locked.Source = source{
+		Type:    "proxy",
+		Module:  fetch.Path,
+		Version: fetch.Version,
+		Url:     proxy + "/" + escapePath(fetch.Path) + "/@v/" + escapePath(fetch.Version) + ".zip",
+		Sha256:  "sha256-" + base64.StdEncoding.EncodeToString(zipHash[:]),
+	}
+
+	return locked, nil
+}
+
+// goProxy returns the first module proxy configured in GOPROXY.
+func goProxy() (string, error) {
+	for _, p := range strings.FieldsFunc(os.Getenv("GOPROXY"), func(r rune) bool { return r == ',' || r == '|' }) {
+		if p == "direct" || p == "off" {
+			return "", fmt.Errorf("GOPROXY=%s is not supported, module zips must be fetched from a proxy", p)
+		}
+		return strings.TrimSuffix(p, "/"), nil
+	}
+	return "https://proxy.golang.org", nil
+}
+
+// goModCache returns the location of the local module cache.
+func goModCache() string {
+	if cache := os.Getenv("GOMODCACHE"); cache != "" {
+		return cache
+	}
+
+	if gopath := os.Getenv("GOPATH"); gopath != "" {
+		return filepath.Join(filepath.SplitList(gopath)[0], "pkg", "mod")
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, "go", "pkg", "mod")
+	}
+
+	return ""
+}
+
+func main() {
+	source := flag.String("source", ".", "path to the directory containing go.mod and go.sum")
+	output := flag.String("o", "", "path of the lock file to write (defaults to stdout)")
+
+	flag.Parse()
+
+	mod, err := readModule(filepath.Join(*source, "go.mod"))
+	if err != nil {
+		log.Fatalf("failed to read module file: %s", err)
+	}
+
+	sums, err := readSums(filepath.Join(*source, "go.sum"))
+	if err != nil && !(os.IsNotExist(err) && len(mod.Require) == 0) {
+		log.Fatalf("failed to read checksums: %s", err)
+	}
+
+	list, err := buildList(mod)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	proxy, err := goProxy()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	cache := goModCache()
+
+	lock := lockFile{
+		Module:    mod.Path,
+		GoVersion: mod.GoVersion,
+		Modules:   []lockedModule{},
+	}
+
+	for _, m := range list {
+		locked, err := lockModule(mod, sums, proxy, cache, m)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		lock.Modules = append(lock.Modules, locked)
+	}
+
+	j, _ := json.MarshalIndent(lock, "", "  ")
+	j = append(j, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(j)
+	} else if err := os.WriteFile(*output, j, 0644); err != nil {
+		log.Fatalf("failed to write lock file: %s", err)
+	}
+}
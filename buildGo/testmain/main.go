@@ -0,0 +1,203 @@
+// Copyright 2026 The TVL Authors
+// SPDX-License-Identifier: Apache-2.0
+
+// This tool generates the `_testmain.go` file of a test binary, which
+// registers the tests, benchmarks, fuzz targets and examples of a
+// package with the testing package, the same way as `go test`. For
+// packages instrumented for coverage, it also sets up the collection
+// of coverage data.
+//
+// The discovery of test functions is shared with the analyser in
+// ../external.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// testmain is the input of the template.
+type testmain struct {
+	ImportPath string
+
+	// Whether the package has internal and external test files, and
+	// whether the generated code refers to functions in them.
+	ImportTest, NeedTest   bool
+	ImportXTest, NeedXTest bool
+
+	// Coverage mode and the import paths of the packages instrumented
+	// for coverage, if any.
+	CoverMode     string
+	CoverPackages []string
+
+	testFuncs
+}
+
+// Covered describes the covered packages in the coverage summary
+// of the test binary, if they are not just the package under test.
+func (t *testmain) Covered() string {
+	if len(t.CoverPackages) == 1 && t.CoverPackages[0] == t.ImportPath {
+		return ""
+	}
+	return " in " + strings.Join(t.CoverPackages, ", ")
+}
+
+// Package returns the name under which the package containing a test
+// function is imported.
+func (t testFunc) Package() string {
+	if t.XTest {
+		return "_xtest"
+	}
+	return "_test"
+}
+
+var testmainTmpl = template.Must(template.New("main").Parse(`
+// Code generated by buildGo testmain. DO NOT EDIT.
+
+package main
+
+import (
+	"os"
+{{- if .Main}}
+	"reflect"
+{{- end}}
+	"testing"
+	"testing/internal/testdeps"
+{{- if .CoverMode}}
+	"internal/coverage/cfile"
+{{- end}}
+
+{{- if .ImportTest}}
+	{{if .NeedTest}}_test{{else}}_{{end}} {{printf "%q" .ImportPath}}
+{{- end}}
+{{- if .ImportXTest}}
+	{{if .NeedXTest}}_xtest{{else}}_{{end}} {{printf "%q" (print .ImportPath "_test")}}
+{{- end}}
+)
+
+var tests = []testing.InternalTest{
+{{- range .Tests}}
+	{ {{- printf "%q" .Name}}, {{.Package}}.{{.Name -}} },
+{{- end}}
+}
+
+var benchmarks = []testing.InternalBenchmark{
+{{- range .Benchmarks}}
+	{ {{- printf "%q" .Name}}, {{.Package}}.{{.Name -}} },
+{{- end}}
+}
+
+var fuzzTargets = []testing.InternalFuzzTarget{
+{{- range .FuzzTargets}}
+	{ {{- printf "%q" .Name}}, {{.Package}}.{{.Name -}} },
+{{- end}}
+}
+
+var examples = []testing.InternalExample{
+{{- range .Examples}}
+	{ {{- printf "%q" .Name}}, {{.Package}}.{{.Name}}, {{printf "%q" .Output}}, {{.Unordered -}} },
+{{- end}}
+}
+
+func init() {
+{{- if .CoverMode}}
+	testdeps.CoverMode = {{printf "%q" .CoverMode}}
+	testdeps.Covered = {{printf "%q" .Covered}}
+	testdeps.CoverSelectedPackages = {{printf "%#v" .CoverPackages}}
+	testdeps.CoverSnapshotFunc = cfile.Snapshot
+	testdeps.CoverProcessTestDirFunc = cfile.ProcessCoverTestDir
+	testdeps.CoverMarkProfileEmittedFunc = cfile.MarkProfileEmitted
+{{- end}}
+	testdeps.ImportPath = {{printf "%q" .ImportPath}}
+}
+
+func main() {
+	m := testing.MainStart(testdeps.TestDeps{}, tests, benchmarks, fuzzTargets, examples)
+{{- with .Main}}
+	{{.Package}}.{{.Name}}(m)
+	os.Exit(int(reflect.ValueOf(m).Elem().FieldByName("exitCode").Int()))
+{{- else}}
+	os.Exit(m.Run())
+{{- end}}
+}
+`))
+
+// isXTest returns true if the test file belongs to the external test
+// package, i.e. its package name has the "_test" suffix.
+func isXTest(file string) (bool, error) {
+	f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.PackageClauseOnly)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.HasSuffix(f.Name.Name, "_test"), nil
+}
+
+func main() {
+	path := flag.String("path", "", "import path of the package under test")
+	output := flag.String("o", "_testmain.go", "path of the file to write")
+	coverMode := flag.String("cover", "", "coverage mode of the instrumented packages, if any")
+	coverPkgs := flag.String("coverpkgs", "", "comma-separated import paths of the instrumented packages")
+
+	flag.Parse()
+
+	if *path == "" {
+		log.Fatalf("-path flag must be specified")
+	}
+
+	t := testmain{ImportPath: *path, CoverMode: *coverMode}
+	if *coverMode != "" {
+		t.CoverPackages = strings.Split(*coverPkgs, ",")
+	}
+
+	for _, file := range flag.Args() {
+		xtest, err := isXTest(file)
+		if err != nil {
+			log.Fatalf("failed to parse test file: %s", err)
+		}
+
+		if err := findTestFuncs(&t.testFuncs, "", []string{file}, xtest); err != nil {
+			log.Fatalf("failed to find test functions: %s", err)
+		}
+
+		if xtest {
+			t.ImportXTest = true
+		} else {
+			t.ImportTest = true
+		}
+	}
+
+	all := append(append(append([]testFunc{}, t.Tests...), t.Benchmarks...), t.FuzzTargets...)
+	for _, e := range t.Examples {
+		all = append(all, e.testFunc)
+	}
+	if t.Main != nil {
+		all = append(all, *t.Main)
+	}
+
+	for _, f := range all {
+		t.NeedTest = t.NeedTest || !f.XTest
+		t.NeedXTest = t.NeedXTest || f.XTest
+	}
+
+	var buf bytes.Buffer
+	if err := testmainTmpl.Execute(&buf, &t); err != nil {
+		log.Fatalf("failed to generate testmain: %s", err)
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("generated invalid testmain: %s\n%s", err, buf.String())
+	}
+
+	if err := os.WriteFile(*output, src, 0644); err != nil {
+		log.Fatalf("failed to write testmain: %s", err)
+	}
+}
@@ -70,13 +70,15 @@ rec {
     target.__readTree
     ++ lib.optionals (target ? __subtarget) [ target.__subtarget ];
 
-  # Create a pipeline step from a single target.
-  mkStep = { headBranch, parentTargetMap, target, cancelOnBuildFailing }:
+  # Create a pipeline step from a single target. Step settings such as
+  # the agent queue can be passed in stepDefaults, and are overridden
+  # by the target's own step arguments.
+  mkStep = { headBranch, parentTargetMap, target, cancelOnBuildFailing, stepDefaults ? { } }:
     let
       label = mkLabel target;
       drvPath = unsafeDiscardStringContext target.drvPath;
     in
-    {
+    stepDefaults // {
       label = ":nix: " + label;
       key = hashString "sha1" label;
       skip = shouldSkip { inherit label drvPath parentTargetMap; };
@@ -183,6 +185,15 @@ rec {
       # To enable this feature one should enable "Fail Fast" setting
       # at Buildkite pipeline or on organization level.
     , cancelOnBuildFailing ? false
+      # Buildkite agent queue and priority of the generated steps, if
+      # any. besadii selects them with its build rules and change
+      # policies, and sets them in the BESADII_AGENT_QUEUE and
+      # BESADII_PRIORITY variables of the build, from which the
+      # pipeline definition passes them (e.g. with --argstr). Empty
+      # strings are the same as null. Steps that select their own
+      # agents keep them.
+    , agentQueue ? null
+    , priority ? null
     }:
     let
       # List of phases to include.
@@ -193,12 +204,19 @@ rec {
       # logic/optimisation depends on knowing whether is executing.
       buildEnabled = elem "build" enabledPhases;
 
+      # Settings applied to all generated steps. The priority may be
+      # passed as a string, as read from the build's variables.
+      isSet = v: v != null && v != "";
+      stepDefaults =
+        lib.optionalAttrs (isSet agentQueue) { agents.queue = agentQueue; }
+        // lib.optionalAttrs (isSet priority) { priority = lib.toInt (toString priority); };
+
       # Convert a target into all of its steps, separated by build
       # phase (as phases end up in different chunks).
       targetToSteps = target:
         let
           mkStepArgs = {
-            inherit headBranch parentTargetMap target cancelOnBuildFailing;
+            inherit headBranch parentTargetMap target cancelOnBuildFailing stepDefaults;
           };
           step = mkStep mkStepArgs;
 
@@ -216,7 +234,7 @@ rec {
 
           extraSteps = mapAttrs
             (_: steps:
-              map (mkExtraStep (targetAttrPath target) buildEnabled) steps)
+              map (step: mkExtraStep (targetAttrPath target) buildEnabled (step // { inherit stepDefaults; })) steps)
             splitExtraSteps;
         in
         if !buildEnabled then extraSteps
@@ -384,13 +402,14 @@ rec {
     };
 
   # Create the Buildkite configuration for an extra step, optionally
-  # wrapping it in a gate group.
+  # wrapping it in a gate group. The step settings of the pipeline (if
+  # any) are passed in cfg.stepDefaults.
   mkExtraStep = parentAttrPath: buildEnabled: cfg:
     let
       # ATTN: needs to match an entry in .gitignore so that the tree won't get dirty
       commandScriptLink = "nix-buildkite-extra-step-command-script";
 
-      step = {
+      step = (cfg.stepDefaults or { }) // {
         key = hashString "sha1" "${cfg.label}-${cfg.parentLabel}";
         label = ":gear: ${cfg.label} (from ${cfg.parentLabel})";
         skip =
@@ -448,4 +467,8 @@ rec {
           inherit (cfg) label parent prompt;
         }
     else step;
+
+  # Tests of the pipeline generation, which are run as a CI subtarget.
+  tests = import ./tests.nix { inherit pkgs mkPipeline; };
+  meta.ci.targets = [ "tests" ];
 }
@@ -0,0 +1,53 @@
+# Tests for the pipeline generation, which check the steps generated
+# for an example target with jq.
+{ pkgs, mkPipeline }:
+
+let
+  target = pkgs.writeText "example" "" // {
+    __readTree = [ "example" ];
+
+    meta.ci.extraSteps = {
+      lint.command = pkgs.writeShellScript "lint" "true";
+
+      docker = {
+        command = pkgs.writeShellScript "docker" "true";
+        agents.queue = "docker";
+      };
+    };
+  };
+
+  pipeline = args: mkPipeline ({
+    headBranch = "refs/heads/canon";
+    drvTargets = [ target ];
+    activePhases = [ "build" ];
+  } // args);
+
+  # Settings passed by besadii apply to all steps, except for steps
+  # selecting their own agents.
+  withSettings = pipeline {
+    agentQueue = "large";
+    priority = "-1";
+  };
+
+  # Unset variables are passed as empty strings.
+  withEmptySettings = pipeline {
+    agentQueue = "";
+    priority = "";
+  };
+
+  withoutSettings = pipeline { };
+in
+pkgs.runCommand "buildkite-tests" { nativeBuildInputs = [ pkgs.jq ]; } ''
+  set -x
+  steps=${withSettings}/build-chunk-1.json
+  jq -e '.steps | length == 3' $steps
+  jq -e 'all(.steps[]; .priority == -1)' $steps
+  jq -e '[.steps[] | .agents.queue] | sort == ["docker", "large", "large"]' $steps
+
+  for steps in ${withEmptySettings}/build-chunk-1.json ${withoutSettings}/build-chunk-1.json; do
+    jq -e 'all(.steps[]; has("priority") | not)' $steps
+    jq -e '[.steps[] | .agents.queue] | sort == [null, null, "docker"]' $steps
+  done
+
+  touch $out
+''
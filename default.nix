@@ -16,6 +16,7 @@
 
 pkgs.lib.fix (self: {
   besadii = import ./besadii {
+    inherit pkgs;
     depot.nix.buildGo = self.buildGo;
   };
 